@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"easytc/tc"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type cmdChaos struct {
+	Targets  string        `short:"t" long:"targets" description:"yaml file with the targets and bounds of the impairments" required:"true"`
+	Seed     *int64        `long:"seed" description:"optional: random seed, to replay a previous run; default: random"`
+	Duration time.Duration `long:"duration" description:"how long to run for" required:"true"`
+	Log      *string       `long:"log" description:"optional: write the machine-readable decision log to this file instead of stdout"`
+	Plan     bool          `long:"plan" description:"only print the decisions which would be made, without applying them"`
+	Verbose  bool          `long:"verbose" description:"enable verbose logging"`
+}
+
+/*
+interface: eth0
+targets:
+  - {dst-ip: 10.0.0.5, dst-port: 443}
+  - {dst-ip: 10.0.0.0/24}
+bounds:
+  latency-ms: [0, 300]
+  loss-pct: [0, 15]
+  outage-pct: 10
+  interval: [10s, 2m]
+  pause: [0s, 30s]
+*/
+
+type chaosConfig struct {
+	Interface *string     `yaml:"interface"`
+	Targets   []*ruleArgs `yaml:"targets"`
+	Bounds    chaosBounds `yaml:"bounds"`
+	rules     []*tc.Rule
+}
+
+type chaosBounds struct {
+	LatencyMs          []float64       `yaml:"latency-ms"`
+	JitterMs           []float64       `yaml:"jitter-ms"`
+	PacketLossPct      []float64       `yaml:"loss-pct"`
+	LinkSpeedRateBytes []float64       `yaml:"rate-bytes"`
+	CorruptPct         []float64       `yaml:"corrupt-pct"`
+	OutagePct          float64         `yaml:"outage-pct"`
+	Interval           []time.Duration `yaml:"interval"`
+	Pause              []time.Duration `yaml:"pause"`
+}
+
+// a single entry of the decision log
+type chaosEvent struct {
+	Time   time.Time         `json:"time"`
+	Offset string            `json:"offset"`
+	Seq    int               `json:"seq,omitempty"`
+	Event  string            `json:"event"`
+	Seed   *int64            `json:"seed,omitempty"`
+	Target map[string]string `json:"target,omitempty"`
+	Action string            `json:"action,omitempty"`
+	Params map[string]string `json:"params,omitempty"`
+	Hold   string            `json:"hold,omitempty"`
+	Error  string            `json:"error,omitempty"`
+}
+
+// a single planned impairment
+type chaosDecision struct {
+	seq    int
+	at     time.Duration
+	hold   time.Duration
+	target int
+	outage bool
+	rule   *tc.Rule
+}
+
+func loadChaosConfig(fname string) (*chaosConfig, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	c := &chaosConfig{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err = dec.Decode(c)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fname, err)
+	}
+	if len(c.Targets) == 0 {
+		return nil, fmt.Errorf("%s: at least one target must be specified", fname)
+	}
+	for i, t := range c.Targets {
+		r, err := t.rule(c.Interface)
+		if err == nil {
+			err = checkFilter(r)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: target %d: %w", fname, i+1, err)
+		}
+		if len(actionFields(r)) > 0 {
+			return nil, fmt.Errorf("%s: target %d: targets only define filters, impairments are configured in bounds", fname, i+1)
+		}
+		c.rules = append(c.rules, r)
+	}
+	b := &c.Bounds
+	for name, v := range map[string][]float64{"latency-ms": b.LatencyMs, "jitter-ms": b.JitterMs, "loss-pct": b.PacketLossPct, "rate-bytes": b.LinkSpeedRateBytes, "corrupt-pct": b.CorruptPct} {
+		if v != nil && (len(v) != 2 || v[0] < 0 || v[1] < v[0]) {
+			return nil, fmt.Errorf("%s: bounds: %s must be [min, max]", fname, name)
+		}
+	}
+	if b.JitterMs != nil && b.LatencyMs == nil {
+		return nil, fmt.Errorf("%s: bounds: jitter-ms requires latency-ms", fname)
+	}
+	if b.LatencyMs == nil && b.PacketLossPct == nil && b.LinkSpeedRateBytes == nil && b.CorruptPct == nil && b.OutagePct == 0 {
+		return nil, fmt.Errorf("%s: bounds: at least one impairment must be configured", fname)
+	}
+	if b.OutagePct < 0 || b.OutagePct > 100 {
+		return nil, fmt.Errorf("%s: bounds: outage-pct must be between 0 and 100", fname)
+	}
+	if b.Interval == nil {
+		b.Interval = []time.Duration{10 * time.Second, time.Minute}
+	}
+	if b.Pause == nil {
+		b.Pause = []time.Duration{0, 0}
+	}
+	if len(b.Interval) != 2 || b.Interval[0] <= 0 || b.Interval[1] < b.Interval[0] {
+		return nil, fmt.Errorf("%s: bounds: interval must be [min, max] with a positive min", fname)
+	}
+	if len(b.Pause) != 2 || b.Pause[0] < 0 || b.Pause[1] < b.Pause[0] {
+		return nil, fmt.Errorf("%s: bounds: pause must be [min, max]", fname)
+	}
+	return c, nil
+}
+
+func randFloat(rnd *rand.Rand, bounds []float64, decimals int) float64 {
+	v := bounds[0] + rnd.Float64()*(bounds[1]-bounds[0])
+	pow := math.Pow(10, float64(decimals))
+	return math.Round(v*pow) / pow
+}
+
+func randDuration(rnd *rand.Rand, bounds []time.Duration) time.Duration {
+	d := bounds[0] + time.Duration(rnd.Float64()*float64(bounds[1]-bounds[0]))
+	return d.Round(time.Millisecond)
+}
+
+// draw the next decision; all random values are always drawn in the same order, so that a seed replays exactly
+func (c *chaosConfig) next(rnd *rand.Rand, seq int, at time.Duration) *chaosDecision {
+	b := &c.Bounds
+	d := &chaosDecision{
+		seq:    seq,
+		at:     at,
+		target: rnd.Intn(len(c.Targets)),
+		outage: rnd.Float64()*100 < b.OutagePct,
+		rule:   &tc.Rule{},
+	}
+	if b.LatencyMs != nil {
+		d.rule.Latency = tc.Ptr(tc.Milliseconds(randFloat(rnd, b.LatencyMs, 0)))
+	}
+	if b.JitterMs != nil {
+		d.rule.Jitter = tc.Ptr(tc.Milliseconds(randFloat(rnd, b.JitterMs, 0)))
+	}
+	if b.PacketLossPct != nil {
+		d.rule.PacketLoss = tc.Ptr(tc.Percent(randFloat(rnd, b.PacketLossPct, 2)))
+	}
+	if b.LinkSpeedRateBytes != nil {
+		d.rule.Rate = tc.Ptr(tc.BytesRate(randFloat(rnd, b.LinkSpeedRateBytes, 0)))
+	}
+	if b.CorruptPct != nil {
+		d.rule.Corrupt = tc.Ptr(tc.Percent(randFloat(rnd, b.CorruptPct, 2)))
+	}
+	d.hold = randDuration(rnd, b.Interval)
+	if d.outage {
+		d.rule = &tc.Rule{
+			PacketLoss: tc.Ptr(tc.Percent(100)),
+		}
+	}
+	return d
+}
+
+// actions of a rule, as a map for logging
+func ruleParams(r *tc.Rule) map[string]string {
+	params := make(map[string]string)
+	for _, f := range actionFields(r) {
+		params[f.name] = f.value
+	}
+	return params
+}
+
+// filter of a rule, as a map for logging
+func ruleTarget(r *tc.Rule) map[string]string {
+	target := make(map[string]string)
+	if r.Iface != nil {
+		target["interface"] = *r.Iface
+	}
+	for _, f := range filterFields(r) {
+		target[f.name] = f.value
+	}
+	return target
+}
+
+func (c *cmdChaos) Execute(tail []string) error {
+	if c.Duration <= 0 {
+		return errors.New("duration must be positive")
+	}
+	if !c.Plan {
+		if err := noDryRun("chaos, use --plan"); err != nil {
+			return err
+		}
+	}
+	conf, err := loadChaosConfig(c.Targets)
+	if err != nil {
+		return err
+	}
+	seed := time.Now().UnixNano()
+	if c.Seed != nil {
+		seed = *c.Seed
+	}
+	rnd := rand.New(rand.NewSource(seed))
+
+	var out io.Writer = os.Stdout
+	if c.Log != nil {
+		f, err := os.OpenFile(*c.Log, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	enc := json.NewEncoder(out)
+	start := time.Now()
+	emit := func(ev *chaosEvent, offset time.Duration) {
+		ev.Time = time.Now()
+		if c.Plan {
+			ev.Time = start.Add(offset)
+		}
+		ev.Offset = offset.String()
+		enc.Encode(ev)
+	}
+
+	targets := conf.rules
+	ctx, cancel := interruptContext()
+	defer cancel()
+	overrides := make([]*override, len(targets))
+	if !c.Plan {
+		client, err := newSetClient(c.Verbose)
+		if err != nil {
+			return err
+		}
+		err = netemCheck(ctx, client)
+		if err != nil {
+			return err
+		}
+		for i, t := range targets {
+			overrides[i], err = newOverride(ctx, client, t)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	emit(&chaosEvent{Event: "start", Seed: &seed}, 0)
+	at := time.Duration(0)
+	seq := 0
+	for at < c.Duration {
+		seq++
+		d := conf.next(rnd, seq, at)
+		pause := randDuration(rnd, conf.Bounds.Pause)
+		if d.at+d.hold > c.Duration {
+			d.hold = c.Duration - d.at
+		}
+		action := "impair"
+		if d.outage {
+			action = "outage"
+		}
+		ev := &chaosEvent{Seq: seq, Event: "apply", Target: ruleTarget(targets[d.target]), Action: action, Params: ruleParams(d.rule), Hold: d.hold.String()}
+		if c.Plan {
+			emit(ev, d.at)
+			emit(&chaosEvent{Seq: seq, Event: "restore", Target: ev.Target}, d.at+d.hold)
+			at = d.at + d.hold + pause
+			continue
+		}
+		err = sleepCtx(ctx, time.Until(start.Add(d.at)))
+		if err != nil {
+			break
+		}
+		err = overrides[d.target].Apply(ctx, d.rule)
+		if err != nil {
+			ev.Error = err.Error()
+		}
+		emit(ev, time.Since(start))
+		if err != nil {
+			break
+		}
+		err = sleepCtx(ctx, time.Until(start.Add(d.at+d.hold)))
+		rerr := overrides[d.target].Restore(context.Background())
+		rev := &chaosEvent{Seq: seq, Event: "restore", Target: ev.Target}
+		if rerr != nil {
+			rev.Error = rerr.Error()
+		}
+		emit(rev, time.Since(start))
+		if err != nil || rerr != nil {
+			err = errors.Join(err, rerr)
+			break
+		}
+		at = d.at + d.hold + pause
+	}
+	if ctx.Err() != nil {
+		err = errors.New("interrupted")
+	}
+	stop := &chaosEvent{Seq: seq, Event: "stop"}
+	if err != nil {
+		stop.Error = err.Error()
+	}
+	offset := time.Since(start)
+	if c.Plan {
+		offset = at
+		if offset > c.Duration {
+			offset = c.Duration
+		}
+	}
+	emit(stop, offset)
+	for _, o := range overrides {
+		if o != nil {
+			err = errors.Join(err, o.Restore(context.Background()))
+		}
+	}
+	return err
+}
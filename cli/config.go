@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"easytc/tc"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// the config file unless --config is given
+const defaultConfig = "/etc/easytc/config.yaml"
+
+// settings read from the config file
+type config struct {
+	// traffic which no rule impairs, for example ssh to a management address; the filter fields of a rule,
+	// and optionally its interface
+	Protected []*ruleArgs `yaml:"protected"`
+}
+
+// load the config file; the default one may be missing
+func loadConfig(fname string) (*config, error) {
+	data, err := os.ReadFile(fname)
+	if errors.Is(err, fs.ErrNotExist) && fname == defaultConfig {
+		return &config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &config{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err = dec.Decode(c)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", fname, err)
+	}
+	for i, a := range c.Protected {
+		r, err := a.rule(nil)
+		if err == nil {
+			err = checkFilter(r)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: protected %d: %w", fname, i+1, err)
+		}
+	}
+	return c, nil
+}
+
+// the protected filters, which must have been checked by loadConfig
+func (c *config) protected() []*tc.Rule {
+	rules := []*tc.Rule{}
+	for _, a := range c.Protected {
+		r, _ := a.rule(nil)
+		rules = append(rules, r)
+	}
+	return rules
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"easytc/tc"
+	"fmt"
+	"strconv"
+)
+
+func (c *cmdShowConflicts) Execute(tail []string) error {
+	conflicts, err := newClient(c.Verbose).Conflicts(context.Background(), c.Interface)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) == 0 {
+		fmt.Println("no conflicts")
+		return nil
+	}
+	for _, conflict := range conflicts {
+		fmt.Println(describeConflict(conflict))
+	}
+	return nil
+}
+
+// which of two overlapping rules applies, and how to change it
+func describeConflict(c *tc.Conflict) string {
+	winner, loser := describeConflicting(c.Winner), describeConflicting(c.Loser)
+	msg := fmt.Sprintf("%s overlaps %s, and is tried first", winner, loser)
+	if c.Shadowed {
+		msg = fmt.Sprintf("%s shadows %s, which never applies", winner, loser)
+	}
+	if c.SamePriority {
+		msg += fmt.Sprintf("; both have priority %s, so their order depends on the order they were added in, use --priority to set it", formatPriority(c.Winner.Priority))
+	}
+	return msg
+}
+
+// a rule and its filter handle, if it exists yet
+func describeConflicting(r *tc.Rule) string {
+	desc := "rule " + describeRule(r)
+	if r.FilterHandle != nil {
+		desc += " (handle " + *r.FilterHandle + ")"
+	}
+	return desc
+}
+
+func formatPriority(p *int) string {
+	if p == nil {
+		return ""
+	}
+	return strconv.Itoa(*p)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"easytc/tc"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type cmdDistBuild struct {
+	From   *string `short:"f" long:"from" description:"file with latency samples in milliseconds, one or more per line"`
+	Name   *string `short:"n" long:"name" description:"name of the distribution table to create"`
+	OutDir *string `short:"o" long:"out-dir" description:"optional: directory to write the table to; default: the tc library directory"`
+	Stdout bool    `long:"stdout" description:"print the table instead of writing it to a file"`
+}
+
+func (c *cmdDistBuild) Execute(tail []string) error {
+	if c.From == nil || c.Name == nil {
+		return errors.New("both --from and --name must be specified")
+	}
+	if *c.Name == "" || strings.ContainsAny(*c.Name, "/ ") {
+		return fmt.Errorf("invalid distribution name %q", *c.Name)
+	}
+	f, err := os.Open(*c.From)
+	if err != nil {
+		return err
+	}
+	samples, err := tc.ReadSamples(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %w", *c.From, err)
+	}
+	dist, err := tc.MakeDistTable(*c.Name, samples)
+	if err != nil {
+		return err
+	}
+	if c.Stdout {
+		return dist.Write(os.Stdout)
+	}
+	dir := tc.DistDir()
+	if c.OutDir != nil {
+		dir = *c.OutDir
+	}
+	fname := filepath.Join(dir, *c.Name+".dist")
+	out, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	err = dist.Write(out)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s: samples=%d mean=%0.3fms stddev=%0.3fms\n", fname, dist.Samples, dist.MeanMs, dist.StddevMs)
+	if c.OutDir != nil && dir != tc.DistDir() {
+		fmt.Printf("note: tc only loads tables from %s, set TC_LIB_DIR=%s to use this one\n", tc.DistDir(), dir)
+	}
+	fmt.Printf("usage: easytc set -d <ip> --distribution %s\n", *c.Name)
+	return nil
+}
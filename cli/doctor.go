@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"easytc/tc"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type cmdDoctor struct {
+	Namespace *string `short:"n" long:"namespace" description:"optional: check a named network namespace (ip netns) instead of the current one"`
+	Json      bool    `long:"json" description:"print the report in json format"`
+	Verbose   bool    `long:"verbose" description:"enable verbose logging"`
+}
+
+// a doctor report with failed checks
+var errDoctorFailed = errors.New("doctor found problems which prevent easytc from working")
+
+func (c *cmdDoctor) Execute(tail []string) error {
+	client := newClient(c.Verbose)
+	if c.Namespace != nil {
+		client = newClient(c.Verbose, tc.WithNamespace(*c.Namespace))
+	}
+	report := client.Doctor(context.Background())
+	if c.Json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err := enc.Encode(report)
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, check := range report.Checks {
+			fmt.Printf("%-6s %-24s %s\n", "["+check.Status+"]", check.Name, check.Detail)
+			if check.Fix != "" {
+				fmt.Printf("%-6s %-24s fix: %s\n", "", "", check.Fix)
+			}
+		}
+	}
+	if !report.OK {
+		failed := []string{}
+		for _, check := range report.Checks {
+			if check.Status == tc.CheckFail {
+				failed = append(failed, check.Name)
+			}
+		}
+		return fmt.Errorf("%w: %s", errDoctorFailed, strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"easytc/tc"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// records the commands of a dry run, see --dry-run
+var dryRun = &tc.RecordingRunner{}
+
+// long running commands depend on the rules they changed before, which a dry run does not change
+func noDryRun(name string) error {
+	if cmdline.DryRun {
+		return fmt.Errorf("--dry-run is not supported by %s, only by set, del and reset", name)
+	}
+	return nil
+}
+
+// print the commands and rule changes of a dry run
+func printDryRun(w io.Writer, rec *tc.RecordingRunner) {
+	fmt.Fprintln(w, "dry run, nothing was changed")
+	cmds := rec.Commands()
+	if len(cmds) == 0 {
+		fmt.Fprintln(w, "no commands would run")
+	} else {
+		fmt.Fprintln(w, "commands which would run:")
+		inputs := rec.Inputs()
+		for i, cmd := range cmds {
+			fmt.Fprintf(w, "  %s\n", strings.Join(cmd, " "))
+			// the input of the command, such as the members of an ipset restore
+			for _, line := range strings.Split(string(inputs[i]), "\n") {
+				if line != "" {
+					fmt.Fprintf(w, "    %s\n", line)
+				}
+			}
+		}
+	}
+	changes := rec.Changes()
+	if len(changes) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "rule changes:")
+	for _, ch := range changes {
+		if ch.Action == tc.ChangeModify && ch.Previous != nil {
+			prev := []string{}
+			for _, f := range actionFields(ch.Previous) {
+				prev = append(prev, f.name+"="+f.value)
+			}
+			fmt.Fprintf(w, "  %-6s %s, was %s\n", ch.Action, describeRule(ch.Rule), strings.Join(prev, " "))
+			continue
+		}
+		fmt.Fprintf(w, "  %-6s %s\n", ch.Action, describeRule(ch.Rule))
+	}
+}
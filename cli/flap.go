@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"easytc/tc"
+	"errors"
+	"log"
+	"math/rand"
+	"time"
+)
+
+type cmdFlap struct {
+	Interface       *string       `short:"i" long:"interface" description:"optional: specify an interface; default: all interfaces"`
+	SourceIP        *string       `short:"s" long:"src-ip" description:"optional: filter by source IP"`
+	DestinationIP   *string       `short:"d" long:"dst-ip" description:"optional: filter by destination IP"`
+	SourcePort      *string       `short:"S" long:"src-port" description:"optional: filter by source port"`
+	DestinationPort *string       `short:"D" long:"dst-port" description:"optional: filter by destination port"`
+	Down            time.Duration `long:"down" description:"how long the link stays down in each cycle" default:"5s"`
+	Up              time.Duration `long:"up" description:"how long the link stays up in each cycle" default:"30s"`
+	Count           int           `long:"count" description:"number of down/up cycles; 0 flaps until interrupted" default:"0"`
+	JitterPct       float64       `long:"jitter-pct" description:"optional: randomize each interval by up to this percentage" default:"0"`
+	Seed            *int64        `long:"seed" description:"optional: random seed for the jitter, to reproduce a previous run"`
+	Verbose         bool          `long:"verbose" description:"enable verbose logging"`
+}
+
+type cmdOutage struct {
+	Interface       *string       `short:"i" long:"interface" description:"optional: specify an interface; default: all interfaces"`
+	SourceIP        *string       `short:"s" long:"src-ip" description:"optional: filter by source IP"`
+	DestinationIP   *string       `short:"d" long:"dst-ip" description:"optional: filter by destination IP"`
+	SourcePort      *string       `short:"S" long:"src-port" description:"optional: filter by source port"`
+	DestinationPort *string       `short:"D" long:"dst-port" description:"optional: filter by destination port"`
+	For             time.Duration `long:"for" description:"duration of the outage" required:"true"`
+	Verbose         bool          `long:"verbose" description:"enable verbose logging"`
+}
+
+// temporarily overrides the actions for a filter, restoring the rules which existed for the filter when it is lifted
+type override struct {
+	client  *tc.Client
+	filter  *tc.Rule
+	ifaces  []string
+	prev    map[string]*tc.Rule
+	applied bool
+}
+
+func newOverride(ctx context.Context, client *tc.Client, filter *tc.Rule) (*override, error) {
+	err := checkFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := client.ListRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	b := &override{
+		client: client,
+		filter: filter,
+		prev:   make(map[string]*tc.Rule),
+	}
+	if filter.Iface != nil {
+		b.ifaces = []string{*filter.Iface}
+	} else {
+		b.ifaces = rules.Interfaces
+	}
+	for _, rule := range rules.Rules {
+		if rule.Iface == nil || rule.FilterHandle == nil || rule.PassThrough {
+			continue
+		}
+		if filter.Iface != nil && *filter.Iface != *rule.Iface {
+			continue
+		}
+		if filterKey(rule) != filterKey(filter) {
+			continue
+		}
+		prev := rule.Filter()
+		prev.Latency = rule.Latency
+		prev.Jitter = rule.Jitter
+		prev.Distribution = rule.Distribution
+		prev.PacketLoss = rule.PacketLoss
+		prev.Rate = rule.Rate
+		prev.Corrupt = rule.Corrupt
+		b.prev[*rule.Iface] = prev
+	}
+	return b, nil
+}
+
+// apply the actions of a to all traffic matched by the filter
+func (b *override) Apply(ctx context.Context, a *tc.Rule) error {
+	r := b.filter.Filter()
+	r.Latency = a.Latency
+	r.Jitter = a.Jitter
+	r.Distribution = a.Distribution
+	r.PacketLoss = a.PacketLoss
+	r.Rate = a.Rate
+	r.Corrupt = a.Corrupt
+	b.applied = true
+	return b.client.Set(ctx, r)
+}
+
+// drop all traffic matched by the filter
+func (b *override) Down(ctx context.Context) error {
+	return b.Apply(ctx, &tc.Rule{
+		PacketLoss: tc.Ptr(tc.Percent(100)),
+	})
+}
+
+// remove the override, restoring the previous rule for the filter on each interface
+func (b *override) Restore(ctx context.Context) error {
+	if !b.applied {
+		return nil
+	}
+	if len(b.prev) == 0 {
+		err := b.client.Delete(ctx, b.filter)
+		if err != nil && !errors.Is(err, tc.ErrRuleNotFound) {
+			return err
+		}
+		b.applied = false
+		return nil
+	}
+	// restore all interfaces, or none
+	tx, err := b.client.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	for _, iface := range b.ifaces {
+		if prev, ok := b.prev[iface]; ok {
+			err := tx.Set(ctx, prev)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		r := b.filter.Filter()
+		r.Iface = &iface
+		err := tx.Delete(ctx, r)
+		if err != nil && !errors.Is(err, tc.ErrRuleNotFound) {
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	b.applied = false
+	return nil
+}
+
+// randomize d by up to +-pct percent
+func jitterDuration(rnd *rand.Rand, d time.Duration, pct float64) time.Duration {
+	if pct <= 0 {
+		return d
+	}
+	return time.Duration(float64(d) * (1 + pct/100*(rnd.Float64()*2-1)))
+}
+
+func (c *cmdFlap) Execute(tail []string) error {
+	if err := noDryRun("flap"); err != nil {
+		return err
+	}
+	if c.Down <= 0 || c.Up <= 0 {
+		return errors.New("down and up must be positive durations")
+	}
+	if c.Count < 0 {
+		return errors.New("count must not be negative")
+	}
+	if c.JitterPct < 0 || c.JitterPct >= 100 {
+		return errors.New("jitter-pct must be between 0 and 100")
+	}
+	ctx, cancel := interruptContext()
+	defer cancel()
+	client, err := newSetClient(c.Verbose)
+	if err != nil {
+		return err
+	}
+	err = netemCheck(ctx, client)
+	if err != nil {
+		return err
+	}
+	filter, err := (&ruleArgs{
+		Interface:       c.Interface,
+		SourceIP:        c.SourceIP,
+		DestinationIP:   c.DestinationIP,
+		SourcePort:      c.SourcePort,
+		DestinationPort: c.DestinationPort,
+	}).rule(nil)
+	if err != nil {
+		return err
+	}
+	b, err := newOverride(ctx, client, filter)
+	if err != nil {
+		return err
+	}
+	seed := time.Now().UnixNano()
+	if c.Seed != nil {
+		seed = *c.Seed
+	}
+	rnd := rand.New(rand.NewSource(seed))
+
+	log.Printf("flap %s: down=%s up=%s count=%d jitter-pct=%g seed=%d", describeRule(filter), c.Down, c.Up, c.Count, c.JitterPct, seed)
+	for i := 1; c.Count == 0 || i <= c.Count; i++ {
+		down := jitterDuration(rnd, c.Down, c.JitterPct)
+		up := jitterDuration(rnd, c.Up, c.JitterPct)
+		log.Printf("flap %d: down for %s", i, down.Round(time.Millisecond))
+		err = b.Down(ctx)
+		if err != nil {
+			break
+		}
+		err = sleepCtx(ctx, down)
+		if err != nil {
+			break
+		}
+		if c.Count != 0 && i == c.Count {
+			log.Printf("flap %d: up", i)
+			err = b.Restore(ctx)
+			break
+		}
+		log.Printf("flap %d: up for %s", i, up.Round(time.Millisecond))
+		err = b.Restore(ctx)
+		if err != nil {
+			break
+		}
+		err = sleepCtx(ctx, up)
+		if err != nil {
+			break
+		}
+	}
+	if ctx.Err() != nil {
+		log.Printf("flap: interrupted, restoring")
+		err = errors.New("interrupted")
+	}
+	return errors.Join(err, b.Restore(context.Background()))
+}
+
+func (c *cmdOutage) Execute(tail []string) error {
+	if err := noDryRun("outage"); err != nil {
+		return err
+	}
+	if c.For <= 0 {
+		return errors.New("for must be a positive duration")
+	}
+	ctx, cancel := interruptContext()
+	defer cancel()
+	client, err := newSetClient(c.Verbose)
+	if err != nil {
+		return err
+	}
+	err = netemCheck(ctx, client)
+	if err != nil {
+		return err
+	}
+	filter, err := (&ruleArgs{
+		Interface:       c.Interface,
+		SourceIP:        c.SourceIP,
+		DestinationIP:   c.DestinationIP,
+		SourcePort:      c.SourcePort,
+		DestinationPort: c.DestinationPort,
+	}).rule(nil)
+	if err != nil {
+		return err
+	}
+	b, err := newOverride(ctx, client, filter)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("outage %s: down for %s", describeRule(filter), c.For)
+	err = b.Down(ctx)
+	if err == nil {
+		err = sleepCtx(ctx, c.For)
+		if ctx.Err() != nil {
+			err = errors.New("interrupted")
+		}
+	}
+	log.Printf("outage %s: up", describeRule(filter))
+	return errors.Join(err, b.Restore(context.Background()))
+}
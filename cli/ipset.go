@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"easytc/tc"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type cmdSetMembersAdd struct {
+	File    *string `short:"f" long:"file" description:"optional: also add the addresses and networks in this file, one per line"`
+	Verbose bool    `long:"verbose" description:"enable verbose logging"`
+}
+
+type cmdSetMembersDel struct {
+	File    *string `short:"f" long:"file" description:"optional: also remove the addresses and networks in this file, one per line"`
+	Verbose bool    `long:"verbose" description:"enable verbose logging"`
+}
+
+func (c *cmdSetMembersAdd) Execute(tail []string) error {
+	name, members, err := setMembersArgs("add", tail, c.File)
+	if err != nil {
+		return err
+	}
+	if len(members) == 0 {
+		return errors.New("no addresses given")
+	}
+	return ruleError(newClient(c.Verbose).AddSetMembers(context.Background(), name, members))
+}
+
+// without addresses, the set is removed
+func (c *cmdSetMembersDel) Execute(tail []string) error {
+	name, members, err := setMembersArgs("del", tail, c.File)
+	if err != nil {
+		return err
+	}
+	return ruleError(newClient(c.Verbose).DelSetMembers(context.Background(), name, members))
+}
+
+// the set name and the addresses of the command line, and of the file if one is given
+func setMembersArgs(verb string, tail []string, file *string) (string, []netip.Prefix, error) {
+	if len(tail) < 1 {
+		return "", nil, fmt.Errorf("usage: easytc set-members %s NAME [ADDRESS...] [--file FILE]", verb)
+	}
+	members := []netip.Prefix{}
+	for _, v := range tail[1:] {
+		p, err := tc.ParsePrefix(v)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid address or network %q", v)
+		}
+		members = append(members, p.Masked())
+	}
+	if file != nil {
+		addrs, err := readAddrFile(*file)
+		if err != nil {
+			return "", nil, err
+		}
+		members = append(members, addrs...)
+	}
+	return tail[0], members, nil
+}
+
+func readAddrFile(fname string) ([]netip.Prefix, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	addrs, err := tc.ReadAddrs(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fname, err)
+	}
+	return addrs, nil
+}
+
+// the set of --src-file or --dst-file is named after the file, without its directory and extension, unless a name is given
+func fileSet(name *string, file *string) *string {
+	if name != nil || file == nil {
+		return name
+	}
+	base := filepath.Base(*file)
+	return tc.Ptr(strings.TrimSuffix(base, filepath.Ext(base)))
+}
+
+// load the addresses of a file into its set, replacing the members the set had
+func loadSetFile(ctx context.Context, client *tc.Client, name *string, file *string) error {
+	if file == nil {
+		return nil
+	}
+	addrs, err := readAddrFile(*file)
+	if err != nil {
+		return err
+	}
+	return ruleError(client.ReplaceSetMembers(ctx, *name, addrs))
+}
+
+// the set names of the Match column, with their number of members
+func setSizes(ctx context.Context, client *tc.Client, fields []ruleField) {
+	for i, f := range fields {
+		if f.name != "src-set" && f.name != "dst-set" {
+			continue
+		}
+		members, err := client.SetMembers(ctx, f.value)
+		if err != nil {
+			fields[i].value += "(?)"
+			continue
+		}
+		fields[i].value += fmt.Sprintf("(%d)", len(members))
+	}
+}
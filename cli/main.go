@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"easytc/tc"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
+	"strconv"
 
 	"github.com/bestmethod/inslice"
 	"github.com/jedib0t/go-pretty/table"
@@ -16,39 +19,133 @@ import (
 )
 
 type command struct {
-	Set   cmdSet   `command:"set" description:"create a tc rule"`
-	Del   cmdDel   `command:"del" description:"delete a tc rule"`
-	Reset cmdReset `command:"reset" description:"remove all tc rules"`
-	Show  struct {
-		Iface cmdShowIface `command:"iface" description:"list interfaces"`
-		Rules cmdShowRules `command:"rules" description:"list rules"`
-		All   cmdShowAll   `command:"all" description:"list all interfaces, rules, qdisc and filters in json format"`
+	DryRun bool   `long:"dry-run" description:"print the tc commands and rule changes instead of running them; for set, update, del and reset"`
+	Config string `long:"config" description:"config file, with the protected traffic which set never impairs"`
+
+	Set    cmdSet    `command:"set" description:"create a tc rule"`
+	Update cmdUpdate `command:"update" description:"change the actions of an existing tc rule in place"`
+	Del    cmdDel    `command:"del" description:"delete a tc rule"`
+	Reset  cmdReset  `command:"reset" description:"remove all tc rules"`
+	Show   struct {
+		Iface     cmdShowIface     `command:"iface" description:"list interfaces"`
+		Rules     cmdShowRules     `command:"rules" description:"list rules"`
+		Conflicts cmdShowConflicts `command:"conflicts" description:"list rules which overlap, and which of them is applied"`
+		All       cmdShowAll       `command:"all" description:"list all interfaces, rules, qdisc and filters in json format"`
 	} `command:"show" description:"list tc rules or interfaces"`
+	Ramp     cmdRamp   `command:"ramp" description:"gradually change the parameters of an existing rule"`
+	Flap     cmdFlap   `command:"flap" description:"repeatedly drop all matching traffic for a while"`
+	Outage   cmdOutage `command:"outage" description:"drop all matching traffic for a given duration"`
+	Chaos    cmdChaos  `command:"chaos" description:"apply random impairments to random targets, reproducible from a seed"`
+	Scenario struct {
+		Run cmdScenarioRun `command:"run" description:"play back a scenario file: scenario run scenario.yaml"`
+	} `command:"scenario" description:"run timed sequences of rule changes"`
+	Dist struct {
+		Build cmdDistBuild `command:"build" description:"generate a netem delay distribution table from latency samples"`
+	} `command:"dist" description:"manage delay distribution tables"`
+	SetMembers struct {
+		Add cmdSetMembersAdd `command:"add" description:"add addresses or networks to a set, creating it: set-members add NAME ADDRESS..."`
+		Del cmdSetMembersDel `command:"del" description:"remove addresses or networks from a set, or the set without any: set-members del NAME [ADDRESS...]"`
+	} `command:"set-members" description:"manage the ipsets of --src-set and --dst-set rules"`
+	Doctor  cmdDoctor  `command:"doctor" description:"check that tc, kernel modules and permissions are in place, and suggest fixes"`
 	Version cmdVersion `command:"version" description:"Print version"`
 }
 
 type cmdVersion struct{}
 
 type cmdSet struct {
-	Interface          *string `short:"i" long:"interface" description:"specify an interface for the rule"`
-	SourceIP           *string `short:"s" long:"src-ip" description:"optional: filter by source IP"`
-	DestinationIP      *string `short:"d" long:"dst-ip" description:"optional: filter by destination IP"`
-	SourcePort         *string `short:"S" long:"src-port" description:"optional: filter by source port"`
-	DestinationPort    *string `short:"D" long:"dst-port" description:"optional: filter by destination port"`
-	LatencyMs          *string `short:"l" long:"latency-ms" description:"optional: specify latency (number) of milliseconds"`
-	PacketLossPct      *string `short:"p" long:"loss-pct" description:"optional: specify packet loss percentage"`
-	LinkSpeedRateBytes *string `short:"e" long:"rate-bytes" description:"optional: specify link speed rate, in bytes"`
-	CorruptPct         *string `short:"c" long:"corrupt-pct" description:"optional: currupt packets (percentage)"`
+	Interface          *string           `short:"i" long:"interface" description:"specify an interface for the rule"`
+	SourceIP           *string           `short:"s" long:"src-ip" description:"optional: filter by source IP"`
+	DestinationIP      *string           `short:"d" long:"dst-ip" description:"optional: filter by destination IP"`
+	SourcePort         *string           `short:"S" long:"src-port" description:"optional: filter by source port"`
+	DestinationPort    *string           `short:"D" long:"dst-port" description:"optional: filter by destination port"`
+	DSCP               *string           `long:"dscp" description:"optional: filter by DSCP class, 0-63 or a name such as ef or af41"`
+	TOS                *string           `long:"tos" description:"optional: filter by the whole TOS byte, for example 0x10"`
+	Length             *string           `long:"length" description:"optional: filter by IP total length in bytes, for example 0-127"`
+	TCPFlags           *string           `long:"tcp-flags" description:"optional: filter TCP packets by flags, '!' for unset: syn,!ack for connection requests"`
+	Protocol           *string           `long:"protocol" description:"optional: filter by IP protocol, a number or a name such as tcp, udp or icmp"`
+	Match              *string           `long:"match" description:"optional: instead of the other filters, filter by a tcpdump-style expression such as 'dst net 10.0.0.0/8 and (tcp dst port 443 or udp dst port 53) and not host 10.0.0.1'; each or branch gets a filter of its own"`
+	FwMark             *string           `long:"fwmark" description:"optional: instead of the other filters, filter by the firewall mark set by iptables or nftables, 0x10 or 0x10/0xff; default priority: 50"`
+	NftMatch           *string           `long:"nft-match" description:"optional: with --fwmark, set the mark on packets matching this nftables expression, such as 'ct state new'; empty removes it"`
+	Cgroup             *string           `long:"cgroup" description:"optional: instead of the other filters, filter by the sockets of this cgroup v2, such as /sys/fs/cgroup/system.slice/foo.service, marked by an nftables rule; default priority: 55"`
+	Pid                *string           `long:"pid" description:"optional: instead of --cgroup, filter by the sockets of the cgroup of this process"`
+	SourceSet          *string           `long:"src-set" description:"optional: instead of the other filters, filter by source IP in this ipset, created if missing; default priority: 60"`
+	DestinationSet     *string           `long:"dst-set" description:"optional: instead of the other filters, filter by destination IP in this ipset, created if missing; default priority: 60"`
+	SourceFile         *string           `long:"src-file" description:"optional: load the addresses and networks in this file, one per line, into the --src-set, by default named after the file"`
+	DestinationFile    *string           `long:"dst-file" description:"optional: load the addresses and networks in this file, one per line, into the --dst-set, by default named after the file"`
+	AllTraffic         bool              `long:"all-traffic" description:"instead of filters: impair all traffic of the interface which no other rule matches"`
+	Priority           *string           `long:"priority" description:"optional: rules with a lower priority are tried first, 2-999; default: 100, or the priority of the existing rule"`
+	LatencyMs          *string           `short:"l" long:"latency-ms" description:"optional: specify latency in milliseconds, or with a unit: 250us, 1.2s"`
+	JitterMs           *string           `short:"j" long:"jitter-ms" description:"optional: specify latency jitter in milliseconds, or with a unit: 250us, 1.2s"`
+	Distribution       *string           `long:"distribution" description:"optional: latency distribution table name; latency and jitter default to the table's sample mean and stddev"`
+	PacketLossPct      *string           `short:"p" long:"loss-pct" description:"optional: specify packet loss percentage, such as 0.5 or 0.5%"`
+	LinkSpeedRateBytes *string           `short:"e" long:"rate-bytes" description:"optional: specify link speed rate in bytes per second, or with a unit: 10mbit, 1.5MB"`
+	CorruptPct         *string           `short:"c" long:"corrupt-pct" description:"optional: currupt packets (percentage)"`
+	Name               *string           `long:"name" description:"optional: name the rule, for del --name and show rules --name"`
+	Labels             map[string]string `long:"label" key-value-delimiter:"=" description:"optional: label the rule with key=value, for show rules --label; repeatable"`
+	ExceptSrc          []string          `long:"except-src" description:"optional: do not impair traffic from this source IP; repeatable"`
+	ExceptDst          []string          `long:"except-dst" description:"optional: do not impair traffic to this destination IP; repeatable"`
+	ExceptSport        []string          `long:"except-sport" description:"optional: do not impair traffic from this source port; repeatable"`
+	ExceptDport        []string          `long:"except-dport" description:"optional: do not impair traffic to this destination port; repeatable"`
+	Adopt              bool              `long:"adopt" description:"replace a root qdisc which easytc did not create; reset restores it"`
+	Verbose            bool              `long:"verbose" description:"enable verbose logging"`
+}
+
+type cmdUpdate struct {
+	Interface          *string `short:"i" long:"interface" description:"optional: specify an interface; default: all interfaces, required with --handle"`
+	SourceIP           *string `short:"s" long:"src-ip" description:"select the rule by source IP"`
+	DestinationIP      *string `short:"d" long:"dst-ip" description:"select the rule by destination IP"`
+	SourcePort         *string `short:"S" long:"src-port" description:"select the rule by source port"`
+	DestinationPort    *string `short:"D" long:"dst-port" description:"select the rule by destination port"`
+	DSCP               *string `long:"dscp" description:"select the rule by DSCP class"`
+	TOS                *string `long:"tos" description:"select the rule by TOS byte"`
+	Length             *string `long:"length" description:"select the rule by IP total length"`
+	TCPFlags           *string `long:"tcp-flags" description:"select the rule by TCP flags"`
+	Protocol           *string `long:"protocol" description:"select the rule by IP protocol"`
+	FwMark             *string `long:"fwmark" description:"select the rule by firewall mark"`
+	Cgroup             *string `long:"cgroup" description:"select the rule by cgroup"`
+	Pid                *string `long:"pid" description:"select the rule by the cgroup of a process"`
+	SourceSet          *string `long:"src-set" description:"select the rule by source ipset"`
+	DestinationSet     *string `long:"dst-set" description:"select the rule by destination ipset"`
+	AllTraffic         bool    `long:"all-traffic" description:"select the all-traffic rule"`
+	Name               *string `long:"name" description:"select the rule by name"`
+	Handle             *string `long:"handle" description:"select the rule by tc filter handle, as in show rules"`
+	LatencyMs          *string `short:"l" long:"latency-ms" description:"optional: new latency in milliseconds, or with a unit: 250us, 1.2s"`
+	JitterMs           *string `short:"j" long:"jitter-ms" description:"optional: new latency jitter in milliseconds, or with a unit: 250us, 1.2s"`
+	Distribution       *string `long:"distribution" description:"optional: new latency distribution table name"`
+	PacketLossPct      *string `short:"p" long:"loss-pct" description:"optional: new packet loss percentage"`
+	LinkSpeedRateBytes *string `short:"e" long:"rate-bytes" description:"optional: new link speed rate in bytes per second, or with a unit: 10mbit, 1.5MB"`
+	CorruptPct         *string `short:"c" long:"corrupt-pct" description:"optional: new corrupt packets percentage"`
 	Verbose            bool    `long:"verbose" description:"enable verbose logging"`
 }
 
 type cmdDel struct {
-	Interface       *string `short:"i" long:"interface" description:"specify an interface for the rule"`
-	SourceIP        *string `short:"s" long:"src-ip" description:"filter source IP"`
-	DestinationIP   *string `short:"d" long:"dst-ip" description:"filter destination IP"`
-	SourcePort      *string `short:"S" long:"src-port" description:"filter source port"`
-	DestinationPort *string `short:"D" long:"dst-port" description:"filter destination port"`
-	Verbose         bool    `long:"verbose" description:"enable verbose logging"`
+	Interface       *string           `short:"i" long:"interface" description:"specify an interface for the rule"`
+	SourceIP        *string           `short:"s" long:"src-ip" description:"filter source IP"`
+	DestinationIP   *string           `short:"d" long:"dst-ip" description:"filter destination IP"`
+	SourcePort      *string           `short:"S" long:"src-port" description:"filter source port"`
+	DestinationPort *string           `short:"D" long:"dst-port" description:"filter destination port"`
+	DSCP            *string           `long:"dscp" description:"filter DSCP class"`
+	TOS             *string           `long:"tos" description:"filter TOS byte"`
+	Length          *string           `long:"length" description:"filter IP total length"`
+	TCPFlags        *string           `long:"tcp-flags" description:"filter TCP flags"`
+	Protocol        *string           `long:"protocol" description:"filter IP protocol"`
+	Match           *string           `long:"match" description:"delete the rules whose filter matches this tcpdump-style expression, as for set --match"`
+	FwMark          *string           `long:"fwmark" description:"filter firewall mark"`
+	Cgroup          *string           `long:"cgroup" description:"filter cgroup"`
+	Pid             *string           `long:"pid" description:"filter the cgroup of a process"`
+	SourceSet       *string           `long:"src-set" description:"filter source ipset"`
+	DestinationSet  *string           `long:"dst-set" description:"filter destination ipset"`
+	AllTraffic      bool              `long:"all-traffic" description:"delete the all-traffic rule"`
+	AnyPorts        bool              `long:"any-ports" description:"match rules with any source and destination ports which are not given"`
+	AllMatching     bool              `long:"all-matching" description:"delete all rules matching the given fields, whatever their other filter fields"`
+	Name            *string           `long:"name" description:"delete the rules with this name"`
+	Labels          map[string]string `long:"label" key-value-delimiter:"=" description:"delete the rules with this key=value label; repeatable"`
+	Handle          *string           `long:"handle" description:"delete the rule with this tc filter handle, as in show rules"`
+	FlowID          *string           `long:"flowid" description:"delete the rules pointing to this tc flow ID, as in show rules"`
+	LatencyMsGt     *string           `long:"latency-ms-gt" description:"delete the rules with a latency above this many milliseconds, or this duration: 250us, 1.2s"`
+	LossPctGt       *string           `long:"loss-pct-gt" description:"delete the rules with a packet loss above this percentage"`
+	CorruptPctGt    *string           `long:"corrupt-pct-gt" description:"delete the rules corrupting more than this percentage of packets"`
+	Verbose         bool              `long:"verbose" description:"enable verbose logging"`
 }
 
 type cmdReset struct {
@@ -59,98 +156,439 @@ type cmdReset struct {
 type cmdShowIface struct{}
 
 type cmdShowRules struct {
-	Verbose bool `long:"verbose" description:"enable verbose logging"`
+	Name    *string           `long:"name" description:"only list the rules with this name"`
+	Labels  map[string]string `long:"label" key-value-delimiter:"=" description:"only list the rules with this key=value label; repeatable"`
+	Where   *string           `long:"where" description:"only list the rules whose filter matches this tcpdump-style expression, as for set --match"`
+	Human   bool              `short:"H" long:"human-readable" description:"list latency, jitter and rate with units, such as 250us and 10Mbit, and percentages with '%'"`
+	Verbose bool              `long:"verbose" description:"enable verbose logging"`
+}
+
+type cmdShowConflicts struct {
+	Interface *string `short:"i" long:"interface" description:"optional: specify an interface; default: all interfaces"`
+	Verbose   bool    `long:"verbose" description:"enable verbose logging"`
 }
 
 type cmdShowAll struct {
 	Verbose bool `long:"verbose" description:"enable verbose logging"`
 }
 
+// the parsed command line, for the global options
+var cmdline = &command{}
+
 func main() {
-	cmd := &command{}
-	_, err := flags.Parse(cmd)
+	parser := flags.NewParser(cmdline, flags.Default)
+	parser.FindOptionByLongName("config").Default = []string{defaultConfig}
+	_, err := parser.Parse()
+	if cmdline.DryRun && (err == nil || len(dryRun.Commands()) > 0) {
+		printDryRun(os.Stdout, dryRun)
+	}
 	if err != nil {
 		switch err.(type) {
 		case *flags.Error:
 			fmt.Fprintln(os.Stderr, "Use '--help' for more details.")
 		}
-		os.Exit(1)
+		os.Exit(exitCode(err))
 	}
 }
 
+// exit codes, so that automation can tell the failures apart
+const (
+	exitError             = 1
+	exitInvalidRule       = 2
+	exitModuleMissing     = 3
+	exitPermissionDenied  = 4
+	exitInterfaceNotFound = 5
+	exitRuleNotFound      = 6
+	exitConflictingRule   = 7
+	exitFlowIDsExhausted  = 8
+	exitCommandFailed     = 9
+	exitForeignQdisc      = 10
+	exitLocked            = 11
+)
+
+func exitCode(err error) int {
+	var verr *tc.ValidationError
+	var cerr *tc.CommandError
+	switch {
+	case errors.Is(err, tc.ErrPermissionDenied):
+		return exitPermissionDenied
+	case errors.Is(err, tc.ErrModuleMissing):
+		return exitModuleMissing
+	case errors.Is(err, tc.ErrInterfaceNotFound):
+		return exitInterfaceNotFound
+	case errors.Is(err, tc.ErrRuleNotFound), errors.Is(err, tc.ErrSetNotFound):
+		return exitRuleNotFound
+	case errors.Is(err, tc.ErrConflictingRule):
+		return exitConflictingRule
+	case errors.Is(err, tc.ErrFlowIDsExhausted):
+		return exitFlowIDsExhausted
+	case errors.Is(err, tc.ErrForeignQdisc):
+		return exitForeignQdisc
+	case errors.Is(err, tc.ErrLocked):
+		return exitLocked
+	case errors.As(err, &verr):
+		return exitInvalidRule
+	case errors.As(err, &cerr):
+		return exitCommandFailed
+	}
+	return exitError
+}
+
 func (c *cmdVersion) Execute(tail []string) error {
-	fmt.Println("v0.3")
+	fmt.Println("v0.4")
 	return nil
 }
 
 func (c *cmdSet) Execute(tail []string) error {
-	mods, err := tc.ListKernelMods(c.Verbose)
+	r, err := (&ruleArgs{
+		Interface:          c.Interface,
+		SourceIP:           c.SourceIP,
+		DestinationIP:      c.DestinationIP,
+		SourcePort:         c.SourcePort,
+		DestinationPort:    c.DestinationPort,
+		DSCP:               c.DSCP,
+		TOS:                c.TOS,
+		Length:             c.Length,
+		TCPFlags:           c.TCPFlags,
+		Protocol:           c.Protocol,
+		FwMark:             c.FwMark,
+		NftMatch:           c.NftMatch,
+		Cgroup:             c.Cgroup,
+		Pid:                c.Pid,
+		SourceSet:          fileSet(c.SourceSet, c.SourceFile),
+		DestinationSet:     fileSet(c.DestinationSet, c.DestinationFile),
+		AllTraffic:         c.AllTraffic,
+		Priority:           c.Priority,
+		LatencyMs:          c.LatencyMs,
+		JitterMs:           c.JitterMs,
+		Distribution:       c.Distribution,
+		PacketLossPct:      c.PacketLossPct,
+		LinkSpeedRateBytes: c.LinkSpeedRateBytes,
+		CorruptPct:         c.CorruptPct,
+		Name:               c.Name,
+		Labels:             c.Labels,
+		Except:             c.except(),
+	}).rule(nil)
 	if err != nil {
 		return err
 	}
-	if !inslice.HasString(mods, "sch_netem") {
-		err = tc.InsertKernelMod(c.Verbose)
+	rules := []*tc.Rule{r}
+	if c.Match != nil {
+		expr, err := parseMatch(*c.Match)
+		if err != nil {
+			return err
+		}
+		rules, err = expr.Rules(r)
+		if err != nil {
+			return ruleError(err)
+		}
+	}
+	for _, r := range rules {
+		// latency and jitter may still be filled in from the distribution table by tc.Set
+		if r.Distribution == nil {
+			err = checkRule(r)
+		} else {
+			err = checkFilter(r)
+		}
 		if err != nil {
-			return errNoNetem
+			return err
 		}
 	}
-	if c.SourceIP == nil && c.SourcePort == nil && c.DestinationIP == nil && c.DestinationPort == nil {
-		return errors.New("at least one filter must be provided from: sourceIp,sourcePort,destinationIp,destinationPort")
+	ctx := context.Background()
+	client, err := newSetClient(c.Verbose)
+	if err != nil {
+		return err
 	}
-	if c.LatencyMs == nil && c.LinkSpeedRateBytes == nil && c.PacketLossPct == nil && c.CorruptPct == nil {
-		return errors.New("at least one action must be specified from: latencyMs,linkSpeedRate,packetLossPct,corruptPct")
+	err = netemCheck(ctx, client)
+	if err != nil {
+		return err
+	}
+	err = loadSetFile(ctx, client, r.SourceSet, c.SourceFile)
+	if err != nil {
+		return err
 	}
-	return tc.Set(&tc.Rule{
-		Iface:              c.Interface,
+	err = loadSetFile(ctx, client, r.DestinationSet, c.DestinationFile)
+	if err != nil {
+		return err
+	}
+	if c.Adopt {
+		err = client.Adopt(ctx, r.Iface)
+		if err != nil {
+			return err
+		}
+	}
+	err = setRules(ctx, client, rules)
+	if errors.Is(err, tc.ErrForeignQdisc) {
+		return fmt.Errorf("%w; use --adopt to replace it", err)
+	}
+	if err != nil {
+		return ruleError(err)
+	}
+	for _, r := range rules {
+		// overlaps of rules at different priorities are intended, and so are those of the branches of a match expression,
+		// which share their netem qdisc
+		for _, conflict := range r.Conflicts {
+			if (!conflict.Shadowed && !conflict.SamePriority) || (sameRule(rules, conflict.Winner) && sameRule(rules, conflict.Loser)) {
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "warning: %s\n", describeConflict(conflict))
+		}
+	}
+	return nil
+}
+
+// set the rules of a match expression together: all of them, or none if one fails
+func setRules(ctx context.Context, client *tc.Client, rules []*tc.Rule) error {
+	if len(rules) == 1 {
+		return client.Set(ctx, rules[0])
+	}
+	tx, err := client.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	for _, r := range rules {
+		err = tx.Set(ctx, r)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// whether a rule of a conflict is one of rules, by ID
+func sameRule(rules []*tc.Rule, rule *tc.Rule) bool {
+	for _, r := range rules {
+		if r.ID != nil && rule.ID != nil && *r.ID == *rule.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// one exception per --except flag; nil if none is given, which keeps the exceptions of an existing rule
+func (c *cmdSet) except() []*ruleArgs {
+	var except []*ruleArgs
+	for _, v := range c.ExceptSrc {
+		except = append(except, &ruleArgs{SourceIP: tc.Ptr(v)})
+	}
+	for _, v := range c.ExceptDst {
+		except = append(except, &ruleArgs{DestinationIP: tc.Ptr(v)})
+	}
+	for _, v := range c.ExceptSport {
+		except = append(except, &ruleArgs{SourcePort: tc.Ptr(v)})
+	}
+	for _, v := range c.ExceptDport {
+		except = append(except, &ruleArgs{DestinationPort: tc.Ptr(v)})
+	}
+	return except
+}
+
+// actions which are not given are left unchanged; the filter, name, labels and ID of the rule are kept
+func (c *cmdUpdate) Execute(tail []string) error {
+	r, err := (&ruleArgs{
+		Interface:          c.Interface,
 		SourceIP:           c.SourceIP,
 		DestinationIP:      c.DestinationIP,
 		SourcePort:         c.SourcePort,
 		DestinationPort:    c.DestinationPort,
+		DSCP:               c.DSCP,
+		TOS:                c.TOS,
+		Length:             c.Length,
+		TCPFlags:           c.TCPFlags,
+		Protocol:           c.Protocol,
+		FwMark:             c.FwMark,
+		Cgroup:             c.Cgroup,
+		Pid:                c.Pid,
+		SourceSet:          c.SourceSet,
+		DestinationSet:     c.DestinationSet,
+		AllTraffic:         c.AllTraffic,
+		Name:               c.Name,
 		LatencyMs:          c.LatencyMs,
+		JitterMs:           c.JitterMs,
+		Distribution:       c.Distribution,
 		PacketLossPct:      c.PacketLossPct,
 		LinkSpeedRateBytes: c.LinkSpeedRateBytes,
 		CorruptPct:         c.CorruptPct,
-	}, c.Verbose)
+	}).rule(nil)
+	if err != nil {
+		return err
+	}
+	r.FilterHandle = c.Handle
+	err = checkFilter(r)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	client := newClient(c.Verbose)
+	err = netemCheck(ctx, client)
+	if err != nil {
+		return err
+	}
+	return ruleError(client.Update(ctx, r))
 }
 
 func (c *cmdDel) Execute(tail []string) error {
-	mods, err := tc.ListKernelMods(c.Verbose)
+	r, err := (&ruleArgs{
+		Interface:       c.Interface,
+		SourceIP:        c.SourceIP,
+		DestinationIP:   c.DestinationIP,
+		SourcePort:      c.SourcePort,
+		DestinationPort: c.DestinationPort,
+		DSCP:            c.DSCP,
+		TOS:             c.TOS,
+		Length:          c.Length,
+		TCPFlags:        c.TCPFlags,
+		Protocol:        c.Protocol,
+		FwMark:          c.FwMark,
+		Cgroup:          c.Cgroup,
+		Pid:             c.Pid,
+		SourceSet:       c.SourceSet,
+		DestinationSet:  c.DestinationSet,
+		AllTraffic:      c.AllTraffic,
+		Name:            c.Name,
+		Labels:          c.Labels,
+	}).rule(nil)
 	if err != nil {
 		return err
 	}
-	if !inslice.HasString(mods, "sch_netem") {
-		err = tc.InsertKernelMod(c.Verbose)
+	s := &tc.Selector{
+		Iface:           r.Iface,
+		SourceIP:        r.SourceIP,
+		SourcePort:      r.SourcePort,
+		DestinationIP:   r.DestinationIP,
+		DestinationPort: r.DestinationPort,
+		DSCP:            r.DSCP,
+		TOS:             r.TOS,
+		Length:          r.Length,
+		TCPFlags:        r.TCPFlags,
+		Protocol:        r.Protocol,
+		FwMark:          r.FwMark,
+		Cgroup:          r.Cgroup,
+		SourceSet:       r.SourceSet,
+		DestinationSet:  r.DestinationSet,
+		AllTraffic:      r.AllTraffic,
+		AnyIP:           c.AllMatching,
+		AnyPort:         c.AllMatching || c.AnyPorts,
+		AnyMatch:        c.AllMatching,
+		Name:            r.Name,
+		Labels:          r.Labels,
+		FilterHandle:    c.Handle,
+		FlowID:          c.FlowID,
+	}
+	if c.Match != nil {
+		s.Match, err = parseMatch(*c.Match)
 		if err != nil {
-			return errNoNetem
+			return err
 		}
 	}
-	return tc.Delete(&tc.Rule{
-		Iface:           c.Interface,
-		SourceIP:        c.SourceIP,
-		DestinationIP:   c.DestinationIP,
-		SourcePort:      c.SourcePort,
-		DestinationPort: c.DestinationPort,
-	}, c.Verbose)
+	errs := &tc.ValidationError{}
+	fail := func(field string, err error) {
+		errs.Fields = append(errs.Fields, &tc.FieldError{Field: field, Err: err})
+	}
+	if c.LatencyMsGt != nil {
+		v, err := tc.ParseDurationDefault(*c.LatencyMsGt, "ms")
+		if err != nil {
+			fail("LatencyOver", err)
+		} else {
+			s.LatencyOver = &v
+		}
+	}
+	if c.LossPctGt != nil {
+		v, err := tc.ParsePercent(*c.LossPctGt)
+		if err != nil {
+			fail("PacketLossOver", err)
+		} else {
+			s.PacketLossOver = &v
+		}
+	}
+	if c.CorruptPctGt != nil {
+		v, err := tc.ParsePercent(*c.CorruptPctGt)
+		if err != nil {
+			fail("CorruptOver", err)
+		} else {
+			s.CorruptOver = &v
+		}
+	}
+	if len(errs.Fields) > 0 {
+		return ruleError(errs)
+	}
+	err = ruleError(s.Validate())
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	client := newClient(c.Verbose)
+	err = netemCheck(ctx, client)
+	if err != nil {
+		return err
+	}
+	removed, err := client.DeleteMatching(ctx, s)
+	if err != nil {
+		return ruleError(err)
+	}
+	// a dry run prints the rules it would remove
+	if !cmdline.DryRun {
+		for _, rule := range removed {
+			fmt.Printf("removed %s\n", describeRule(rule))
+		}
+		if len(removed) == 1 {
+			fmt.Println("removed 1 rule")
+		} else {
+			fmt.Printf("removed %d rules\n", len(removed))
+		}
+	}
+	return nil
 }
 
-var errNoNetem = errors.New("kernel module 'sch_netem' not found; centos install via `yum install kernel-modules-extra iproute-tc`; reboot may be required")
+// client logging all tc commands to stderr if verbose is set
+func newClient(verbose bool, opts ...tc.Option) *tc.Client {
+	if cmdline.DryRun {
+		opts = append(opts, tc.WithRunner(dryRun))
+	}
+	if verbose {
+		opts = append(opts, tc.WithLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))))
+	}
+	return tc.New(opts...)
+}
 
-func (c *cmdReset) Execute(tail []string) error {
-	mods, err := tc.ListKernelMods(c.Verbose)
+// client as newClient does, which never impairs the protected traffic of the config file; for the commands which set rules
+func newSetClient(verbose bool, opts ...tc.Option) (*tc.Client, error) {
+	conf, err := loadConfig(cmdline.Config)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(verbose, append(opts, tc.WithProtected(conf.protected()...))...), nil
+}
+
+// load the netem kernel module if it is not loaded yet
+func netemCheck(ctx context.Context, client *tc.Client) error {
+	mods, err := client.ListKernelMods(ctx)
 	if err != nil {
 		return err
 	}
 	if !inslice.HasString(mods, "sch_netem") {
-		err = tc.InsertKernelMod(c.Verbose)
-		if err != nil {
-			return errNoNetem
+		err = client.InsertKernelMod(ctx)
+		if errors.Is(err, tc.ErrModuleMissing) {
+			return fmt.Errorf("%w; %s; run 'easytc doctor' for details", err, tc.ModuleMissingFix())
 		}
+		return err
 	}
-	return tc.Reset(c.Interface, c.Verbose)
+	return nil
+}
+
+func (c *cmdReset) Execute(tail []string) error {
+	ctx := context.Background()
+	client := newClient(c.Verbose)
+	err := netemCheck(ctx, client)
+	if err != nil {
+		return err
+	}
+	return client.Reset(ctx, c.Interface)
 }
 
 func (c *cmdShowIface) Execute(tail []string) error {
-	data, err := tc.ListIface()
+	data, err := newClient(false).ListIface(context.Background())
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -161,7 +599,17 @@ func (c *cmdShowIface) Execute(tail []string) error {
 }
 
 func (c *cmdShowRules) Execute(tail []string) error {
-	rules, err := tc.ListRules(c.Verbose)
+	ctx := context.Background()
+	client := newClient(c.Verbose)
+	var where *tc.MatchExpr
+	if c.Where != nil {
+		var err error
+		where, err = parseMatch(*c.Where)
+		if err != nil {
+			return err
+		}
+	}
+	rules, err := client.ListRules(ctx)
 	if err != nil {
 		return err
 	}
@@ -197,18 +645,53 @@ func (c *cmdShowRules) Execute(tail []string) error {
 		}
 		t.SetAllowedRowLength(width)
 	}
-	t.AppendHeader(table.Row{"Iface", "SrcIP", "DstIP", "SrcPort", "DstPort", "LatencyMs", "PacketLossPct", "CorruptPct", "RateBytes", "TcFlowID", "TcQdiscHandle", "TcFilterHandle"})
+	actionColumns := table.Row{"LatencyMs", "JitterMs", "PacketLossPct", "CorruptPct", "RateBytes"}
+	if c.Human {
+		actionColumns = table.Row{"Latency", "Jitter", "PacketLoss", "Corrupt", "Rate"}
+	}
+	header := append(table.Row{"ID", "Name", "Labels", "Type", "Priority", "Iface", "SrcIP", "DstIP", "SrcPort", "DstPort", "Match"}, actionColumns...)
+	t.AppendHeader(append(header, "TcFlowID", "TcQdiscHandle", "TcFilterHandle"))
 	for _, rule := range rules.Rules {
+		if c.Name != nil && tc.PtrToString(rule.Name) != *c.Name {
+			continue
+		}
+		if !rule.HasLabels(c.Labels) {
+			continue
+		}
+		if where != nil && !where.Matches(rule) {
+			continue
+		}
+		filter := filterFields(rule)
+		if rule.AllTraffic {
+			filter = []ruleField{{"src-ip", "*"}, {"dst-ip", "*"}, {"src-port", "*"}, {"dst-port", "*"}}
+		}
+		actions := actionFields(rule)
+		if c.Human {
+			actions = humanActionFields(rule)
+		}
+		match := matchFields(rule)
+		setSizes(ctx, client, match)
+		// the nftables rule of a cgroup rule is made from the cgroup
+		if rule.NftMatch != nil && rule.Cgroup == nil {
+			match = append(match, ruleField{"nft-match", strconv.Quote(*rule.NftMatch)})
+		}
 		vv := table.Row{
+			tc.PtrToString(rule.ID),
+			tc.PtrToString(rule.Name),
+			rule.LabelString(),
+			ruleType(rule),
+			formatPriority(rule.Priority),
 			tc.PtrToString(rule.Iface),
-			tc.PtrToString(rule.SourceIP),
-			tc.PtrToString(rule.DestinationIP),
-			tc.PtrToString(rule.SourcePort),
-			tc.PtrToString(rule.DestinationPort),
-			tc.PtrToString(rule.LatencyMs),
-			tc.PtrToString(rule.PacketLossPct),
-			tc.PtrToString(rule.CorruptPct),
-			tc.PtrToString(rule.LinkSpeedRateBytes),
+			fieldValue(filter, "src-ip"),
+			fieldValue(filter, "dst-ip"),
+			fieldValue(filter, "src-port"),
+			fieldValue(filter, "dst-port"),
+			formatFields(match),
+			fieldValue(actions, "latency-ms"),
+			fieldValue(actions, "jitter-ms"),
+			fieldValue(actions, "loss-pct"),
+			fieldValue(actions, "corrupt-pct"),
+			fieldValue(actions, "rate-bytes"),
 			tc.PtrToString(rule.FlowID),
 			tc.PtrToString(rule.QdiscHandle),
 			tc.PtrToString(rule.FilterHandle),
@@ -220,8 +703,21 @@ func (c *cmdShowRules) Execute(tail []string) error {
 	return nil
 }
 
+// what a rule does with its traffic: impair it, or pass it unimpaired as an exception of the rule with the given ID, or as protected traffic
+func ruleType(rule *tc.Rule) string {
+	switch {
+	case !rule.PassThrough:
+		return "impair"
+	case rule.Protected:
+		return "protected"
+	case rule.ExceptionOf != nil:
+		return "except " + *rule.ExceptionOf
+	}
+	return "pass"
+}
+
 func (c *cmdShowAll) Execute(tail []string) error {
-	data, err := tc.ListRules(c.Verbose)
+	data, err := newClient(c.Verbose).ListRules(context.Background())
 	if err != nil {
 		log.Fatal(err)
 	}
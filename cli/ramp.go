@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"easytc/tc"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type cmdRamp struct {
+	Interface          *string       `short:"i" long:"interface" description:"optional: specify an interface; default: all interfaces"`
+	SourceIP           *string       `short:"s" long:"src-ip" description:"optional: filter by source IP"`
+	DestinationIP      *string       `short:"d" long:"dst-ip" description:"optional: filter by destination IP"`
+	SourcePort         *string       `short:"S" long:"src-port" description:"optional: filter by source port"`
+	DestinationPort    *string       `short:"D" long:"dst-port" description:"optional: filter by destination port"`
+	LatencyMs          *string       `short:"l" long:"latency-ms" description:"optional: latency range in milliseconds, as start..end"`
+	PacketLossPct      *string       `short:"p" long:"loss-pct" description:"optional: packet loss percentage range, as start..end"`
+	LinkSpeedRateBytes *string       `short:"e" long:"rate-bytes" description:"optional: link speed rate range in bytes, as start..end"`
+	CorruptPct         *string       `short:"c" long:"corrupt-pct" description:"optional: corrupt packets percentage range, as start..end"`
+	Over               time.Duration `long:"over" description:"duration of the ramp" required:"true"`
+	Steps              int           `long:"steps" description:"number of steps" default:"10"`
+	Verbose            bool          `long:"verbose" description:"enable verbose logging"`
+}
+
+// a parameter moving linearly from start to end
+type rampRange struct {
+	name     string
+	start    float64
+	end      float64
+	decimals int
+}
+
+func parseRampRange(name string, val string, decimals int) (*rampRange, error) {
+	items := strings.Split(val, "..")
+	if len(items) != 2 {
+		return nil, fmt.Errorf("%s: range must be specified as start..end", name)
+	}
+	start, err := strconv.ParseFloat(items[0], 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid start value: %w", name, err)
+	}
+	end, err := strconv.ParseFloat(items[1], 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid end value: %w", name, err)
+	}
+	if start < 0 || end < 0 {
+		return nil, fmt.Errorf("%s: values must not be negative", name)
+	}
+	return &rampRange{
+		name:     name,
+		start:    start,
+		end:      end,
+		decimals: decimals,
+	}, nil
+}
+
+// value at the given step
+func (r *rampRange) at(step int, steps int) float64 {
+	v := r.start + (r.end-r.start)*float64(step)/float64(steps)
+	pow := math.Pow(10, float64(r.decimals))
+	return math.Round(v*pow) / pow
+}
+
+func (c *cmdRamp) Execute(tail []string) error {
+	if err := noDryRun("ramp"); err != nil {
+		return err
+	}
+	if c.Steps < 1 {
+		return errors.New("steps must be at least 1")
+	}
+	if c.Over <= 0 {
+		return errors.New("over must be a positive duration")
+	}
+	filter, err := (&ruleArgs{
+		Interface:       c.Interface,
+		SourceIP:        c.SourceIP,
+		DestinationIP:   c.DestinationIP,
+		SourcePort:      c.SourcePort,
+		DestinationPort: c.DestinationPort,
+	}).rule(nil)
+	if err == nil {
+		err = checkFilter(filter)
+	}
+	if err != nil {
+		return err
+	}
+	var latency, loss, rate, corrupt *rampRange
+	if c.LatencyMs != nil {
+		if latency, err = parseRampRange("latency-ms", *c.LatencyMs, 3); err != nil {
+			return err
+		}
+	}
+	if c.PacketLossPct != nil {
+		if loss, err = parseRampRange("loss-pct", *c.PacketLossPct, 2); err != nil {
+			return err
+		}
+	}
+	if c.LinkSpeedRateBytes != nil {
+		if rate, err = parseRampRange("rate-bytes", *c.LinkSpeedRateBytes, 0); err != nil {
+			return err
+		}
+	}
+	if c.CorruptPct != nil {
+		if corrupt, err = parseRampRange("corrupt-pct", *c.CorruptPct, 2); err != nil {
+			return err
+		}
+	}
+	if latency == nil && loss == nil && rate == nil && corrupt == nil {
+		return errors.New("at least one range must be specified from: latencyMs,packetLossPct,linkSpeedRate,corruptPct")
+	}
+	ctx, cancel := interruptContext()
+	defer cancel()
+	client := newClient(c.Verbose)
+	err = netemCheck(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	// remember the current parameters, to restore them if interrupted
+	rules, err := client.ListRules(ctx)
+	if err != nil {
+		return err
+	}
+	orig := []*tc.Rule{}
+	for _, rule := range rules.Rules {
+		if rule.Iface == nil || rule.FilterHandle == nil || rule.PassThrough {
+			continue
+		}
+		if c.Interface != nil && *c.Interface != *rule.Iface {
+			continue
+		}
+		if filterKey(rule) != filterKey(filter) {
+			continue
+		}
+		o := rule.Filter()
+		if latency != nil {
+			o.Latency = restore(rule.Latency)
+		}
+		if loss != nil {
+			o.PacketLoss = restore(rule.PacketLoss)
+		}
+		if rate != nil {
+			o.Rate = restore(rule.Rate)
+		}
+		if corrupt != nil {
+			o.Corrupt = restore(rule.Corrupt)
+		}
+		orig = append(orig, o)
+	}
+	if len(orig) == 0 {
+		return fmt.Errorf("rule not found for %s; create it with 'set' first", describeRule(filter))
+	}
+
+	interval := c.Over / time.Duration(c.Steps)
+	start := time.Now()
+	log.Printf("ramp %s: over=%s steps=%d interval=%s", describeRule(filter), c.Over, c.Steps, interval)
+	for step := 0; step <= c.Steps; step++ {
+		err = sleepCtx(ctx, time.Until(start.Add(interval*time.Duration(step))))
+		if err != nil {
+			break
+		}
+		r := filter.Filter()
+		if latency != nil {
+			r.Latency = tc.Ptr(tc.Milliseconds(latency.at(step, c.Steps)))
+		}
+		if loss != nil {
+			r.PacketLoss = tc.Ptr(tc.Percent(loss.at(step, c.Steps)))
+		}
+		if rate != nil {
+			r.Rate = tc.Ptr(tc.BytesRate(rate.at(step, c.Steps)))
+		}
+		if corrupt != nil {
+			r.Corrupt = tc.Ptr(tc.Percent(corrupt.at(step, c.Steps)))
+		}
+		log.Printf("ramp step %d/%d: %s", step, c.Steps, describeRule(r))
+		err = ruleError(client.Update(ctx, r))
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		log.Printf("ramp %s: finished", describeRule(filter))
+		return nil
+	}
+	if ctx.Err() != nil {
+		log.Printf("ramp %s: interrupted, restoring previous parameters", describeRule(filter))
+		err = errors.New("interrupted")
+	}
+	for _, o := range orig {
+		err = errors.Join(err, client.Update(context.Background(), o))
+	}
+	return err
+}
+
+// value to restore a ramped parameter to; a parameter which did not exist is restored as 0, which disables it
+func restore[T any](v *T) *T {
+	if v == nil {
+		var zero T
+		return &zero
+	}
+	return v
+}
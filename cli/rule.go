@@ -0,0 +1,462 @@
+package main
+
+import (
+	"easytc/tc"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a rule as given on the command line or in a yaml file, in the units of the command line flags
+type ruleArgs struct {
+	Interface          *string           `yaml:"interface"`
+	SourceIP           *string           `yaml:"src-ip"`
+	DestinationIP      *string           `yaml:"dst-ip"`
+	SourcePort         *string           `yaml:"src-port"`
+	DestinationPort    *string           `yaml:"dst-port"`
+	DSCP               *string           `yaml:"dscp"`
+	TOS                *string           `yaml:"tos"`
+	Length             *string           `yaml:"length"`
+	TCPFlags           *string           `yaml:"tcp-flags"`
+	Protocol           *string           `yaml:"protocol"`
+	FwMark             *string           `yaml:"fwmark"`
+	NftMatch           *string           `yaml:"nft-match"`
+	Cgroup             *string           `yaml:"cgroup"`
+	Pid                *string           `yaml:"pid"`
+	SourceSet          *string           `yaml:"src-set"`
+	DestinationSet     *string           `yaml:"dst-set"`
+	AllTraffic         bool              `yaml:"all-traffic"`
+	Priority           *string           `yaml:"priority"`
+	LatencyMs          *string           `yaml:"latency-ms"`
+	JitterMs           *string           `yaml:"jitter-ms"`
+	Distribution       *string           `yaml:"distribution"`
+	PacketLossPct      *string           `yaml:"loss-pct"`
+	LinkSpeedRateBytes *string           `yaml:"rate-bytes"`
+	CorruptPct         *string           `yaml:"corrupt-pct"`
+	Name               *string           `yaml:"name"`
+	Labels             map[string]string `yaml:"labels"`
+	// traffic of the filter which is not impaired, each given by filter fields only
+	Except []*ruleArgs `yaml:"except"`
+}
+
+// command line names of the tc.Rule fields, for error messages
+var ruleFlags = map[string]string{
+	"Iface":           "interface",
+	"SourceIP":        "src-ip",
+	"DestinationIP":   "dst-ip",
+	"SourcePort":      "src-port",
+	"DestinationPort": "dst-port",
+	"DSCP":            "dscp",
+	"TOS":             "tos",
+	"Length":          "length",
+	"TCPFlags":        "tcp-flags",
+	"Protocol":        "protocol",
+	"Match":           "match",
+	"FwMark":          "fwmark",
+	"NftMatch":        "nft-match",
+	"Cgroup":          "cgroup",
+	"Pid":             "pid",
+	"SourceSet":       "src-set",
+	"DestinationSet":  "dst-set",
+	"AllTraffic":      "all-traffic",
+	"Priority":        "priority",
+	"Latency":         "latency-ms",
+	"Jitter":          "jitter-ms",
+	"Distribution":    "distribution",
+	"PacketLoss":      "loss-pct",
+	"Rate":            "rate-bytes",
+	"Corrupt":         "corrupt-pct",
+	"Name":            "name",
+	"Labels":          "label",
+	"FilterHandle":    "handle",
+	"FlowID":          "flowid",
+	"LatencyOver":     "latency-ms-gt",
+	"PacketLossOver":  "loss-pct-gt",
+	"CorruptOver":     "corrupt-pct-gt",
+	"Except":          "except",
+}
+
+// convert to a tc.Rule; iface is used if the rule does not specify an interface
+func (a *ruleArgs) rule(iface *string) (*tc.Rule, error) {
+	if a.Interface != nil {
+		iface = a.Interface
+	}
+	r := &tc.Rule{
+		Iface:        iface,
+		AllTraffic:   a.AllTraffic,
+		Distribution: a.Distribution,
+		Name:         a.Name,
+	}
+	// the labels of an existing rule are kept unless some are given
+	if len(a.Labels) > 0 {
+		r.Labels = a.Labels
+	}
+	errs := &tc.ValidationError{}
+	fail := func(field string, err error) {
+		errs.Fields = append(errs.Fields, &tc.FieldError{Field: field, Err: err})
+	}
+	prefix := func(field string, v *string) *netip.Prefix {
+		if v == nil {
+			return nil
+		}
+		p, err := tc.ParsePrefix(*v)
+		if err != nil {
+			fail(field, err)
+			return nil
+		}
+		return &p
+	}
+	port := func(field string, v *string) *tc.PortRange {
+		if v == nil {
+			return nil
+		}
+		p, err := tc.ParsePortRange(*v)
+		if err != nil {
+			fail(field, err)
+			return nil
+		}
+		return &p
+	}
+	if a.Priority != nil {
+		p, err := strconv.Atoi(*a.Priority)
+		if err != nil {
+			fail("Priority", fmt.Errorf("invalid priority %q", *a.Priority))
+		} else {
+			r.Priority = &p
+		}
+	}
+	r.SourceIP = prefix("SourceIP", a.SourceIP)
+	r.DestinationIP = prefix("DestinationIP", a.DestinationIP)
+	r.SourcePort = port("SourcePort", a.SourcePort)
+	r.DestinationPort = port("DestinationPort", a.DestinationPort)
+	if a.DSCP != nil {
+		v, err := tc.ParseDSCP(*a.DSCP)
+		if err != nil {
+			fail("DSCP", err)
+		} else {
+			r.DSCP = &v
+		}
+	}
+	if a.TOS != nil {
+		v, err := strconv.ParseUint(*a.TOS, 0, 8)
+		if err != nil {
+			fail("TOS", fmt.Errorf("invalid TOS %q, must be 0-255", *a.TOS))
+		} else {
+			r.TOS = tc.Ptr(uint8(v))
+		}
+	}
+	if a.Length != nil {
+		v, err := tc.ParsePortRange(*a.Length)
+		if err != nil {
+			fail("Length", fmt.Errorf("invalid length %q", *a.Length))
+		} else {
+			r.Length = &v
+		}
+	}
+	if a.TCPFlags != nil {
+		v, err := tc.ParseTCPFlags(*a.TCPFlags)
+		if err != nil {
+			fail("TCPFlags", err)
+		} else {
+			r.TCPFlags = &v
+		}
+	}
+	if a.Protocol != nil {
+		v, err := tc.ParseProtocol(*a.Protocol)
+		if err != nil {
+			fail("Protocol", err)
+		} else {
+			r.Protocol = &v
+		}
+	}
+	if a.FwMark != nil {
+		v, err := tc.ParseFwMark(*a.FwMark)
+		if err != nil {
+			fail("FwMark", err)
+		} else {
+			r.FwMark = &v
+		}
+	}
+	r.NftMatch = a.NftMatch
+	if a.Cgroup != nil {
+		v, err := tc.ParseCgroup(*a.Cgroup)
+		if err != nil {
+			fail("Cgroup", err)
+		} else {
+			r.Cgroup = &v
+		}
+	}
+	if a.Pid != nil {
+		pid, err := strconv.Atoi(*a.Pid)
+		var v string
+		if err == nil {
+			v, err = tc.PidCgroup(pid)
+		}
+		switch {
+		case err != nil:
+			fail("Pid", fmt.Errorf("cannot find the cgroup of process %q: %w", *a.Pid, err))
+		case a.Cgroup != nil:
+			fail("Pid", errors.New("cannot be combined with Cgroup"))
+		default:
+			r.Cgroup = &v
+		}
+	}
+	r.SourceSet = a.SourceSet
+	r.DestinationSet = a.DestinationSet
+	if a.LatencyMs != nil {
+		v, err := tc.ParseDurationDefault(*a.LatencyMs, "ms")
+		if err != nil {
+			fail("Latency", err)
+		} else {
+			r.Latency = &v
+		}
+	}
+	if a.JitterMs != nil {
+		v, err := tc.ParseDurationDefault(*a.JitterMs, "ms")
+		if err != nil {
+			fail("Jitter", err)
+		} else {
+			r.Jitter = &v
+		}
+	}
+	if a.PacketLossPct != nil {
+		v, err := tc.ParsePercent(*a.PacketLossPct)
+		if err != nil {
+			fail("PacketLoss", err)
+		} else {
+			r.PacketLoss = &v
+		}
+	}
+	if a.LinkSpeedRateBytes != nil {
+		v, err := tc.ParseRateDefault(*a.LinkSpeedRateBytes, "B")
+		if err != nil {
+			fail("Rate", err)
+		} else {
+			r.Rate = &v
+		}
+	}
+	if a.CorruptPct != nil {
+		v, err := tc.ParsePercent(*a.CorruptPct)
+		if err != nil {
+			fail("Corrupt", err)
+		} else {
+			r.Corrupt = &v
+		}
+	}
+	// exceptions are kept unless some are given
+	for _, x := range a.Except {
+		xr, err := x.rule(nil)
+		if err != nil {
+			fail("Except", err)
+			continue
+		}
+		r.Except = append(r.Except, xr)
+	}
+	if len(errs.Fields) > 0 {
+		return nil, ruleError(errs)
+	}
+	return r, nil
+}
+
+// rewrite rule validation errors to refer to the command line flags instead of the tc.Rule fields
+func ruleError(err error) error {
+	var verr *tc.ValidationError
+	if !errors.As(err, &verr) {
+		return err
+	}
+	// longest first, so that LatencyOver is not taken for Latency
+	fields := []string{}
+	for field := range ruleFlags {
+		fields = append(fields, field)
+	}
+	slices.SortFunc(fields, func(a, b string) int {
+		return len(b) - len(a)
+	})
+	items := []string{}
+	for _, f := range verr.Fields {
+		msg := f.Err.Error()
+		for _, field := range fields {
+			msg = strings.ReplaceAll(msg, field, ruleFlags[field])
+		}
+		if f.Field != "" {
+			msg = ruleFlags[f.Field] + ": " + msg
+		}
+		items = append(items, msg)
+	}
+	return &flagsError{msg: strings.Join(items, "; "), err: err}
+}
+
+// a rule validation error, with the message referring to the command line flags
+type flagsError struct {
+	msg string
+	err error
+}
+
+func (e *flagsError) Error() string {
+	return e.msg
+}
+
+func (e *flagsError) Unwrap() error {
+	return e.err
+}
+
+// parse the expression of --match or --where
+func parseMatch(s string) (*tc.MatchExpr, error) {
+	m, err := tc.ParseMatch(s)
+	if err != nil {
+		return nil, ruleError(&tc.ValidationError{Fields: []*tc.FieldError{{Err: err}}})
+	}
+	return m, nil
+}
+
+// validate a rule which will be set
+func checkRule(r *tc.Rule) error {
+	return ruleError(r.Validate())
+}
+
+// validate a rule which only selects existing rules by filter
+func checkFilter(r *tc.Rule) error {
+	return ruleError(r.ValidateFilter())
+}
+
+// a rule field in the units of the command line flags
+type ruleField struct {
+	name  string
+	value string
+}
+
+func formatPrefix(p *netip.Prefix) string {
+	if p == nil {
+		return ""
+	}
+	if p.Bits() == p.Addr().BitLen() {
+		return p.Addr().String()
+	}
+	return p.String()
+}
+
+func formatMs(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', -1, 64)
+}
+
+// filter fields of a rule which are set
+func filterFields(r *tc.Rule) []ruleField {
+	fields := []ruleField{}
+	if r.AllTraffic {
+		fields = append(fields, ruleField{"all-traffic", "*"})
+	}
+	if r.SourceIP != nil {
+		fields = append(fields, ruleField{"src-ip", formatPrefix(r.SourceIP)})
+	}
+	if r.DestinationIP != nil {
+		fields = append(fields, ruleField{"dst-ip", formatPrefix(r.DestinationIP)})
+	}
+	if r.SourcePort != nil {
+		fields = append(fields, ruleField{"src-port", r.SourcePort.String()})
+	}
+	if r.DestinationPort != nil {
+		fields = append(fields, ruleField{"dst-port", r.DestinationPort.String()})
+	}
+	return append(fields, matchFields(r)...)
+}
+
+// filter fields of a rule other than its IPs and ports which are set
+func matchFields(r *tc.Rule) []ruleField {
+	fields := []ruleField{}
+	if r.DSCP != nil {
+		fields = append(fields, ruleField{"dscp", strconv.Itoa(int(*r.DSCP))})
+	}
+	if r.TOS != nil {
+		fields = append(fields, ruleField{"tos", fmt.Sprintf("0x%02x", *r.TOS)})
+	}
+	if r.Length != nil {
+		fields = append(fields, ruleField{"length", r.Length.String()})
+	}
+	if r.TCPFlags != nil {
+		fields = append(fields, ruleField{"tcp-flags", r.TCPFlags.String()})
+	}
+	if r.Protocol != nil {
+		fields = append(fields, ruleField{"protocol", tc.ProtocolName(*r.Protocol)})
+	}
+	if r.FwMark != nil {
+		fields = append(fields, ruleField{"fwmark", r.FwMark.String()})
+	}
+	if r.Cgroup != nil {
+		fields = append(fields, ruleField{"cgroup", *r.Cgroup})
+	}
+	if r.SourceSet != nil {
+		fields = append(fields, ruleField{"src-set", *r.SourceSet})
+	}
+	if r.DestinationSet != nil {
+		fields = append(fields, ruleField{"dst-set", *r.DestinationSet})
+	}
+	return fields
+}
+
+// action fields of a rule which are set
+func actionFields(r *tc.Rule) []ruleField {
+	fields := []ruleField{}
+	if r.Latency != nil {
+		fields = append(fields, ruleField{"latency-ms", formatMs(*r.Latency)})
+	}
+	if r.Jitter != nil {
+		fields = append(fields, ruleField{"jitter-ms", formatMs(*r.Jitter)})
+	}
+	if r.Distribution != nil {
+		fields = append(fields, ruleField{"distribution", *r.Distribution})
+	}
+	if r.PacketLoss != nil {
+		fields = append(fields, ruleField{"loss-pct", r.PacketLoss.String()})
+	}
+	if r.Rate != nil {
+		fields = append(fields, ruleField{"rate-bytes", strconv.FormatUint(r.Rate.BytesPerSecond(), 10)})
+	}
+	if r.Corrupt != nil {
+		fields = append(fields, ruleField{"corrupt-pct", r.Corrupt.String()})
+	}
+	return fields
+}
+
+// action fields of a rule which are set, with their units, for show rules -H
+func humanActionFields(r *tc.Rule) []ruleField {
+	fields := []ruleField{}
+	if r.Latency != nil {
+		fields = append(fields, ruleField{"latency-ms", tc.FormatDuration(*r.Latency)})
+	}
+	if r.Jitter != nil {
+		fields = append(fields, ruleField{"jitter-ms", tc.FormatDuration(*r.Jitter)})
+	}
+	if r.PacketLoss != nil {
+		fields = append(fields, ruleField{"loss-pct", r.PacketLoss.String() + "%"})
+	}
+	if r.Rate != nil {
+		fields = append(fields, ruleField{"rate-bytes", tc.FormatRate(*r.Rate)})
+	}
+	if r.Corrupt != nil {
+		fields = append(fields, ruleField{"corrupt-pct", r.Corrupt.String() + "%"})
+	}
+	return fields
+}
+
+// value of a field, or empty if it is not set
+func fieldValue(fields []ruleField, name string) string {
+	for _, f := range fields {
+		if f.name == name {
+			return f.value
+		}
+	}
+	return ""
+}
+
+// fields as name=value, separated by spaces
+func formatFields(fields []ruleField) string {
+	items := []string{}
+	for _, f := range fields {
+		items = append(items, f.name+"="+f.value)
+	}
+	return strings.Join(items, " ")
+}
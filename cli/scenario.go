@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"easytc/tc"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type cmdScenarioRun struct {
+	Verbose bool `long:"verbose" description:"enable verbose logging"`
+}
+
+/*
+interface: eth0
+steps:
+  - at: 0s
+    set: {dst-ip: 10.0.0.0/8, latency-ms: 50}
+  - at: 30s
+    set: {dst-ip: 10.0.0.0/8, latency-ms: 50, loss-pct: 10}
+  - at: 60s
+    for: 20s
+    set: {dst-ip: 10.0.0.3, loss-pct: 100}
+  - at: 80s
+    clear: true
+*/
+
+type scenario struct {
+	Interface *string         `yaml:"interface"`
+	Steps     []*scenarioStep `yaml:"steps"`
+}
+
+type scenarioStep struct {
+	At    time.Duration `yaml:"at"`
+	For   time.Duration `yaml:"for"`
+	Set   *ruleArgs     `yaml:"set"`
+	Del   *ruleArgs     `yaml:"del"`
+	Clear bool          `yaml:"clear"`
+	Reset bool          `yaml:"reset"`
+}
+
+// a single point on the scenario timeline
+type scenarioEvent struct {
+	at     time.Duration
+	step   int
+	action string
+	rule   *tc.Rule
+}
+
+func loadScenario(fname string) (*scenario, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	s := &scenario{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err = dec.Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fname, err)
+	}
+	return s, nil
+}
+
+// validate the scenario and expand it into an ordered list of events
+func (s *scenario) timeline() ([]*scenarioEvent, error) {
+	events := []*scenarioEvent{}
+	for i, step := range s.Steps {
+		actions := 0
+		if step.Set != nil {
+			actions++
+		}
+		if step.Del != nil {
+			actions++
+		}
+		if step.Clear {
+			actions++
+		}
+		if step.Reset {
+			actions++
+		}
+		if actions != 1 {
+			return nil, fmt.Errorf("step %d: exactly one of set, del, clear or reset must be specified", i+1)
+		}
+		if step.At < 0 || step.For < 0 {
+			return nil, fmt.Errorf("step %d: at and for must not be negative", i+1)
+		}
+		if step.For != 0 && step.Set == nil {
+			return nil, fmt.Errorf("step %d: for can only be used with set", i+1)
+		}
+		switch {
+		case step.Set != nil:
+			r, err := step.Set.rule(s.Interface)
+			if err == nil && r.Distribution == nil {
+				err = checkRule(r)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("step %d: %w", i+1, err)
+			}
+			events = append(events, &scenarioEvent{at: step.At, step: i + 1, action: "set", rule: r})
+			if step.For != 0 {
+				events = append(events, &scenarioEvent{at: step.At + step.For, step: i + 1, action: "revert", rule: r})
+			}
+		case step.Del != nil:
+			r, err := step.Del.rule(s.Interface)
+			if err == nil {
+				err = checkFilter(r)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("step %d: %w", i+1, err)
+			}
+			events = append(events, &scenarioEvent{at: step.At, step: i + 1, action: "del", rule: r})
+		case step.Clear:
+			events = append(events, &scenarioEvent{at: step.At, step: i + 1, action: "clear"})
+		case step.Reset:
+			events = append(events, &scenarioEvent{at: step.At, step: i + 1, action: "reset", rule: &tc.Rule{Iface: s.Interface}})
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].at < events[j].at
+	})
+	return events, nil
+}
+
+// identifies a rule by interface and filter
+func ruleKey(r *tc.Rule) string {
+	return tc.PtrToString(r.Iface) + "|" + filterKey(r)
+}
+
+// identifies a rule by filter only
+func filterKey(r *tc.Rule) string {
+	items := []string{}
+	for _, f := range filterFields(r) {
+		items = append(items, f.name+"="+f.value)
+	}
+	return strings.Join(items, "|")
+}
+
+// human readable rule description for logging
+func describeRule(r *tc.Rule) string {
+	items := []string{}
+	if r.Iface != nil {
+		items = append(items, "iface="+*r.Iface)
+	}
+	for _, f := range append(filterFields(r), actionFields(r)...) {
+		items = append(items, f.name+"="+f.value)
+	}
+	return strings.Join(items, " ")
+}
+
+// sleep for the given duration, returning early with an error if the context is cancelled
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// changes rules directly with a *tc.Client, or as part of a *tc.Tx
+type ruleChanger interface {
+	Set(ctx context.Context, r *tc.Rule) error
+	Delete(ctx context.Context, r *tc.Rule) error
+}
+
+// tracks the rules applied by a long running command, so that they can be removed when it is interrupted
+type activeRules struct {
+	keys  []string
+	rules map[string][]*tc.Rule
+}
+
+func newActiveRules() *activeRules {
+	return &activeRules{
+		rules: make(map[string][]*tc.Rule),
+	}
+}
+
+// a copy to stage the changes of a transaction on, which replaces a once it is committed
+func (a *activeRules) clone() *activeRules {
+	c := &activeRules{
+		keys:  slices.Clone(a.keys),
+		rules: make(map[string][]*tc.Rule, len(a.rules)),
+	}
+	for k, stack := range a.rules {
+		c.rules[k] = slices.Clone(stack)
+	}
+	return c
+}
+
+func (a *activeRules) set(ctx context.Context, ch ruleChanger, r *tc.Rule) error {
+	err := ch.Set(ctx, r)
+	if err != nil {
+		return err
+	}
+	key := ruleKey(r)
+	if _, ok := a.rules[key]; !ok {
+		a.keys = append(a.keys, key)
+	}
+	a.rules[key] = append(a.rules[key], r)
+	return nil
+}
+
+// restore the rule which was active for the same filter before r was applied, or delete the filter if there was none
+func (a *activeRules) revert(ctx context.Context, ch ruleChanger, r *tc.Rule) (*tc.Rule, error) {
+	key := ruleKey(r)
+	stack := a.rules[key]
+	if len(stack) == 0 {
+		// already removed
+		return nil, nil
+	}
+	if stack[len(stack)-1] != r {
+		// superseded by a later step, only forget about it
+		for i := range stack {
+			if stack[i] == r {
+				a.rules[key] = append(stack[:i], stack[i+1:]...)
+				break
+			}
+		}
+		return nil, nil
+	}
+	stack = stack[:len(stack)-1]
+	a.rules[key] = stack
+	if len(stack) > 0 {
+		prev := stack[len(stack)-1]
+		return prev, ch.Set(ctx, prev)
+	}
+	err := a.del(ctx, ch, r)
+	if errors.Is(err, tc.ErrRuleNotFound) {
+		// removed in the meantime
+		return nil, nil
+	}
+	return nil, err
+}
+
+func (a *activeRules) del(ctx context.Context, ch ruleChanger, r *tc.Rule) error {
+	key := ruleKey(r)
+	delete(a.rules, key)
+	for i, k := range a.keys {
+		if k == key {
+			a.keys = append(a.keys[:i], a.keys[i+1:]...)
+			break
+		}
+	}
+	return ch.Delete(ctx, r)
+}
+
+// delete all rules which are still active
+func (a *activeRules) clear(ctx context.Context, ch ruleChanger) error {
+	var errs []error
+	for len(a.keys) > 0 {
+		stack := a.rules[a.keys[0]]
+		r := stack[len(stack)-1]
+		log.Printf("removing %s", describeRule(r))
+		err := a.del(ctx, ch, r)
+		if err != nil && !errors.Is(err, tc.ErrRuleNotFound) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// context which is cancelled on SIGINT or SIGTERM
+func interruptContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+func (c *cmdScenarioRun) Execute(tail []string) error {
+	if err := noDryRun("scenario run"); err != nil {
+		return err
+	}
+	if len(tail) != 1 {
+		return errors.New("usage: easytc scenario run scenario.yaml")
+	}
+	s, err := loadScenario(tail[0])
+	if err != nil {
+		return err
+	}
+	events, err := s.timeline()
+	if err != nil {
+		return fmt.Errorf("%s: %w", tail[0], err)
+	}
+	ctx, cancel := interruptContext()
+	defer cancel()
+	client, err := newSetClient(c.Verbose)
+	if err != nil {
+		return err
+	}
+	err = netemCheck(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	active := newActiveRules()
+	start := time.Now()
+	log.Printf("scenario %s: starting, %d events", tail[0], len(events))
+	for i := 0; i < len(events); {
+		ev := events[i]
+		err = sleepCtx(ctx, time.Until(start.Add(ev.at)))
+		if err != nil {
+			break
+		}
+		if ev.action == "reset" {
+			log.Printf("t=%s step=%d reset", ev.at, ev.step)
+			err = client.Reset(ctx, ev.rule.Iface)
+			active = newActiveRules()
+			if err != nil {
+				err = fmt.Errorf("step %d: %w", ev.step, err)
+				break
+			}
+			i++
+			continue
+		}
+		// events at the same time are applied together, or not at all
+		n := 1
+		for i+n < len(events) && events[i+n].at == ev.at && events[i+n].action != "reset" {
+			n++
+		}
+		err = applyEvents(ctx, client, active, events[i:i+n])
+		if err != nil {
+			break
+		}
+		i += n
+	}
+	if err == nil {
+		log.Printf("scenario %s: finished after %s", tail[0], time.Since(start).Round(time.Millisecond))
+		return nil
+	}
+	if ctx.Err() != nil {
+		log.Printf("scenario %s: interrupted after %s, cleaning up", tail[0], time.Since(start).Round(time.Millisecond))
+		err = errors.New("interrupted")
+	} else {
+		log.Printf("scenario %s: %s, cleaning up", tail[0], err)
+	}
+	return errors.Join(err, active.clear(context.Background(), client))
+}
+
+// apply scenario events in a single transaction; the active rules only change if it is committed
+func applyEvents(ctx context.Context, client *tc.Client, active *activeRules, events []*scenarioEvent) error {
+	tx, err := client.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	staged := active.clone()
+	for _, ev := range events {
+		switch ev.action {
+		case "set":
+			log.Printf("t=%s step=%d set %s", ev.at, ev.step, describeRule(ev.rule))
+			err = ruleError(staged.set(ctx, tx, ev.rule))
+		case "revert":
+			var prev *tc.Rule
+			prev, err = staged.revert(ctx, tx, ev.rule)
+			if prev != nil {
+				log.Printf("t=%s step=%d revert, restore %s", ev.at, ev.step, describeRule(prev))
+			} else {
+				log.Printf("t=%s step=%d revert %s", ev.at, ev.step, describeRule(ev.rule))
+			}
+		case "del":
+			log.Printf("t=%s step=%d del %s", ev.at, ev.step, describeRule(ev.rule))
+			err = staged.del(ctx, tx, ev.rule)
+		case "clear":
+			log.Printf("t=%s step=%d clear", ev.at, ev.step)
+			err = staged.clear(ctx, tx)
+		}
+		if err != nil {
+			return fmt.Errorf("step %d: %w", ev.step, err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	*active = *staged
+	return nil
+}
@@ -6,6 +6,8 @@ require (
 	github.com/bestmethod/inslice v0.0.0-20210212091431-146fa4d769bf
 	github.com/jedib0t/go-pretty v4.3.0+incompatible
 	github.com/jessevdk/go-flags v1.6.1
+	golang.org/x/term v0.21.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,97 @@
+package tc
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// rules with a Cgroup are fw rules whose mark is set by an nftables rule matching the sockets of the cgroup v2; the socket expression
+// is not allowed in the postrouting hook, so the packets of local sockets are marked in an output chain instead
+const (
+	nftOutputChain = "output"
+	cgroupRoot     = "/sys/fs/cgroup"
+)
+
+// cgroup rules which are set without a mark get one of the bits under CgroupMarkMask, so that they do not clash with the marks
+// of iptables or nftables rules which use the low bits; they have a default priority of their own, as the fw filters of a priority
+// share their mask
+const (
+	CgroupMarkMask        uint32 = 0x00ff0000
+	cgroupMarkShift              = 16
+	DefaultCgroupPriority        = 55
+)
+
+// parse a cgroup v2 path, absolute under /sys/fs/cgroup or relative to it, into the path relative to the cgroup root,
+// for example system.slice/foo.service
+func ParseCgroup(s string) (string, error) {
+	p := strings.Trim(strings.TrimPrefix(s, cgroupRoot), "/")
+	if p == "" {
+		return "", fmt.Errorf("invalid cgroup %q, the root cgroup holds all processes", s)
+	}
+	for _, part := range strings.Split(p, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("invalid cgroup %q", s)
+		}
+	}
+	return p, nil
+}
+
+// the cgroup v2 of a process, relative to the cgroup root
+func PidCgroup(pid int) (string, error) {
+	f, err := os.Open("/proc/" + strconv.Itoa(pid) + "/cgroup")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// the unified hierarchy has ID 0 and no controllers, as in 0::/system.slice/foo.service
+		if p, ok := strings.CutPrefix(scanner.Text(), "0::"); ok {
+			return ParseCgroup(p)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("process %d is not in a cgroup v2", pid)
+}
+
+// the nftables expression matching the packets of the sockets of a cgroup and its descendants
+func cgroupMatch(cgroup string) string {
+	return "socket cgroupv2 level " + strconv.Itoa(strings.Count(cgroup, "/")+1) + " " + strconv.Quote(cgroup)
+}
+
+// the mark of a cgroup rule which is set without one: the mark of the rule of the same cgroup on its interface, or the first free one
+func cgroupMark(rules *Rules, r *Rule) (FwMark, error) {
+	used := []uint32{}
+	for _, rule := range rules.Rules {
+		if rule.Iface == nil || *rule.Iface != *r.Iface || rule.FwMark == nil {
+			continue
+		}
+		if equalPtr(rule.Cgroup, r.Cgroup) {
+			return *rule.FwMark, nil
+		}
+		if rule.FwMark.Mask == CgroupMarkMask {
+			used = append(used, rule.FwMark.Value)
+		}
+	}
+	for v := uint32(1); v <= CgroupMarkMask>>cgroupMarkShift; v++ {
+		mark := FwMark{Value: v << cgroupMarkShift, Mask: CgroupMarkMask}
+		if !slices.Contains(used, mark.Value) {
+			return mark, nil
+		}
+	}
+	return FwMark{}, fmt.Errorf("%w: all cgroup marks under 0x%x are used on interface %s", ErrConflictingRule, CgroupMarkMask, *r.Iface)
+}
+
+// the nftables chain of the rule which sets the mark of a fw rule
+func nftChainOf(cgroup bool) string {
+	if cgroup {
+		return nftOutputChain
+	}
+	return nftChain
+}
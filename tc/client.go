@@ -0,0 +1,273 @@
+package tc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// runs an external command, returning its combined stdout and stderr
+type Runner interface {
+	Run(ctx context.Context, name string, args ...string) ([]byte, error)
+}
+
+// runs commands with os/exec
+type ExecRunner struct{}
+
+func (ExecRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, name, args...).CombinedOutput()
+}
+
+// a Runner which can also pass input to a command on its stdin, as needed to change the members of ipsets in one command
+type InputRunner interface {
+	Runner
+	RunInput(ctx context.Context, input []byte, name string, args ...string) ([]byte, error)
+}
+
+func (ExecRunner) RunInput(ctx context.Context, input []byte, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	return cmd.CombinedOutput()
+}
+
+// manages tc rules; create with New
+type Client struct {
+	tcPath      string
+	nftPath     string
+	namespace   string
+	log         *slog.Logger
+	timeout     time.Duration
+	runner      Runner
+	stateDir    string
+	lockTimeout time.Duration
+	protected   []*Rule
+}
+
+type Option func(*Client)
+
+// path to the tc binary; default: tc from PATH
+func WithTcPath(path string) Option {
+	return func(c *Client) {
+		c.tcPath = path
+	}
+}
+
+// path to the nft binary, which sets the marks of rules with NftMatch; default: nft from PATH
+func WithNftPath(path string) Option {
+	return func(c *Client) {
+		c.nftPath = path
+	}
+}
+
+// manage the interfaces of a named network namespace (ip netns) instead of the current one
+func WithNamespace(name string) Option {
+	return func(c *Client) {
+		c.namespace = name
+	}
+}
+
+// log every command and decision at debug level; default: no logging
+func WithLogger(l *slog.Logger) Option {
+	return func(c *Client) {
+		c.log = l
+	}
+}
+
+// timeout for each command which is run; default: no timeout
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = d
+	}
+}
+
+// run commands with r instead of os/exec
+func WithRunner(r Runner) Option {
+	return func(c *Client) {
+		c.runner = r
+	}
+}
+
+// directory to record which interfaces' root qdiscs easytc owns, and the qdisc trees it adopted; default: /run/easytc
+func WithStateDir(dir string) Option {
+	return func(c *Client) {
+		c.stateDir = dir
+	}
+}
+
+// how long to wait for other easytc processes or goroutines changing tc rules of the same network namespace; default: 30s
+func WithLockTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.lockTimeout = d
+	}
+}
+
+func New(opts ...Option) *Client {
+	c := &Client{
+		tcPath:      "tc",
+		nftPath:     "nft",
+		log:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+		runner:      ExecRunner{},
+		stateDir:    defaultStateDir,
+		lockTimeout: defaultLockTimeout,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// run a command with the client's runner and timeout; failures are returned as a *CommandError
+func (c *Client) run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return c.runInput(ctx, nil, name, args...)
+}
+
+// run a command as run does, with input on its stdin unless input is nil; the runner must be an InputRunner for input
+func (c *Client) runInput(ctx context.Context, input []byte, name string, args ...string) ([]byte, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	argv := append([]string{name}, args...)
+	c.log.Debug("running", "argv", argv)
+	var out []byte
+	var err error
+	if input == nil {
+		out, err = c.runner.Run(ctx, name, args...)
+	} else if r, ok := c.runner.(InputRunner); ok {
+		out, err = r.RunInput(ctx, input, name, args...)
+	} else {
+		err = fmt.Errorf("runner %T cannot pass input to a command", c.runner)
+	}
+	if err == nil && ctx.Err() == nil {
+		return out, nil
+	}
+	cerr := &CommandError{
+		Argv:     argv,
+		ExitCode: -1,
+		Stderr:   string(out),
+		Err:      err,
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		cerr.ExitCode = exitErr.ExitCode()
+	}
+	if ctx.Err() != nil {
+		cerr.Err = ctx.Err()
+	}
+	c.log.Debug("command failed", "argv", argv, "exit_code", cerr.ExitCode, "err", cerr.Err)
+	return out, cerr
+}
+
+// run tc in the client's namespace
+func (c *Client) tc(ctx context.Context, args ...string) ([]byte, error) {
+	if c.namespace != "" {
+		args = append([]string{"-n", c.namespace}, args...)
+	}
+	return c.run(ctx, c.tcPath, args...)
+}
+
+// run a command which has no namespace option in the client's namespace
+func (c *Client) runInNamespace(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return c.runInputInNamespace(ctx, nil, name, args...)
+}
+
+// run a command as runInNamespace does, with input on its stdin unless input is nil
+func (c *Client) runInputInNamespace(ctx context.Context, input []byte, name string, args ...string) ([]byte, error) {
+	if c.namespace != "" {
+		return c.runInput(ctx, input, "ip", append([]string{"netns", "exec", c.namespace, name}, args...)...)
+	}
+	return c.runInput(ctx, input, name, args...)
+}
+
+// run tc, ignoring its output
+func (c *Client) tcExec(ctx context.Context, args ...string) error {
+	_, err := c.tc(ctx, args...)
+	return err
+}
+
+// list the interfaces of the client's namespace, using ip
+func (c *Client) listNamespaceIface(ctx context.Context) ([]string, error) {
+	out, err := c.run(ctx, "ip", "-n", c.namespace, "-j", "link", "show")
+	if err != nil {
+		return nil, err
+	}
+	links := []struct {
+		Ifname string `json:"ifname"`
+	}{}
+	err = json.Unmarshal(out, &links)
+	if err != nil {
+		return nil, err
+	}
+	iface := []string{}
+	for _, l := range links {
+		if l.Ifname == "lo" {
+			continue
+		}
+		iface = append(iface, l.Ifname)
+	}
+	return iface, nil
+}
+
+// client used by the package level functions
+func defaultClient(verbose bool) *Client {
+	if !verbose {
+		return New()
+	}
+	return New(WithLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))))
+}
+
+func ListKernelMods(verbose bool) ([]string, error) {
+	return defaultClient(verbose).ListKernelMods(context.Background())
+}
+
+func InsertKernelMod(verbose bool) error {
+	return defaultClient(verbose).InsertKernelMod(context.Background())
+}
+
+func ListQdisc(verbose bool) ([]*Qdisc, error) {
+	return defaultClient(verbose).ListQdisc(context.Background())
+}
+
+func ListFilter(iface string, verbose bool) ([]*Filter, error) {
+	return defaultClient(verbose).ListFilter(context.Background(), iface)
+}
+
+func ListIface() ([]string, error) {
+	return New().ListIface(context.Background())
+}
+
+func ListRules(verbose bool) (*Rules, error) {
+	return defaultClient(verbose).ListRules(context.Background())
+}
+
+func Set(r *Rule, verbose bool) error {
+	return defaultClient(verbose).Set(context.Background(), r)
+}
+
+func Update(r *Rule, verbose bool) error {
+	return defaultClient(verbose).Update(context.Background(), r)
+}
+
+func Delete(r *Rule, verbose bool) error {
+	return defaultClient(verbose).Delete(context.Background(), r)
+}
+
+func Reset(iface *string, verbose bool) error {
+	return defaultClient(verbose).Reset(context.Background(), iface)
+}
+
+func Adopt(iface *string, verbose bool) error {
+	return defaultClient(verbose).Adopt(context.Background(), iface)
+}
+
+func CleanupUnusedQdisc(verbose bool) error {
+	return defaultClient(verbose).CleanupUnusedQdisc(context.Background())
+}
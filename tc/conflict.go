@@ -0,0 +1,240 @@
+package tc
+
+import (
+	"context"
+	"math"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// two rules on an interface whose filters match some of the same traffic; only the rule which is tried first applies to it
+type Conflict struct {
+	Iface string
+	// tried first, and applied to the traffic both rules match
+	Winner *Rule
+	Loser  *Rule
+	// the winner matches all the traffic of the loser, so the loser never applies
+	Shadowed bool
+	// both rules have the same priority, so which one is tried first depends on the order they were added in
+	SamePriority bool
+}
+
+// the conflicts between the rules of an interface, or of all interfaces if iface is nil
+func (c *Client) Conflicts(ctx context.Context, iface *string) ([]*Conflict, error) {
+	rules, err := c.ListRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if iface != nil {
+		if _, err := rules.selectIfaces(iface); err != nil {
+			return nil, err
+		}
+	}
+	conflicts := []*Conflict{}
+	for i, a := range rules.Rules {
+		if !canConflict(a) || (iface != nil && *a.Iface != *iface) {
+			continue
+		}
+		for _, b := range rules.Rules[i+1:] {
+			if !canConflict(b) || *b.Iface != *a.Iface {
+				continue
+			}
+			if conflict := conflictOf(a, b); conflict != nil {
+				conflicts = append(conflicts, conflict)
+			}
+		}
+	}
+	return conflicts, nil
+}
+
+// the filter of a rule which is set on its interface, with the priority and handle it is tried by; existing is the rule with the same
+// filter, if any. The rule keeps its place, unless it is new or moves to another priority, and then comes after the rules of the same
+// priority
+func placedFilter(r *Rule, existing *Rule) *Rule {
+	p := r.Filter()
+	p.Priority = Ptr(defaultPriority(r))
+	if r.AllTraffic {
+		prio, _ := strconv.Atoi(allTrafficPrio)
+		p.Priority = &prio
+	}
+	p.FilterHandle = Ptr(lastHandle)
+	if existing != nil {
+		p.Priority = existing.Priority
+		p.FilterHandle = existing.FilterHandle
+	}
+	if r.Priority != nil && !r.AllTraffic && !equalPtr(r.Priority, p.Priority) {
+		p.Priority = r.Priority
+		p.FilterHandle = Ptr(lastHandle)
+	}
+	return p
+}
+
+// conflicts of a rule which is set on its interface, against the other rules there; existing is the rule with the same filter, if any
+func conflictsOf(rules *Rules, r *Rule, existing *Rule) []*Conflict {
+	p := placedFilter(r, existing)
+	p.Latency, p.Jitter, p.PacketLoss, p.Rate, p.Corrupt = r.Latency, r.Jitter, r.PacketLoss, r.Rate, r.Corrupt
+	p.ID, p.Name = r.ID, r.Name
+	conflicts := []*Conflict{}
+	if !canConflict(p) {
+		return conflicts
+	}
+	for _, other := range rules.Rules {
+		if other == existing || !canConflict(other) || *other.Iface != *r.Iface {
+			continue
+		}
+		if conflict := conflictOf(p, other); conflict != nil {
+			conflicts = append(conflicts, conflict)
+		}
+	}
+	// the handle of the added filter is not known yet
+	if *p.FilterHandle == lastHandle {
+		p.FilterHandle = nil
+	}
+	return conflicts
+}
+
+// the highest u32 filter handle, to order a filter which is not added yet after the others
+const lastHandle = "fff::fff"
+
+// rules with a filter; pass-through filters and the all-traffic rule overlap other rules by design
+func canConflict(r *Rule) bool {
+	return r.Iface != nil && r.FilterHandle != nil && !r.PassThrough && !r.AllTraffic
+}
+
+func conflictOf(a *Rule, b *Rule) *Conflict {
+	// marks are set independently of the fields u32 matches, whether fw and u32 filters overlap is not known
+	if (a.FwMark == nil) != (b.FwMark == nil) || !overlapBits(markBits(a.FwMark), markBits(b.FwMark)) {
+		return nil
+	}
+	// the members of sets change without the filters, whether rules with sets overlap is not known
+	if a.hasSet() || b.hasSet() {
+		return nil
+	}
+	if !overlaps(a, b) {
+		return nil
+	}
+	if triedBefore(b, a) {
+		a, b = b, a
+	}
+	return &Conflict{
+		Iface:        *a.Iface,
+		Winner:       a,
+		Loser:        b,
+		Shadowed:     covers(a, b),
+		SamePriority: equalPtr(a.Priority, b.Priority),
+	}
+}
+
+// whether the u32 filter fields of a and b match some of the same traffic
+func overlaps(a *Rule, b *Rule) bool {
+	return overlapPrefix(a.SourceIP, b.SourceIP) && overlapPrefix(a.DestinationIP, b.DestinationIP) &&
+		overlapPorts(a.SourcePort, b.SourcePort) && overlapPorts(a.DestinationPort, b.DestinationPort) && overlapPorts(a.Length, b.Length) &&
+		overlapBits(tosBits(a), tosBits(b)) && overlapBits(flagBits(a.TCPFlags), flagBits(b.TCPFlags)) &&
+		overlapBits(protocolBits(a), protocolBits(b))
+}
+
+// whether the kernel tries the filter of a before the one of b: by priority, and within a priority by filter handle
+func triedBefore(a *Rule, b *Rule) bool {
+	pa, pb := priority(a), priority(b)
+	if pa != pb {
+		return pa < pb
+	}
+	return filterNode(a.FilterHandle) < filterNode(b.FilterHandle)
+}
+
+func priority(r *Rule) int {
+	if r.Priority == nil {
+		return defaultPriority(r)
+	}
+	return *r.Priority
+}
+
+// node ID of a u32 filter handle, as in 800::801
+func filterNode(fh *string) uint64 {
+	if fh == nil {
+		return math.MaxUint64
+	}
+	_, node, _ := strings.Cut(*fh, "::")
+	n, err := strconv.ParseUint(node, 16, 32)
+	if err != nil {
+		return math.MaxUint64
+	}
+	return n
+}
+
+// whether the filter of a matches all the traffic of the filter of b
+func covers(a *Rule, b *Rule) bool {
+	return coversPrefix(a.SourceIP, b.SourceIP) && coversPrefix(a.DestinationIP, b.DestinationIP) &&
+		coversPorts(a.SourcePort, b.SourcePort) && coversPorts(a.DestinationPort, b.DestinationPort) && coversPorts(a.Length, b.Length) &&
+		coversBits(tosBits(a), tosBits(b)) && coversBits(flagBits(a.TCPFlags), flagBits(b.TCPFlags)) && coversBits(markBits(a.FwMark), markBits(b.FwMark)) &&
+		coversBits(protocolBits(a), protocolBits(b))
+}
+
+// bits under a mask, as matched by u32 or fw
+type maskedBits struct {
+	value uint32
+	mask  uint32
+}
+
+// the DSCP or TOS match of a rule, as bits of the TOS byte
+func tosBits(r *Rule) *maskedBits {
+	switch {
+	case r.DSCP != nil:
+		return &maskedBits{value: uint32(*r.DSCP) << 2, mask: 0xfc}
+	case r.TOS != nil:
+		return &maskedBits{value: uint32(*r.TOS), mask: 0xff}
+	}
+	return nil
+}
+
+func flagBits(f *TCPFlags) *maskedBits {
+	if f == nil {
+		return nil
+	}
+	return &maskedBits{value: uint32(f.Value), mask: uint32(f.Mask)}
+}
+
+// the protocol of a rule, which TCP flags imply
+func protocolBits(r *Rule) *maskedBits {
+	switch {
+	case r.Protocol != nil:
+		return &maskedBits{value: uint32(*r.Protocol), mask: 0xff}
+	case r.TCPFlags != nil:
+		return &maskedBits{value: protocolTCP, mask: 0xff}
+	}
+	return nil
+}
+
+func markBits(m *FwMark) *maskedBits {
+	if m == nil {
+		return nil
+	}
+	return &maskedBits{value: m.Value, mask: m.Mask}
+}
+
+// masked bits overlap unless a bit under both masks differs
+func overlapBits(a *maskedBits, b *maskedBits) bool {
+	return a == nil || b == nil || (a.value^b.value)&a.mask&b.mask == 0
+}
+
+func coversBits(a *maskedBits, b *maskedBits) bool {
+	return a == nil || (b != nil && a.mask&b.mask == a.mask && (a.value^b.value)&a.mask == 0)
+}
+
+// an unset field matches anything
+func overlapPrefix(a *netip.Prefix, b *netip.Prefix) bool {
+	return a == nil || b == nil || a.Overlaps(*b)
+}
+
+func overlapPorts(a *PortRange, b *PortRange) bool {
+	return a == nil || b == nil || (a.First <= b.Last && b.First <= a.Last)
+}
+
+func coversPrefix(a *netip.Prefix, b *netip.Prefix) bool {
+	return a == nil || (b != nil && withinPrefix(b, a))
+}
+
+func coversPorts(a *PortRange, b *PortRange) bool {
+	return a == nil || (b != nil && withinPorts(b, a))
+}
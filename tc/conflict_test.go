@@ -0,0 +1,161 @@
+package tc
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func prefix(s string) *netip.Prefix {
+	return Ptr(netip.MustParsePrefix(s))
+}
+
+func ports(first uint16, last uint16) *PortRange {
+	return &PortRange{First: first, Last: last}
+}
+
+func flags(t *testing.T, s string) *TCPFlags {
+	t.Helper()
+	f, err := ParseTCPFlags(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &f
+}
+
+func mark(t *testing.T, s string) *FwMark {
+	t.Helper()
+	m, err := ParseFwMark(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &m
+}
+
+func TestOverlapsCovers(t *testing.T) {
+	tcp, udp := Ptr(uint8(protocolTCP)), Ptr(uint8(17))
+	tests := []struct {
+		a, b     *Rule
+		overlaps bool
+		// a covers b, and b covers a
+		covers, coveredBy bool
+	}{
+		{&Rule{DestinationIP: prefix("10.0.0.0/8")}, &Rule{DestinationIP: prefix("10.1.0.0/16")}, true, true, false},
+		{&Rule{DestinationIP: prefix("10.0.0.0/8")}, &Rule{DestinationIP: prefix("192.168.0.0/16")}, false, false, false},
+		{&Rule{DestinationIP: prefix("10.0.0.0/8")}, &Rule{DestinationIP: prefix("10.0.0.0/8")}, true, true, true},
+		// an unset field matches anything
+		{&Rule{SourceIP: prefix("10.0.0.0/8")}, &Rule{DestinationIP: prefix("10.0.0.0/8")}, true, false, false},
+		{&Rule{}, &Rule{DestinationPort: Ptr(Port(80))}, true, true, false},
+		{&Rule{DestinationPort: ports(80, 90)}, &Rule{DestinationPort: ports(85, 100)}, true, false, false},
+		{&Rule{DestinationPort: ports(1, 1000)}, &Rule{DestinationPort: Ptr(Port(80))}, true, true, false},
+		{&Rule{SourcePort: Ptr(Port(80))}, &Rule{SourcePort: Ptr(Port(81))}, false, false, false},
+		{&Rule{Length: ports(0, 511)}, &Rule{Length: ports(512, 1023)}, false, false, false},
+		// DSCP 46 is the TOS byte 0xb8 without its two ECN bits
+		{&Rule{DSCP: Ptr(uint8(46))}, &Rule{TOS: Ptr(uint8(0xb8))}, true, true, false},
+		{&Rule{DSCP: Ptr(uint8(46))}, &Rule{TOS: Ptr(uint8(0xb9))}, true, true, false},
+		{&Rule{DSCP: Ptr(uint8(46))}, &Rule{DSCP: Ptr(uint8(10))}, false, false, false},
+		{&Rule{TOS: Ptr(uint8(0x10))}, &Rule{TOS: Ptr(uint8(0x20))}, false, false, false},
+		// TCP flags imply TCP
+		{&Rule{Protocol: tcp}, &Rule{TCPFlags: flags(t, "syn")}, true, true, false},
+		{&Rule{Protocol: udp}, &Rule{TCPFlags: flags(t, "syn")}, false, false, false},
+		{&Rule{TCPFlags: flags(t, "syn")}, &Rule{TCPFlags: flags(t, "syn,!ack")}, true, true, false},
+		{&Rule{TCPFlags: flags(t, "syn,!ack")}, &Rule{TCPFlags: flags(t, "syn,ack")}, false, false, false},
+		{&Rule{Protocol: tcp, DestinationPort: Ptr(Port(443))}, &Rule{Protocol: udp, DestinationPort: Ptr(Port(443))}, false, false, false},
+		// marks are not u32 fields, only their bits are covered
+		{&Rule{FwMark: mark(t, "0x10/0xff")}, &Rule{FwMark: mark(t, "0x110")}, true, true, false},
+		{&Rule{FwMark: mark(t, "0x10")}, &Rule{FwMark: mark(t, "0x20")}, true, false, false},
+	}
+	for _, tt := range tests {
+		if got := overlaps(tt.a, tt.b); got != tt.overlaps {
+			t.Errorf("overlaps(%s, %s) = %v, want %v", describeFilter(tt.a), describeFilter(tt.b), got, tt.overlaps)
+		}
+		if got := overlaps(tt.b, tt.a); got != tt.overlaps {
+			t.Errorf("overlaps(%s, %s) = %v, want %v", describeFilter(tt.b), describeFilter(tt.a), got, tt.overlaps)
+		}
+		if got := covers(tt.a, tt.b); got != tt.covers {
+			t.Errorf("covers(%s, %s) = %v, want %v", describeFilter(tt.a), describeFilter(tt.b), got, tt.covers)
+		}
+		if got := covers(tt.b, tt.a); got != tt.coveredBy {
+			t.Errorf("covers(%s, %s) = %v, want %v", describeFilter(tt.b), describeFilter(tt.a), got, tt.coveredBy)
+		}
+	}
+}
+
+func TestConflictsOf(t *testing.T) {
+	rule := func(name string, prio int, fh string, r *Rule) *Rule {
+		r.Iface, r.Name, r.Priority, r.FilterHandle = Ptr("eth0"), Ptr(name), Ptr(prio), Ptr(fh)
+		return r
+	}
+	other := rule("other-iface", 100, "800::800", &Rule{DestinationIP: prefix("10.0.0.0/8")})
+	other.Iface = Ptr("eth1")
+	rules := &Rules{Rules: []*Rule{
+		rule("a", 100, "800::800", &Rule{DestinationIP: prefix("10.0.0.0/8")}),
+		rule("b", 100, "800::801", &Rule{DestinationIP: prefix("10.1.0.0/16")}),
+		rule("fw", 50, "0x10", &Rule{FwMark: mark(t, "0x10")}),
+		rule("all", 1000, "803::800", &Rule{AllTraffic: true}),
+		rule("pass", 1, "802::800", &Rule{DestinationIP: prefix("10.0.0.1/32"), PassThrough: true}),
+		rule("set", 60, "1", &Rule{DestinationSet: Ptr("peers")}),
+		other,
+	}}
+	tests := []struct {
+		name string
+		r    *Rule
+		want []string
+	}{
+		// a new rule comes after the rules of its priority
+		{"new rule", &Rule{DestinationIP: prefix("10.1.2.0/24")}, []string{"a>r shadowed same-priority", "b>r shadowed same-priority"}},
+		{"new rule tried first", &Rule{DestinationIP: prefix("10.1.2.0/24"), Priority: Ptr(50)}, []string{"r>a", "r>b"}},
+		{"new rule covering", &Rule{DestinationIP: prefix("10.0.0.0/7"), Priority: Ptr(50)}, []string{"r>a shadowed", "r>b shadowed"}},
+		// the rule with the same filter is the one which is set, and keeps its place
+		{"existing rule", &Rule{DestinationIP: prefix("10.0.0.0/8")}, []string{"r>b shadowed same-priority"}},
+		{"existing rule moving", &Rule{DestinationIP: prefix("10.0.0.0/8"), Priority: Ptr(100)}, []string{"r>b shadowed same-priority"}},
+		{"existing rule moving last", &Rule{DestinationIP: prefix("10.0.0.0/8"), Priority: Ptr(200)}, []string{"b>r"}},
+		{"no overlap", &Rule{DestinationIP: prefix("192.168.0.0/16")}, nil},
+		// fw filters only conflict with each other, by their bits
+		{"fw rule", &Rule{FwMark: mark(t, "0x10/0xff"), Priority: Ptr(70)}, []string{"fw>r"}},
+		{"fw rule tried first", &Rule{FwMark: mark(t, "0x10/0xff"), Priority: Ptr(40)}, []string{"r>fw shadowed"}},
+		{"fw rule without overlap", &Rule{FwMark: mark(t, "0x20")}, nil},
+		// pass-through filters, all-traffic rules and sets overlap by design, or unknowably
+		{"all traffic", &Rule{AllTraffic: true}, nil},
+		{"set", &Rule{DestinationSet: Ptr("other")}, nil},
+	}
+	for _, tt := range tests {
+		tt.r.Iface, tt.r.Name = Ptr("eth0"), Ptr("r")
+		got := []string{}
+		for _, c := range conflictsOf(rules, tt.r, findFilter(rules, tt.r)) {
+			s := *c.Winner.Name + ">" + *c.Loser.Name
+			if c.Shadowed {
+				s += " shadowed"
+			}
+			if c.SamePriority {
+				s += " same-priority"
+			}
+			got = append(got, s)
+		}
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s: got conflicts\n%s\nwant\n%s", tt.name, strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+		}
+	}
+}
+
+// the filter fields of a rule, for test messages
+func describeFilter(r *Rule) string {
+	s := filterString(r)
+	if r.DSCP != nil {
+		s += fmt.Sprintf(" dscp %d", *r.DSCP)
+	}
+	if r.TOS != nil {
+		s += fmt.Sprintf(" tos 0x%02x", *r.TOS)
+	}
+	if r.Length != nil {
+		s += " length " + r.Length.String()
+	}
+	if r.TCPFlags != nil {
+		s += fmt.Sprintf(" flags 0x%02x/0x%02x", r.TCPFlags.Value, r.TCPFlags.Mask)
+	}
+	if r.FwMark != nil {
+		s += " mark " + r.FwMark.String()
+	}
+	return "{" + strings.TrimSpace(s) + "}"
+}
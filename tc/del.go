@@ -1,107 +1,245 @@
 package tc
 
 import (
+	"context"
 	"fmt"
-	"os/exec"
-
-	"github.com/bestmethod/inslice"
+	"slices"
 )
 
-// remove all rules from a given interface; if interface is not given, removes all rules from all interfaces
-func Reset(iface *string, verbose bool) error {
-	ifaces := []string{}
-	if iface == nil {
-		var err error
-		ifaces, err = ListIface()
+// remove all rules from a given interface; if interface is not given, removes all rules from all interfaces;
+// only root qdiscs created by easytc are removed, and adopted qdisc trees are restored
+func (c *Client) Reset(ctx context.Context, iface *string) error {
+	unlock, err := c.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	rules, err := c.ListRules(ctx)
+	if err != nil {
+		return err
+	}
+	ifaces, err := rules.selectIfaces(iface)
+	if err != nil {
+		return err
+	}
+	for _, i := range ifaces {
+		state, err := c.readState(i)
+		if err != nil {
+			return err
+		}
+		if hasNft(state) {
+			err = c.dropNft(ctx, i, nil)
+			if err != nil {
+				return err
+			}
+		}
+		root := rootQdisc(rules.Qdisc, i)
+		switch {
+		case isOwnRoot(root):
+			err = c.tcExec(ctx, "qdisc", "del", "dev", i, "root")
+			if err != nil {
+				return err
+			}
+			for _, rule := range rules.Rules {
+				if rule.Iface != nil && *rule.Iface == i && rule.FilterHandle != nil && !rule.PassThrough {
+					c.recordChange(ChangeRemove, rule, nil)
+				}
+			}
+		case state == nil:
+			c.log.Debug("root qdisc is not owned by easytc", "iface", i)
+			continue
+		case !isDefaultRoot(root):
+			// the easytc qdisc was replaced by someone else, keep their setup
+			c.log.Debug("root qdisc is no longer owned by easytc", "iface", i)
+			state.Snapshot = nil
+		}
+		// the root is the kernel default now; recreate an adopted tree, also if adopting it failed half way
+		if state != nil && state.Snapshot != nil {
+			err = c.restore(ctx, i, state.Snapshot)
+			if err != nil {
+				path, _ := c.statePath(i)
+				return fmt.Errorf("restoring the adopted qdiscs of interface %s, see %s: %w", i, path, err)
+			}
+		}
+		err = c.removeState(i)
 		if err != nil {
 			return err
 		}
-	} else {
-		ifaces = append(ifaces, *iface)
-	}
-	for _, i := range ifaces {
-		comm := []string{"tc", "qdisc", "del", "dev", i, "root"}
-		logf(verbose, "(Reset) Running %v", comm)
-		exec.Command(comm[0], comm[1:]...).CombinedOutput()
 	}
 	return nil
 }
 
-func CleanupUnusedQdisc(verbose bool) error {
-	rules, err := ListRules(verbose)
+// remove netem qdiscs which are no longer used by any filter
+func (c *Client) CleanupUnusedQdisc(ctx context.Context) error {
+	unlock, err := c.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return c.cleanupUnusedQdisc(ctx)
+}
+
+func (c *Client) cleanupUnusedQdisc(ctx context.Context) error {
+	rules, err := c.ListRules(ctx)
 	if err != nil {
 		return err
 	}
 	for _, rule := range rules.Rules {
 		if rule.FilterHandle == nil && rule.Iface != nil && rule.QdiscHandle != nil && rule.FlowID != nil {
-			comm := []string{"tc", "qdisc", "del", "dev", *rule.Iface, "parent", *rule.FlowID, "handle", *rule.QdiscHandle}
-			logf(verbose, "(CleanupUnusedQdisc) Running %v", comm)
-			out, err := exec.Command(comm[0], comm[1:]...).CombinedOutput()
+			err := c.tcExec(ctx, "qdisc", "del", "dev", *rule.Iface, "parent", *rule.FlowID, "handle", *rule.QdiscHandle)
 			if err != nil {
-				return fmt.Errorf("%s:%s", err, string(out))
+				return err
 			}
 		}
 	}
 	return nil
 }
 
-func Delete(r *Rule, verbose bool) error {
+// delete the rule selected by the filter, name or filter handle of r, from the interface of r, or from all interfaces
+func (c *Client) Delete(ctx context.Context, r *Rule) error {
+	unlock, err := c.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return c.undoOnError(ctx, func() error {
+		return c.deleteRule(ctx, r)
+	})
+}
+
+func (c *Client) deleteRule(ctx context.Context, r *Rule) error {
+	err := r.ValidateFilter()
+	if err != nil {
+		return err
+	}
 	// list qdisc
-	rules, err := ListRules(verbose)
+	rules, err := c.ListRules(ctx)
 	if err != nil {
 		return err
 	}
 
 	// list ifaces
-	var ifaces []string
-	if r.Iface == nil {
-		ifaces = rules.Interfaces
-	} else {
-		ifaces = append(ifaces, *r.Iface)
-		if !inslice.HasString(ifaces, *r.Iface) {
-			return fmt.Errorf("interface %s does not exist", *r.Iface)
-		}
+	ifaces, err := rules.selectIfaces(r.Iface)
+	if err != nil {
+		return err
 	}
 
+	found := false
 	for _, iface := range ifaces {
 		for _, rule := range rules.Rules {
-			if rule.Iface == nil || iface != *rule.Iface {
+			if rule.Iface == nil || iface != *rule.Iface || rule.FilterHandle == nil {
 				continue
 			}
-			if (r.SourceIP != nil && rule.SourceIP == nil) || (r.SourceIP == nil && rule.SourceIP != nil) {
+			if !r.selects(rule) {
 				continue
 			}
-			if (r.DestinationIP != nil && rule.DestinationIP == nil) || (r.DestinationIP == nil && rule.DestinationIP != nil) {
-				continue
-			}
-			if (r.SourcePort != nil && rule.SourcePort == nil) || (r.SourcePort == nil && rule.SourcePort != nil) {
-				continue
-			}
-			if (r.DestinationPort != nil && rule.DestinationPort == nil) || (r.DestinationPort == nil && rule.DestinationPort != nil) {
-				continue
-			}
-			if r.SourceIP != nil && *r.SourceIP != *rule.SourceIP {
-				continue
-			}
-			if r.DestinationIP != nil && *r.DestinationIP != *rule.DestinationIP {
-				continue
+			// we are here, the rule had been found, delete it
+			err := c.tcExec(ctx, filterArgs("del", *rule.Iface, rule, rule.FilterHandle)...)
+			if err != nil {
+				return err
 			}
-			if r.SourcePort != nil && *r.SourcePort != *rule.SourcePort {
-				continue
+			err = c.dropUnusedFlow(ctx, rules, rule)
+			if err != nil {
+				return err
 			}
-			if r.DestinationPort != nil && *r.DestinationPort != *rule.DestinationPort {
-				continue
+			err = c.dropMeta(iface, *rule.FilterHandle)
+			if err != nil {
+				return err
 			}
-			// we are here, the rule had been found, delete it
-			comm := []string{"tc", "filter", "del", "dev", *rule.Iface, "protocol", "ip", "parent", "1:0", "prio", "3", "handle", *rule.FilterHandle, "u32"}
-			logf(verbose, "(Delete) Running %v", comm)
-			out, err := exec.Command(comm[0], comm[1:]...).CombinedOutput()
+			err = c.dropExceptions(ctx, rules, rule)
 			if err != nil {
-				return fmt.Errorf("%s: %s", err, string(out))
+				return err
+			}
+			if rule.NftMatch != nil {
+				err = c.dropNft(ctx, iface, rule.FwMark)
+				if err != nil {
+					return err
+				}
 			}
+			c.recordChange(ChangeRemove, rule, nil)
+			found = true
 			break
 		}
 	}
+	if !found {
+		return ErrRuleNotFound
+	}
 
-	return CleanupUnusedQdisc(verbose)
+	return c.cleanupUnusedQdisc(ctx)
+}
+
+// delete all rules selected by s, and the netem qdiscs they leave unused; returns the deleted rules, or ErrRuleNotFound if none matched
+func (c *Client) DeleteMatching(ctx context.Context, s *Selector) ([]*Rule, error) {
+	unlock, err := c.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	var removed []*Rule
+	err = c.undoOnError(ctx, func() error {
+		removed, err = c.deleteMatching(ctx, s)
+		return err
+	})
+	return removed, err
+}
+
+func (c *Client) deleteMatching(ctx context.Context, s *Selector) ([]*Rule, error) {
+	err := s.Validate()
+	if err != nil {
+		return nil, err
+	}
+	rules, err := c.ListRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if s.Iface != nil {
+		if _, err := rules.selectIfaces(s.Iface); err != nil {
+			return nil, err
+		}
+	}
+	selected, err := s.selectRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	if len(selected) == 0 {
+		return nil, ErrRuleNotFound
+	}
+	for _, rule := range selected {
+		err = c.tcExec(ctx, filterArgs("del", *rule.Iface, rule, rule.FilterHandle)...)
+		if err != nil {
+			return nil, err
+		}
+		err = c.dropMeta(*rule.Iface, *rule.FilterHandle)
+		if err != nil {
+			return nil, err
+		}
+		err = c.dropExceptions(ctx, rules, rule)
+		if err != nil {
+			return nil, err
+		}
+		if rule.NftMatch != nil {
+			err = c.dropNft(ctx, *rule.Iface, rule.FwMark)
+			if err != nil {
+				return nil, err
+			}
+		}
+		c.recordChange(ChangeRemove, rule, nil)
+	}
+	// netem qdiscs which no remaining filter points to, once per flow
+	dropped := make(map[string]bool)
+	for _, rule := range selected {
+		flow := *rule.Iface + " " + PtrToString(rule.FlowID)
+		if rule.QdiscHandle == nil || dropped[flow] || slices.ContainsFunc(rules.Rules, func(other *Rule) bool {
+			return other.FilterHandle != nil && !slices.Contains(selected, other) && *other.Iface == *rule.Iface && equalPtr(other.FlowID, rule.FlowID)
+		}) {
+			continue
+		}
+		dropped[flow] = true
+		err = c.tcExec(ctx, "qdisc", "del", "dev", *rule.Iface, "parent", *rule.FlowID, "handle", *rule.QdiscHandle)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return selected, c.cleanupUnusedQdisc(ctx)
 }
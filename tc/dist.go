@@ -0,0 +1,232 @@
+package tc
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// table layout as used by iproute2's maketable, see netem/maketable.c
+const (
+	distTableSize        = 16384 / 4
+	distTableFactor      = 8192
+	distMinShort         = -32768
+	distMaxShort         = 32767
+	distTableDomain      = (distMaxShort / distTableFactor) + 1
+	distTableGranularity = 50000
+	distTableFullSize    = distTableDomain * distTableGranularity * 2
+)
+
+// directories in which tc looks for distribution tables, in order of preference; TC_LIB_DIR takes precedence over all
+var DistDirs = []string{"/usr/lib/tc", "/usr/lib64/tc", "/usr/lib/x86_64-linux-gnu/tc", "/usr/lib/aarch64-linux-gnu/tc"}
+
+// netem delay distribution table, generated from latency samples
+type DistTable struct {
+	Name     string
+	Samples  int
+	MeanMs   float64
+	StddevMs float64
+	Table    []int
+}
+
+// read latency samples, in milliseconds, from a reader; samples are whitespace or newline separated, lines starting with # are ignored
+func ReadSamples(r io.Reader) ([]float64, error) {
+	samples := []float64{}
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.Trim(scanner.Text(), "\r\n\t ")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, item := range strings.Fields(line) {
+			v, err := strconv.ParseFloat(item, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid sample %q: %s", lineNo, item, err)
+			}
+			samples = append(samples, v)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
+
+// generate the inverse distribution table from latency samples, the same way iproute2's maketable does
+func MakeDistTable(name string, samples []float64) (*DistTable, error) {
+	if len(samples) < 2 {
+		return nil, errors.New("at least 2 samples are required to build a distribution table")
+	}
+	sum := float64(0)
+	sumSquare := float64(0)
+	for _, x := range samples {
+		sum += x
+		sumSquare += x * x
+	}
+	n := float64(len(samples))
+	mu := sum / n
+	sigma := math.Sqrt((sumSquare - n*mu*mu) / (n - 1))
+	if sigma == 0 || math.IsNaN(sigma) {
+		return nil, errors.New("samples have no variance, use a fixed latency instead of a distribution")
+	}
+
+	// histogram of normalized values
+	table := make([]int, distTableFullSize)
+	for _, x := range samples {
+		index := int(math.RoundToEven(((x-mu)/sigma + distTableDomain) * distTableGranularity))
+		if index < 0 {
+			index = 0
+		}
+		if index >= distTableFullSize {
+			index = distTableFullSize - 1
+		}
+		table[index]++
+	}
+
+	// cumulative distribution
+	total := 0
+	for i := range table {
+		total += table[i]
+		table[i] = total
+	}
+
+	// invert
+	inverse := make([]int, distTableSize)
+	for i := range inverse {
+		inverse[i] = distMinShort
+	}
+	for i := range table {
+		findex := float64(i)/distTableGranularity - distTableDomain
+		fvalue := float64(table[i]) / float64(total)
+		inverseIndex := int(math.RoundToEven(fvalue * distTableSize))
+		inverseValue := int(math.RoundToEven(findex * distTableFactor))
+		if inverseValue <= distMinShort {
+			inverseValue = distMinShort + 1
+		}
+		if inverseValue > distMaxShort {
+			inverseValue = distMaxShort
+		}
+		if inverseIndex >= distTableSize {
+			inverseIndex = distTableSize - 1
+		}
+		inverse[inverseIndex] = inverseValue
+	}
+
+	// fill in missing entries using linear interpolation
+	last := distMinShort
+	lasti := -1
+	for i := range inverse {
+		if inverse[i] != distMinShort {
+			last = inverse[i]
+			lasti = i
+			continue
+		}
+		j := i
+		for j < distTableSize && inverse[j] == distMinShort {
+			j++
+		}
+		if j < distTableSize {
+			inverse[i] = last + (i-lasti)*(inverse[j]-last)/(j-lasti)
+		} else {
+			inverse[i] = last + (i-lasti)*(distMaxShort-last)/(distTableSize-lasti)
+		}
+	}
+
+	return &DistTable{
+		Name:     name,
+		Samples:  len(samples),
+		MeanMs:   mu,
+		StddevMs: sigma,
+		Table:    inverse,
+	}, nil
+}
+
+// write the table in iproute2 .dist format; sample statistics are stored in a comment so that the table can be used without specifying latency and jitter
+func (d *DistTable) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# This is the distribution table for the %s distribution.\n", d.Name)
+	fmt.Fprintf(bw, "# easytc samples=%d mean_ms=%s stddev_ms=%s\n", d.Samples, strconv.FormatFloat(d.MeanMs, 'f', 3, 64), strconv.FormatFloat(d.StddevMs, 'f', 3, 64))
+	for i, v := range d.Table {
+		sep := " "
+		if i%8 == 7 {
+			sep = "\n"
+		}
+		fmt.Fprintf(bw, "%d%s", v, sep)
+	}
+	return bw.Flush()
+}
+
+// find the directory tc loads distribution tables from
+func DistDir() string {
+	if dir := os.Getenv("TC_LIB_DIR"); dir != "" {
+		return dir
+	}
+	for _, dir := range DistDirs {
+		if _, err := os.Stat(filepath.Join(dir, "normal.dist")); err == nil {
+			return dir
+		}
+	}
+	return DistDirs[0]
+}
+
+// read sample statistics of a distribution table previously generated by easytc
+func ReadDistTable(name string) (*DistTable, error) {
+	fname := filepath.Join(DistDir(), name+".dist")
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	d := &DistTable{
+		Name: name,
+	}
+	found := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "#") {
+			for _, item := range strings.Fields(line) {
+				v, err := strconv.Atoi(item)
+				if err != nil {
+					return nil, fmt.Errorf("%s: invalid table entry %q", fname, item)
+				}
+				d.Table = append(d.Table, v)
+			}
+			continue
+		}
+		items := strings.Fields(strings.TrimPrefix(line, "#"))
+		if len(items) == 0 || items[0] != "easytc" {
+			continue
+		}
+		for _, item := range items[1:] {
+			kv := strings.SplitN(item, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "samples":
+				d.Samples, _ = strconv.Atoi(kv[1])
+			case "mean_ms":
+				d.MeanMs, _ = strconv.ParseFloat(kv[1], 64)
+				found = true
+			case "stddev_ms":
+				d.StddevMs, _ = strconv.ParseFloat(kv[1], 64)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !found {
+		return d, fmt.Errorf("%s: table was not generated by easytc, latency and jitter must be specified", fname)
+	}
+	return d, nil
+}
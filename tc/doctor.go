@@ -0,0 +1,337 @@
+package tc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	CheckOK   = "ok"
+	CheckWarn = "warn"
+	CheckFail = "fail"
+)
+
+// result of a single doctor check
+type Check struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+	Fix    string `json:"fix,omitempty"`
+}
+
+// result of all doctor checks; OK is false if any check failed
+type Report struct {
+	OK        bool     `json:"ok"`
+	Distro    string   `json:"distro"`
+	Namespace string   `json:"namespace"`
+	Checks    []*Check `json:"checks"`
+}
+
+func (r *Report) add(name string, status string, detail string, fix string) {
+	r.Checks = append(r.Checks, &Check{Name: name, Status: status, Detail: detail, Fix: fix})
+	if status == CheckFail {
+		r.OK = false
+	}
+}
+
+// kernel modules used by easytc; ifb is only needed for ingress rules, cls_fw for fwmark and cgroup rules, and cls_basic and
+// em_ipset for rules with sets
+var doctorModules = []struct {
+	name     string
+	required bool
+}{
+	{"sch_netem", true},
+	{"sch_prio", true},
+	{"cls_u32", true},
+	{"ifb", false},
+	{"cls_fw", false},
+	{"cls_basic", false},
+	{"em_ipset", false},
+}
+
+// check the environment for everything easytc needs, without changing anything
+func (c *Client) Doctor(ctx context.Context) *Report {
+	distro := osDistro()
+	r := &Report{
+		OK:        true,
+		Distro:    distro.name,
+		Namespace: c.namespace,
+	}
+
+	// tc binary and iproute2 version
+	path, err := exec.LookPath(c.tcPath)
+	if err != nil {
+		r.add("tc", CheckFail, fmt.Sprintf("%s not found: %s", c.tcPath, err), distro.fix("tc", ""))
+	} else {
+		out, err := c.run(ctx, c.tcPath, "-V")
+		if err != nil {
+			r.add("tc", CheckFail, err.Error(), distro.fix("tc", ""))
+		} else {
+			r.add("tc", CheckOK, fmt.Sprintf("%s, %s", path, iprouteVersion(string(out))), "")
+		}
+		out, err = c.tc(ctx, "-j", "qdisc", "show")
+		if err != nil || !json.Valid(out) {
+			r.add("tc-json", CheckWarn, "tc does not support json output (-j), falling back to parsing text output, which supports fewer options", distro.fix("tc-upgrade", ""))
+		} else {
+			r.add("tc-json", CheckOK, "tc supports json output (-j)", "")
+		}
+	}
+
+	// binaries which only some rules need
+	r.addOptionalBinary("nft", c.nftPath, "for fwmark rules with an nftables match, and cgroup rules", "install nftables, which provides nft")
+	r.addOptionalBinary("ipset", "ipset", "for rules with sets", "install ipset")
+
+	// kernel modules
+	loaded, err := loadedModules()
+	if err != nil {
+		r.add("modules", CheckWarn, fmt.Sprintf("cannot read /proc/modules: %s", err), "")
+	}
+	for _, m := range doctorModules {
+		name := "module-" + m.name
+		failStatus := CheckFail
+		if !m.required {
+			failStatus = CheckWarn
+		}
+		switch {
+		case loaded[m.name]:
+			r.add(name, CheckOK, m.name+" is loaded", "")
+		case isDir("/sys/module/" + m.name):
+			r.add(name, CheckOK, m.name+" is built into the kernel", "")
+		default:
+			_, err := c.run(ctx, "modprobe", "-n", m.name)
+			if errors.Is(err, exec.ErrNotFound) {
+				r.add(name, CheckWarn, fmt.Sprintf("%s is not loaded, and modprobe is not available to check if it can be loaded", m.name), "install kmod, which provides modprobe")
+			} else if err != nil {
+				r.add(name, failStatus, fmt.Sprintf("%s is not loaded and cannot be loaded: %s", m.name, err), distro.fix("module", m.name))
+			} else {
+				r.add(name, CheckOK, m.name+" is not loaded, but can be loaded with modprobe", "")
+			}
+		}
+	}
+
+	// capabilities
+	hasCap, err := hasNetAdmin()
+	switch {
+	case err != nil:
+		r.add("cap-net-admin", CheckWarn, fmt.Sprintf("cannot read capabilities: %s", err), "")
+	case !hasCap:
+		r.add("cap-net-admin", CheckFail, "CAP_NET_ADMIN is required to change qdiscs and filters", "run as root (sudo easytc ...), or in a container started with --cap-add NET_ADMIN")
+	default:
+		r.add("cap-net-admin", CheckOK, "CAP_NET_ADMIN is available", "")
+	}
+
+	// namespace
+	if c.namespace != "" {
+		if isFile("/run/netns/" + c.namespace) {
+			r.add("namespace", CheckOK, fmt.Sprintf("network namespace %s exists", c.namespace), "")
+		} else {
+			r.add("namespace", CheckFail, fmt.Sprintf("network namespace %s not found in /run/netns", c.namespace), fmt.Sprintf("create it with: ip netns add %s", c.namespace))
+		}
+	} else {
+		ns, err := os.Readlink("/proc/self/ns/net")
+		if err != nil {
+			ns = "unknown"
+		}
+		r.add("namespace", CheckOK, fmt.Sprintf("using the current network namespace (%s)", ns), "")
+	}
+
+	// root qdiscs which would be replaced
+	ifaces, err := c.ListIface(ctx)
+	if err != nil {
+		r.add("root-qdisc", CheckFail, fmt.Sprintf("cannot list interfaces: %s", err), "")
+		return r
+	}
+	qdiscs, err := c.ListQdisc(ctx)
+	if err != nil {
+		r.add("root-qdisc", CheckFail, fmt.Sprintf("cannot list qdiscs: %s", err), "")
+		return r
+	}
+	for _, iface := range ifaces {
+		name := "root-qdisc-" + iface
+		root := rootQdisc(qdiscs, iface)
+		switch {
+		case root == nil || root.Kind == nil:
+			r.add(name, CheckOK, "no root qdisc", "")
+		case isOwnRoot(root):
+			r.add(name, CheckOK, "easytc prio qdisc", "")
+		case isDefaultRoot(root):
+			r.add(name, CheckOK, fmt.Sprintf("kernel default %s qdisc, restored on reset", *root.Kind), "")
+		default:
+			r.add(name, CheckWarn, fmt.Sprintf("foreign root qdisc %s %s, easytc will not replace it unless adopted", *root.Kind, PtrToString(root.Handle)), fmt.Sprintf("review 'tc qdisc show dev %s'; use set --adopt to replace it, reset restores it", iface))
+		}
+	}
+	return r
+}
+
+// check a binary which only some rules need, a warning if it is missing
+func (r *Report) addOptionalBinary(name string, path string, neededFor string, fix string) {
+	found, err := exec.LookPath(path)
+	if err != nil {
+		r.add(name, CheckWarn, fmt.Sprintf("%s not found, it is needed %s", path, neededFor), fix)
+		return
+	}
+	r.add(name, CheckOK, found, "")
+}
+
+// root qdisc of an interface, if any
+func rootQdisc(qdiscs []*Qdisc, iface string) *Qdisc {
+	for _, q := range qdiscs {
+		if q.Dev != nil && *q.Dev == iface && q.Root != nil && *q.Root {
+			return q
+		}
+	}
+	return nil
+}
+
+// whether a root qdisc is the prio qdisc created by easytc
+func isOwnRoot(q *Qdisc) bool {
+	return q != nil && q.Kind != nil && *q.Kind == "prio" && PtrToString(q.Handle) == "1:" && q.Options != nil && q.Options.PrioBands != nil && *q.Options.PrioBands == prioBands
+}
+
+// version from the output of tc -V, for example "tc utility, iproute2-6.1.0, libbpf 1.1.0"
+func iprouteVersion(out string) string {
+	for _, item := range strings.Split(strings.TrimSpace(out), ",") {
+		item = strings.TrimSpace(item)
+		if strings.HasPrefix(item, "iproute2-") {
+			return item
+		}
+	}
+	return strings.TrimSpace(out)
+}
+
+// modules listed in /proc/modules
+func loadedModules() (map[string]bool, error) {
+	data, err := os.ReadFile("/proc/modules")
+	if err != nil {
+		return nil, err
+	}
+	mods := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 0 {
+			mods[fields[0]] = true
+		}
+	}
+	return mods, nil
+}
+
+// whether the effective capabilities of this process include CAP_NET_ADMIN
+func hasNetAdmin() (bool, error) {
+	data, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return false, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), "CapEff:")
+		if !ok {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		if err != nil {
+			return false, err
+		}
+		const capNetAdmin = 12
+		return caps&(1<<capNetAdmin) != 0, nil
+	}
+	return false, fmt.Errorf("CapEff not found in /proc/self/status")
+}
+
+func isDir(path string) bool {
+	st, err := os.Stat(path)
+	return err == nil && st.IsDir()
+}
+
+func isFile(path string) bool {
+	st, err := os.Stat(path)
+	return err == nil && !st.IsDir()
+}
+
+// linux distribution family, from /etc/os-release
+type distro struct {
+	name   string
+	family string
+}
+
+func osDistro() distro {
+	d := distro{name: "unknown"}
+	data, err := os.ReadFile("/etc/os-release")
+	if err != nil {
+		return d
+	}
+	ids := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(value, `"'`)
+		switch key {
+		case "ID":
+			d.name = value
+			ids = append([]string{value}, ids...)
+		case "ID_LIKE":
+			ids = append(ids, strings.Fields(value)...)
+		}
+	}
+	for _, id := range ids {
+		if _, ok := distroFixes[id]; ok {
+			d.family = id
+			break
+		}
+	}
+	return d
+}
+
+// install commands per distribution family, for the tc binary and for kernel modules, and the upgrade command for tc
+var distroFixes = map[string]struct {
+	tc        string
+	modules   string
+	tcUpgrade string
+}{
+	"debian": {"apt-get install iproute2", "apt-get install linux-image-$(uname -r)", "apt-get install --only-upgrade iproute2"},
+	"ubuntu": {"apt-get install iproute2", "apt-get install linux-modules-extra-$(uname -r)", "apt-get install --only-upgrade iproute2"},
+	"rhel":   {"yum install iproute-tc", "yum install kernel-modules-extra", "yum update iproute iproute-tc"},
+	"fedora": {"dnf install iproute-tc", "dnf install kernel-modules-extra", "dnf upgrade iproute iproute-tc"},
+	"suse":   {"zypper install iproute2", "zypper install kernel-default", "zypper update iproute2"},
+	"arch":   {"pacman -S iproute2", "pacman -S linux", "pacman -Syu iproute2"},
+	"alpine": {"apk add iproute2-tc", "apk add linux-lts", "apk upgrade iproute2-tc"},
+}
+
+// actionable fix for a missing tc binary ("tc"), a tc too old for json output ("tc-upgrade") or a kernel module ("module")
+func (d distro) fix(kind string, name string) string {
+	f, ok := distroFixes[d.family]
+	switch kind {
+	case "tc":
+		if !ok {
+			return "install iproute2, which provides tc"
+		}
+		return "install tc: " + f.tc
+	case "tc-upgrade":
+		if !ok {
+			return "upgrade iproute2 to a version whose tc supports json output"
+		}
+		return "upgrade tc: " + f.tcUpgrade
+	case "module":
+		load := fmt.Sprintf("modprobe %s; a reboot may be required if the kernel was upgraded since boot", name)
+		if !ok {
+			return fmt.Sprintf("install the kernel modules package which provides %s for the running kernel, then %s", name, load)
+		}
+		return fmt.Sprintf("%s, then %s", f.modules, load)
+	}
+	return ""
+}
+
+// actionable fix for ErrModuleMissing on this host
+func ModuleMissingFix() string {
+	return osDistro().fix("module", "sch_netem")
+}
@@ -0,0 +1,23 @@
+package tc
+
+import "testing"
+
+func TestDistroFix(t *testing.T) {
+	tests := []struct {
+		family string
+		kind   string
+		name   string
+		want   string
+	}{
+		{"debian", "tc", "", "install tc: apt-get install iproute2"},
+		{"debian", "tc-upgrade", "", "upgrade tc: apt-get install --only-upgrade iproute2"},
+		{"", "tc", "", "install iproute2, which provides tc"},
+		{"", "tc-upgrade", "", "upgrade iproute2 to a version whose tc supports json output"},
+		{"fedora", "module", "sch_netem", "dnf install kernel-modules-extra, then modprobe sch_netem; a reboot may be required if the kernel was upgraded since boot"},
+	}
+	for _, tt := range tests {
+		if got := (distro{family: tt.family}).fix(tt.kind, tt.name); got != tt.want {
+			t.Errorf("fix(%q, %q) for %q = %q, want %q", tt.kind, tt.name, tt.family, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package tc
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+)
+
+var (
+	// the sch_netem kernel module is not loaded and cannot be loaded
+	ErrModuleMissing = errors.New("kernel module sch_netem is not available")
+	// the interface does not exist
+	ErrInterfaceNotFound = errors.New("interface not found")
+	// tc or modprobe were denied; changing qdiscs requires CAP_NET_ADMIN
+	ErrPermissionDenied = errors.New("permission denied, CAP_NET_ADMIN is required")
+	// every prio band of the interface already has its own netem qdisc
+	ErrFlowIDsExhausted = errors.New("no free flow IDs left")
+	// no existing rule matches the given filter
+	ErrRuleNotFound = errors.New("rule not found")
+	// no ipset has the given name
+	ErrSetNotFound = errors.New("set not found")
+	// the rule clashes with an existing qdisc or filter, or a set which rules use is removed
+	ErrConflictingRule = errors.New("conflicting rule")
+	// the interface has a root qdisc which easytc did not create, and which it will not replace unless adopted
+	ErrForeignQdisc = errors.New("foreign root qdisc")
+	// another easytc process kept changing tc rules of the same network namespace for longer than the lock timeout
+	ErrLocked = errors.New("tc rules are locked by another easytc process")
+)
+
+// a command which failed to run, or exited with a non-zero exit code
+type CommandError struct {
+	Argv []string
+	// -1 if the command did not run, or was killed
+	ExitCode int
+	// output of the command; tc and modprobe print their errors to stderr
+	Stderr string
+	Err    error
+}
+
+func (e *CommandError) Error() string {
+	msg := strings.Join(e.Argv, " ") + ": " + e.Err.Error()
+	if out := strings.TrimSpace(e.Stderr); out != "" {
+		msg += ": " + out
+	}
+	return msg
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// classify the failure by the error messages of tc, ipset and modprobe, so that errors.Is works with the sentinel errors
+func (e *CommandError) Is(target error) bool {
+	switch target {
+	case ErrPermissionDenied:
+		return strings.Contains(e.Stderr, "Operation not permitted") || errors.Is(e.Err, fs.ErrPermission)
+	case ErrModuleMissing:
+		return strings.Contains(e.Stderr, "qdisc kind is unknown") || strings.Contains(e.Stderr, "Module sch_netem not found")
+	case ErrInterfaceNotFound:
+		return strings.Contains(e.Stderr, "Cannot find device")
+	case ErrSetNotFound:
+		return strings.Contains(e.Stderr, "The set with the given name does not exist") || strings.Contains(e.Stderr, "unknown set name")
+	case ErrConflictingRule:
+		return strings.Contains(e.Stderr, "File exists") || strings.Contains(e.Stderr, "in use by a kernel component")
+	}
+	return false
+}
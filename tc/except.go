@@ -0,0 +1,277 @@
+package tc
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+)
+
+// pass-through filters send the traffic they match to the default band of the root qdisc, which has no netem qdisc,
+// before the filters of the rules are tried
+const passFlow = "1:3"
+
+// exclude the traffic of other rules' filters from being impaired, on every interface the client changes, or on the interface
+// of the filter if it is set; the filters are added when a rule is set, and removed by Reset
+func WithProtected(filters ...*Rule) Option {
+	return func(c *Client) {
+		c.protected = append(c.protected, filters...)
+	}
+}
+
+// check an exception of a rule: it needs its own filter fields, and must narrow the filter of the rule
+func (r *Rule) checkExcept(e *ValidationError) {
+	if (r.FwMark != nil || r.Cgroup != nil || r.hasSet()) && len(r.Except) > 0 {
+		e.add("Except", "cannot be combined with FwMark, Cgroup, SourceSet or DestinationSet, exceptions are u32 filters which cannot match them")
+	}
+	for _, x := range r.Except {
+		if x == nil {
+			continue
+		}
+		xe := x.check()
+		for _, f := range xe.Fields {
+			e.add("Except", "%s", f.Error())
+		}
+		if x.AllTraffic || !x.hasMatch() {
+			e.add("Except", "at least one filter must be provided from: %s", filterFieldNames)
+		}
+		if x.FwMark != nil || x.NftMatch != nil || x.Cgroup != nil || x.hasSet() {
+			e.add("Except", "FwMark, NftMatch, Cgroup, SourceSet and DestinationSet cannot be used, exceptions are u32 filters")
+		}
+		if x.Latency != nil || x.Rate != nil || x.PacketLoss != nil || x.Corrupt != nil || x.Distribution != nil || x.Name != nil || x.Labels != nil || x.Except != nil || x.Priority != nil {
+			e.add("Except", "only filter fields can be set")
+		}
+		if !covers(r, r.exceptFilter(x)) {
+			e.add("Except", "the traffic of an exception must be within the filter of the rule")
+		}
+	}
+}
+
+func withinPrefix(p *netip.Prefix, of *netip.Prefix) bool {
+	if p == nil || of == nil {
+		return true
+	}
+	return p.Bits() >= of.Bits() && of.Contains(p.Addr())
+}
+
+func withinPorts(p *PortRange, of *PortRange) bool {
+	if p == nil || of == nil {
+		return true
+	}
+	return p.First >= of.First && p.Last <= of.Last
+}
+
+// the pass-through filter of an exception of r: the filter of r, narrowed by the filter fields of the exception
+func (r *Rule) exceptFilter(x *Rule) *Rule {
+	f := &Rule{
+		Iface:           r.Iface,
+		SourceIP:        r.SourceIP,
+		SourcePort:      r.SourcePort,
+		DestinationIP:   r.DestinationIP,
+		DestinationPort: r.DestinationPort,
+		DSCP:            r.DSCP,
+		TOS:             r.TOS,
+		Length:          r.Length,
+		TCPFlags:        r.TCPFlags,
+		Protocol:        r.Protocol,
+		PassThrough:     true,
+		FlowID:          Ptr(passFlow),
+	}
+	if x.SourceIP != nil {
+		f.SourceIP = x.SourceIP
+	}
+	if x.SourcePort != nil {
+		f.SourcePort = x.SourcePort
+	}
+	if x.DestinationIP != nil {
+		f.DestinationIP = x.DestinationIP
+	}
+	if x.DestinationPort != nil {
+		f.DestinationPort = x.DestinationPort
+	}
+	if x.DSCP != nil {
+		f.DSCP = x.DSCP
+	}
+	if x.TOS != nil {
+		f.TOS = x.TOS
+	}
+	if x.Length != nil {
+		f.Length = x.Length
+	}
+	if x.TCPFlags != nil {
+		f.TCPFlags = x.TCPFlags
+	}
+	if x.Protocol != nil {
+		f.Protocol = x.Protocol
+	}
+	return f
+}
+
+// the exceptions of a rule on its interface, as pass-through rules
+func exceptionsOf(rules *Rules, rule *Rule) []*Rule {
+	found := []*Rule{}
+	if rule.ID == nil {
+		return found
+	}
+	for _, other := range rules.Rules {
+		if other.PassThrough && other.Iface != nil && *other.Iface == *rule.Iface && equalPtr(other.ExceptionOf, rule.ID) {
+			found = append(found, other)
+		}
+	}
+	return found
+}
+
+// the pass-through filters of exceptions are tried before the filters of all rules, so that an exception also exempts the traffic of
+// other rules which are tried before its own: refuse a rule whose exceptions, or the one given or kept, overlap the filter of such a
+// rule, or whose filter is tried before a rule with an exception it overlaps. As for conflicts, whether u32 filters overlap fw filters
+// and sets is not known
+func checkExceptOverlaps(rules *Rules, r *Rule, existing *Rule) error {
+	if r.FwMark != nil || r.Cgroup != nil || r.hasSet() {
+		return nil
+	}
+	p := placedFilter(r, existing)
+	exceptions := []*Rule{}
+	for _, x := range r.Except {
+		exceptions = append(exceptions, r.exceptFilter(x))
+	}
+	if r.Except == nil && existing != nil {
+		exceptions = exceptionsOf(rules, existing)
+	}
+	for _, other := range rules.Rules {
+		if other == existing || other.Iface == nil || *other.Iface != *r.Iface || other.FilterHandle == nil || other.PassThrough ||
+			other.FwMark != nil || other.hasSet() {
+			continue
+		}
+		if triedBefore(other, p) {
+			for _, x := range exceptions {
+				if overlaps(x, other) {
+					return fmt.Errorf("%w: an exception of the rule would also exempt traffic of rule %s on interface %s, which is tried before the rule",
+						ErrConflictingRule, PtrToString(other.ID), *r.Iface)
+				}
+			}
+			continue
+		}
+		for _, x := range exceptionsOf(rules, other) {
+			if overlaps(x, p) {
+				return fmt.Errorf("%w: an exception of rule %s on interface %s would also exempt traffic of the rule, which is tried before it",
+					ErrConflictingRule, PtrToString(other.ID), *r.Iface)
+			}
+		}
+	}
+	return nil
+}
+
+// replace the exceptions of a rule which was set on its interface by the ones of r, unless r gives none
+func (c *Client) setExceptions(ctx context.Context, r *Rule, rules *Rules) error {
+	if r.Except == nil {
+		return nil
+	}
+	want := []*Rule{}
+	for _, x := range r.Except {
+		want = append(want, r.exceptFilter(x))
+	}
+	have := exceptionsOf(rules, r)
+	for _, old := range have {
+		if containsFilter(want, old) {
+			continue
+		}
+		err := c.deletePass(ctx, old)
+		if err != nil {
+			return err
+		}
+	}
+	for _, f := range want {
+		// a protected filter passes the traffic already
+		if containsFilter(have, f) || containsFilter(protectedOn(rules, *r.Iface), f) {
+			continue
+		}
+		err := c.addPass(ctx, f, rules, &ruleMeta{Owner: PtrToString(r.ID)})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func containsFilter(rules []*Rule, r *Rule) bool {
+	for _, rule := range rules {
+		if sameFilter(rule, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// delete the exceptions of a deleted rule
+func (c *Client) dropExceptions(ctx context.Context, rules *Rules, rule *Rule) error {
+	for _, x := range exceptionsOf(rules, rule) {
+		err := c.deletePass(ctx, x)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add the protected filters of the client to an interface, unless they are there already
+func (c *Client) ensureProtected(ctx context.Context, iface string, rules *Rules) error {
+	for _, p := range c.protected {
+		if p.Iface != nil && *p.Iface != iface {
+			continue
+		}
+		f := (&Rule{Iface: &iface}).exceptFilter(p)
+		if containsFilter(protectedOn(rules, iface), f) {
+			continue
+		}
+		err := c.addPass(ctx, f, rules, &ruleMeta{Protected: true})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func protectedOn(rules *Rules, iface string) []*Rule {
+	found := []*Rule{}
+	for _, rule := range rules.Rules {
+		if rule.PassThrough && rule.Protected && *rule.Iface == iface {
+			found = append(found, rule)
+		}
+	}
+	return found
+}
+
+// check the protected filters of the client
+func (c *Client) validateProtected() error {
+	e := &ValidationError{}
+	(&Rule{Except: c.protected}).checkExcept(e)
+	return e.errOrNil()
+}
+
+// add a pass-through filter, and record whose it is
+func (c *Client) addPass(ctx context.Context, f *Rule, rules *Rules, meta *ruleMeta) error {
+	params := append(filterArgs("add", *f.Iface, f, nil), matchArgs(f)...)
+	err := c.tcExec(ctx, append(params, "flowid", passFlow)...)
+	if err != nil {
+		return err
+	}
+	// a dry run added no filter to look up
+	if c.recorder() != nil {
+		return nil
+	}
+	fh, err := c.addedFilterHandle(ctx, f, rules)
+	if err != nil {
+		return err
+	}
+	meta.Match = matchKey(f)
+	return c.changeMeta(*f.Iface, fh, func(*ruleMeta) *ruleMeta {
+		return meta
+	})
+}
+
+func (c *Client) deletePass(ctx context.Context, f *Rule) error {
+	err := c.tcExec(ctx, filterArgs("del", *f.Iface, f, f.FilterHandle)...)
+	if err != nil {
+		return err
+	}
+	return c.dropMeta(*f.Iface, *f.FilterHandle)
+}
@@ -0,0 +1,420 @@
+package tc
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// a filter expression in the syntax of tcpdump, such as "dst net 10.0.0.0/8 and (tcp dst port 443 or udp dst port 53) and not host 10.0.0.1";
+// it is compiled into one u32 filter for each branch of its disjunctive normal form, the negated primitives of a branch becoming its exceptions
+type MatchExpr struct {
+	text string
+	root *exprNode
+}
+
+// a node of a filter expression: an operator on its arguments, or a primitive, which matches one filter field
+type exprNode struct {
+	// "and", "or", "not", or empty for a primitive
+	op   string
+	args []*exprNode
+	prim *Rule
+}
+
+// each branch of an expression is a filter of its own, with exceptions; more would rather be a mistake
+const maxMatchBranches = 64
+
+// the operators may also be written as in C
+var exprTokenReplacer = strings.NewReplacer("(", " ( ", ")", " ) ", "&&", " and ", "||", " or ", "!", " not ")
+
+// parse a filter expression of primitives combined with and, or, not and parentheses. The primitives are
+// [src|dst] host ADDR, [src|dst] net PREFIX, [tcp|udp|sctp] [src|dst] port N, [tcp|udp|sctp] [src|dst] portrange N-M,
+// a protocol name such as tcp, udp or icmp, and ip proto N; without src or dst, either matches
+func ParseMatch(s string) (*MatchExpr, error) {
+	p := &exprParser{tokens: strings.Fields(strings.ToLower(exprTokenReplacer.Replace(s)))}
+	if len(p.tokens) == 0 {
+		return nil, errors.New("empty match expression")
+	}
+	root, err := p.or()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %s", p.describe())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid match expression %q: %w", s, err)
+	}
+	return &MatchExpr{text: s, root: root}, nil
+}
+
+func (m *MatchExpr) String() string {
+	return m.text
+}
+
+type exprParser struct {
+	tokens []string
+	pos    int
+}
+
+// the next token, or empty at the end
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+// the next token, for error messages
+func (p *exprParser) describe() string {
+	if t := p.peek(); t != "" {
+		return strconv.Quote(t)
+	}
+	return "end of expression"
+}
+
+// and binds tighter than or
+func (p *exprParser) or() (*exprNode, error) {
+	return p.binary("or", p.and)
+}
+
+func (p *exprParser) and() (*exprNode, error) {
+	return p.binary("and", p.unary)
+}
+
+func (p *exprParser) binary(op string, operand func() (*exprNode, error)) (*exprNode, error) {
+	n, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	args := []*exprNode{n}
+	for p.peek() == op {
+		p.next()
+		n, err = operand()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, n)
+	}
+	if len(args) == 1 {
+		return n, nil
+	}
+	return &exprNode{op: op, args: args}, nil
+}
+
+func (p *exprParser) unary() (*exprNode, error) {
+	switch p.peek() {
+	case "not":
+		p.next()
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprNode{op: "not", args: []*exprNode{n}}, nil
+	case "(":
+		p.next()
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("expected ')' instead of %s", p.describe())
+		}
+		p.next()
+		return n, nil
+	}
+	return p.primitive()
+}
+
+func (p *exprParser) primitive() (*exprNode, error) {
+	t := p.peek()
+	if v, ok := protocolNames[t]; ok {
+		p.next()
+		proto := &exprNode{prim: &Rule{Protocol: Ptr(v)}}
+		switch p.peek() {
+		case "src", "dst", "port", "portrange":
+		default:
+			return proto, nil
+		}
+		if t != "tcp" && t != "udp" && t != "sctp" {
+			return nil, fmt.Errorf("%s has no ports", t)
+		}
+		n, kind, err := p.directed()
+		if err != nil {
+			return nil, err
+		}
+		if kind != "port" && kind != "portrange" {
+			return nil, fmt.Errorf("%s must be followed by port or portrange, not %s", t, kind)
+		}
+		return &exprNode{op: "and", args: []*exprNode{proto, n}}, nil
+	}
+	if t == "ip" {
+		p.next()
+		if p.next() != "proto" {
+			return nil, errors.New("ip must be followed by proto")
+		}
+		v, err := ParseProtocol(p.peek())
+		if err != nil {
+			return nil, err
+		}
+		p.next()
+		return &exprNode{prim: &Rule{Protocol: Ptr(v)}}, nil
+	}
+	n, _, err := p.directed()
+	return n, err
+}
+
+// a host, net, port or portrange primitive, with its direction if any; it matches either direction without one
+func (p *exprParser) directed() (*exprNode, string, error) {
+	dir := ""
+	if t := p.peek(); t == "src" || t == "dst" {
+		dir = p.next()
+	}
+	kind := p.peek()
+	switch kind {
+	case "host", "net", "port", "portrange":
+		p.next()
+	default:
+		return nil, "", fmt.Errorf("expected host, net, port or portrange instead of %s", p.describe())
+	}
+	value := p.peek()
+	src, dst := &Rule{}, &Rule{}
+	switch kind {
+	case "host":
+		a, err := netip.ParseAddr(value)
+		if err != nil || !a.Is4() {
+			return nil, "", fmt.Errorf("host must be followed by an IPv4 address instead of %s", p.describe())
+		}
+		prefix := netip.PrefixFrom(a, 32)
+		src.SourceIP, dst.DestinationIP = &prefix, &prefix
+	case "net":
+		prefix, err := ParsePrefix(value)
+		switch {
+		case err != nil || !prefix.Addr().Is4():
+			return nil, "", fmt.Errorf("net must be followed by an IPv4 network instead of %s", p.describe())
+		case prefix.Masked() != prefix:
+			return nil, "", fmt.Errorf("%s has host bits set, did you mean %s", prefix, prefix.Masked())
+		}
+		src.SourceIP, dst.DestinationIP = &prefix, &prefix
+	default:
+		ports, err := ParsePortRange(value)
+		if err != nil || (kind == "port" && ports.First != ports.Last) {
+			what := "a port"
+			if kind == "portrange" {
+				what = "a port range"
+			}
+			return nil, "", fmt.Errorf("%s must be followed by %s instead of %s", kind, what, p.describe())
+		}
+		src.SourcePort, dst.DestinationPort = &ports, &ports
+	}
+	p.next()
+	switch dir {
+	case "src":
+		return &exprNode{prim: src}, kind, nil
+	case "dst":
+		return &exprNode{prim: dst}, kind, nil
+	}
+	return &exprNode{op: "or", args: []*exprNode{{prim: src}, {prim: dst}}}, kind, nil
+}
+
+// a primitive of a branch, or its negation
+type exprLiteral struct {
+	prim *Rule
+	not  bool
+}
+
+// the branches of the disjunctive normal form of a node, or of its negation; each branch is a conjunction of literals
+func (n *exprNode) branches(not bool) ([][]exprLiteral, error) {
+	switch {
+	case n.prim != nil:
+		return [][]exprLiteral{{{prim: n.prim, not: not}}}, nil
+	case n.op == "not":
+		return n.args[0].branches(!not)
+	}
+	// the negation of an and is the or of the negations, and the other way round
+	or := (n.op == "or") != not
+	result := [][]exprLiteral{{}}
+	if or {
+		result = nil
+	}
+	for _, arg := range n.args {
+		b, err := arg.branches(not)
+		if err != nil {
+			return nil, err
+		}
+		if or {
+			result = append(result, b...)
+		} else {
+			product := [][]exprLiteral{}
+			for _, x := range result {
+				for _, y := range b {
+					product = append(product, append(slices.Clone(x), y...))
+				}
+			}
+			result = product
+		}
+		if len(result) > maxMatchBranches {
+			return nil, fmt.Errorf("the expression has more than %d branches", maxMatchBranches)
+		}
+	}
+	return result, nil
+}
+
+// the filter of a branch, with an exception for each negated primitive which excludes some of its traffic; false if it matches no traffic
+func branchFilter(lits []exprLiteral) (*Rule, bool) {
+	f := &Rule{}
+	for _, l := range lits {
+		if !l.not && !narrow(f, l.prim) {
+			return nil, false
+		}
+	}
+	for _, l := range lits {
+		if !l.not || !overlaps(f, l.prim) {
+			continue
+		}
+		if covers(l.prim, f) {
+			return nil, false
+		}
+		if !containsFilter(f.Except, l.prim) {
+			f.Except = append(f.Except, l.prim.Filter())
+		}
+	}
+	f.AllTraffic = !f.hasMatch()
+	return f, true
+}
+
+// narrow the filter of r to the traffic it has in common with the filter fields of prim; false if there is none.
+// Prefixes, and the port ranges u32 can match, are either nested or disjoint
+func narrow(r *Rule, prim *Rule) bool {
+	if !overlaps(r, prim) {
+		return false
+	}
+	narrowPrefix := func(a **netip.Prefix, b *netip.Prefix) {
+		if *a == nil || (b != nil && b.Bits() > (*a).Bits()) {
+			*a = b
+		}
+	}
+	narrowPorts := func(a **PortRange, b *PortRange) {
+		if *a == nil {
+			*a = b
+		} else if b != nil {
+			*a = &PortRange{First: max((*a).First, b.First), Last: min((*a).Last, b.Last)}
+		}
+	}
+	narrowPrefix(&r.SourceIP, prim.SourceIP)
+	narrowPrefix(&r.DestinationIP, prim.DestinationIP)
+	narrowPorts(&r.SourcePort, prim.SourcePort)
+	narrowPorts(&r.DestinationPort, prim.DestinationPort)
+	if prim.Protocol != nil {
+		r.Protocol = prim.Protocol
+	}
+	return true
+}
+
+// the rules of the expression: a copy of r for each branch, with the filter of the branch, and its exceptions added to those of r.
+// r must have no filter fields, and no name if there are several branches, as a name stands for one filter. Branches which match
+// no traffic are left out; as the pass-through filters of exceptions apply to all rules of an interface, the exceptions of a branch
+// must not exempt the traffic of another
+func (m *MatchExpr) Rules(r *Rule) ([]*Rule, error) {
+	e := &ValidationError{}
+	if r.hasFilter() {
+		e.add("", "%s cannot be combined with a match expression", filterFieldNames)
+		return nil, e
+	}
+	branches, err := m.root.branches(false)
+	if err != nil {
+		e.add("", "%q: %s", m.text, err)
+		return nil, e
+	}
+	filters := []*Rule{}
+	for _, lits := range branches {
+		f, ok := branchFilter(lits)
+		if !ok {
+			continue
+		}
+		i := slices.IndexFunc(filters, func(g *Rule) bool { return sameFilter(f, g) })
+		if i < 0 {
+			filters = append(filters, f)
+			continue
+		}
+		// the union of two branches with the same filter excludes only what both exclude
+		switch {
+		case subsetOf(f.Except, filters[i].Except):
+			filters[i] = f
+		case !subsetOf(filters[i].Except, f.Except):
+			e.add("", "%q has branches with the same filter and different exceptions, which cannot be expressed as filters", m.text)
+			return nil, e
+		}
+	}
+	if len(filters) == 0 {
+		e.add("", "%q matches no traffic", m.text)
+		return nil, e
+	}
+	for _, f := range filters {
+		for _, x := range f.Except {
+			for _, g := range filters {
+				if g != f && overlaps(f.exceptFilter(x), g) {
+					e.add("", "%q cannot be expressed as filters, an exception of one branch would also exempt traffic of another", m.text)
+					return nil, e
+				}
+			}
+		}
+	}
+	if r.Name != nil && len(filters) > 1 {
+		e.add("Name", "cannot be set for a match expression with %d branches, a name stands for one filter", len(filters))
+		return nil, e
+	}
+	rules := []*Rule{}
+	for _, f := range filters {
+		rule := *r
+		rule.SourceIP, rule.DestinationIP, rule.SourcePort, rule.DestinationPort = f.SourceIP, f.DestinationIP, f.SourcePort, f.DestinationPort
+		rule.Protocol, rule.AllTraffic = f.Protocol, f.AllTraffic
+		rule.Except = append(slices.Clone(f.Except), r.Except...)
+		rules = append(rules, &rule)
+	}
+	return rules, nil
+}
+
+// whether all filters of a are in b
+func subsetOf(a []*Rule, b []*Rule) bool {
+	for _, x := range a {
+		if !containsFilter(b, x) {
+			return false
+		}
+	}
+	return true
+}
+
+// whether the filter of a rule matches the expression: a primitive is true if the rule only matches traffic of the primitive.
+// The exceptions of the rule are not taken into account
+func (m *MatchExpr) Matches(rule *Rule) bool {
+	return m.root.eval(rule)
+}
+
+func (n *exprNode) eval(rule *Rule) bool {
+	switch n.op {
+	case "not":
+		return !n.args[0].eval(rule)
+	case "and":
+		for _, arg := range n.args {
+			if !arg.eval(rule) {
+				return false
+			}
+		}
+		return true
+	case "or":
+		for _, arg := range n.args {
+			if arg.eval(rule) {
+				return true
+			}
+		}
+		return false
+	}
+	return covers(n.prim, rule)
+}
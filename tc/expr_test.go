@@ -0,0 +1,279 @@
+package tc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the filter of a rule and its exceptions, in a form easy to compare
+func filterString(r *Rule) string {
+	s := []string{}
+	if r.SourceIP != nil {
+		s = append(s, "src "+r.SourceIP.String())
+	}
+	if r.DestinationIP != nil {
+		s = append(s, "dst "+r.DestinationIP.String())
+	}
+	if r.SourcePort != nil {
+		s = append(s, "sport "+r.SourcePort.String())
+	}
+	if r.DestinationPort != nil {
+		s = append(s, "dport "+r.DestinationPort.String())
+	}
+	if r.Protocol != nil {
+		s = append(s, fmt.Sprintf("proto %d", *r.Protocol))
+	}
+	if r.AllTraffic {
+		s = append(s, "all")
+	}
+	if len(r.Except) > 0 {
+		x := []string{}
+		for _, e := range r.Except {
+			x = append(x, filterString(e))
+		}
+		s = append(s, "except ("+strings.Join(x, "; ")+")")
+	}
+	return strings.Join(s, " ")
+}
+
+// the filters of the rules of an expression, one per line
+func matchRules(t *testing.T, expr string, r *Rule) (string, error) {
+	t.Helper()
+	m, err := ParseMatch(expr)
+	if err != nil {
+		t.Fatalf("ParseMatch(%q): %v", expr, err)
+	}
+	rules, err := m.Rules(r)
+	if err != nil {
+		return "", err
+	}
+	s := []string{}
+	for _, rule := range rules {
+		s = append(s, filterString(rule))
+	}
+	return strings.Join(s, "\n"), nil
+}
+
+func TestMatchRules(t *testing.T) {
+	tests := []struct {
+		expr string
+		want []string
+	}{
+		// and binds tighter than or
+		{"host 10.0.0.1 or tcp and dst port 80", []string{
+			"src 10.0.0.1/32",
+			"dst 10.0.0.1/32",
+			"dport 80 proto 6",
+		}},
+		{"(host 10.0.0.1 or tcp) and dst port 80", []string{
+			"src 10.0.0.1/32 dport 80",
+			"dst 10.0.0.1/32 dport 80",
+			"dport 80 proto 6",
+		}},
+		{"src net 10.0.0.0/8 && (udp dst port 53 || tcp dst port 443)", []string{
+			"src 10.0.0.0/8 dport 53 proto 17",
+			"src 10.0.0.0/8 dport 443 proto 6",
+		}},
+		// the narrower of nested prefixes and the common part of port ranges
+		{"dst net 10.0.0.0/8 and dst host 10.1.2.3 and dst portrange 1000-1999 and dst portrange 1024-2047", []string{
+			"dst 10.1.2.3/32 dport 1024-1999",
+		}},
+		{"ip proto 47", []string{"proto 47"}},
+		{"not not tcp", []string{"proto 6"}},
+		// negations are pushed down to the primitives, which become exceptions
+		{"dst net 10.0.0.0/8 and not (src host 10.0.0.1 or dst port 22)", []string{
+			"dst 10.0.0.0/8 except (src 10.0.0.1/32; dport 22)",
+		}},
+		{"!(src port 22 || dst port 22)", []string{
+			"all except (sport 22; dport 22)",
+		}},
+		{"not (not tcp or not dst port 443)", []string{
+			"dport 443 proto 6",
+		}},
+		// exceptions which match none of the traffic of the branch are dropped
+		{"dst net 10.0.0.0/8 and not dst net 192.168.0.0/16", []string{
+			"dst 10.0.0.0/8",
+		}},
+		// branches which match no traffic are left out, and duplicates merged
+		{"tcp and udp or icmp", []string{"proto 1"}},
+		{"tcp or tcp", []string{"proto 6"}},
+		{"tcp or (tcp and not dst port 22)", []string{"proto 6"}},
+		{"(tcp and not dst port 22) or tcp", []string{"proto 6"}},
+	}
+	for _, tt := range tests {
+		got, err := matchRules(t, tt.expr, &Rule{Latency: Ptr(time.Millisecond)})
+		if want := strings.Join(tt.want, "\n"); err != nil || got != want {
+			t.Errorf("%q: got\n%s\nerror %v, want\n%s", tt.expr, got, err, want)
+		}
+	}
+}
+
+func TestMatchRulesKeepRule(t *testing.T) {
+	except := &Rule{DestinationPort: Ptr(Port(22))}
+	m, err := ParseMatch("src host 10.0.0.1 or src host 10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := m.Rules(&Rule{Iface: Ptr("eth0"), Latency: Ptr(time.Millisecond), Except: []*Rule{except}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("got %d rules, want 2", len(rules))
+	}
+	for _, r := range rules {
+		if *r.Iface != "eth0" || *r.Latency != time.Millisecond || len(r.Except) != 1 || r.Except[0] != except {
+			t.Errorf("%s: the interface, actions and exceptions of the rule are not kept", filterString(r))
+		}
+	}
+}
+
+func TestMatchRulesErrors(t *testing.T) {
+	hosts := []string{}
+	ports := []string{}
+	for i := 1; i <= 8; i++ {
+		hosts = append(hosts, fmt.Sprintf("src host 10.0.0.%d", i))
+		ports = append(ports, fmt.Sprintf("dst port %d", i))
+	}
+	branches64 := "(" + strings.Join(hosts, " or ") + ") and (" + strings.Join(ports, " or ") + ")"
+	if got, err := matchRules(t, branches64, &Rule{Latency: Ptr(time.Millisecond)}); err != nil || strings.Count(got, "\n") != 63 {
+		t.Errorf("64 branches: got %d rules, error %v", strings.Count(got, "\n")+1, err)
+	}
+
+	tests := []struct {
+		expr string
+		rule *Rule
+		want string
+	}{
+		{branches64 + " or tcp", nil, "more than 64 branches"},
+		{"(port 1 or port 2) and (port 3 or port 4) and (port 5 or port 6) and (port 7 or port 8)", nil, "more than 64 branches"},
+		{"tcp and udp", nil, "matches no traffic"},
+		{"tcp and not tcp", nil, "matches no traffic"},
+		{"dst net 10.1.0.0/16 and not dst net 10.0.0.0/8", nil, "matches no traffic"},
+		// the pass-through filter of the exception would exempt tcp port 22 from the first branch
+		{"tcp or (dst net 10.0.0.0/8 and not dst port 22)", nil, "an exception of one branch would also exempt traffic of another"},
+		{"not tcp or not dst port 22", nil, "same filter and different exceptions"},
+		{"host 10.0.0.1", &Rule{Name: Ptr("web")}, "a name stands for one filter"},
+		{"tcp", &Rule{DestinationPort: Ptr(Port(80))}, "cannot be combined with a match expression"},
+	}
+	for _, tt := range tests {
+		r := tt.rule
+		if r == nil {
+			r = &Rule{}
+		}
+		r.Latency = Ptr(time.Millisecond)
+		if got, err := matchRules(t, tt.expr, r); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got\n%s\nerror %v, want an error containing %q", tt.expr, got, err, tt.want)
+		}
+	}
+	// a name is fine for a single branch
+	if _, err := matchRules(t, "dst host 10.0.0.1", &Rule{Name: Ptr("web"), Latency: Ptr(time.Millisecond)}); err != nil {
+		t.Errorf("single branch with a name: %v", err)
+	}
+}
+
+func TestParseMatchErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"", "empty match expression"},
+		{"tcp and", "instead of end of expression"},
+		{"(tcp or udp", "expected ')'"},
+		{"tcp)", `unexpected ")"`},
+		{"icmp port 1", "icmp has no ports"},
+		{"tcp src host 10.0.0.1", "must be followed by port or portrange"},
+		{"host 10.0.0", "host must be followed by an IPv4 address"},
+		{"host ::1", "host must be followed by an IPv4 address"},
+		{"net 10.0.0.1/8", "did you mean 10.0.0.0/8"},
+		{"port 1-2", "port must be followed by a port"},
+		{"portrange x", "portrange must be followed by a port range"},
+		{"ip 6", "ip must be followed by proto"},
+		{"src tcp", "expected host, net, port or portrange"},
+	}
+	for _, tt := range tests {
+		if _, err := ParseMatch(tt.expr); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("ParseMatch(%q) = %v, want an error containing %q", tt.expr, err, tt.want)
+		}
+	}
+}
+
+func TestMatchExprMatches(t *testing.T) {
+	web := &Rule{DestinationIP: Ptr(netip.MustParsePrefix("10.1.0.0/16")), DestinationPort: Ptr(Port(443)), Protocol: Ptr(uint8(protocolTCP))}
+	all := &Rule{AllTraffic: true}
+	tests := []struct {
+		expr string
+		rule *Rule
+		want bool
+	}{
+		{"dst net 10.0.0.0/8", web, true},
+		{"net 10.0.0.0/8", web, true},
+		{"dst net 10.1.2.0/24", web, false},
+		{"src net 10.0.0.0/8", web, false},
+		{"tcp and dst port 443", web, true},
+		{"port 443", web, true},
+		{"src port 443", web, false},
+		{"udp", web, false},
+		{"not udp", web, true},
+		{"udp or dst port 443", web, true},
+		{"tcp and not dst port 443", web, false},
+		// a rule on all traffic is not only tcp
+		{"tcp", all, false},
+		{"not tcp", all, true},
+	}
+	for _, tt := range tests {
+		m, err := ParseMatch(tt.expr)
+		if err != nil {
+			t.Fatalf("ParseMatch(%q): %v", tt.expr, err)
+		}
+		if got := m.Matches(tt.rule); got != tt.want {
+			t.Errorf("%q matches %s = %v, want %v", tt.expr, filterString(tt.rule), got, tt.want)
+		}
+	}
+}
+
+// the exceptions of negated branches are checked against the other rules of the interface like the exceptions of any rule
+func TestMatchRulesExceptionOverlaps(t *testing.T) {
+	c, f, iface := newFakeClient(t)
+	ctx := context.Background()
+	err := c.Set(ctx, &Rule{Iface: Ptr(iface), DestinationPort: Ptr(Port(22)), Latency: Ptr(time.Millisecond)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := f.filterLines(iface)
+	m, err := ParseMatch("dst net 192.168.0.0/16 or dst net 10.0.0.0/8 and not dst port 22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := m.Rules(&Rule{Iface: Ptr(iface), Priority: Ptr(200), Latency: Ptr(time.Millisecond)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := c.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+	for _, r := range rules {
+		err = tx.Set(ctx, r)
+		if err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, ErrConflictingRule) {
+		t.Fatalf("got error %v, want %v", err, ErrConflictingRule)
+	}
+	err = tx.Rollback(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := f.filterLines(iface); !slices.Equal(got, before) {
+		t.Errorf("filters after rollback:\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(before, "\n"))
+	}
+}
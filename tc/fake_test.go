@@ -0,0 +1,636 @@
+package tc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// a Runner which keeps the qdiscs, filters and nftables rules of the interfaces in memory, answering tc and nft as they would,
+// so that the changes of a client can be tested without touching the host
+type fakeRunner struct {
+	devs    []string
+	qdiscs  []*Qdisc
+	filters map[string][]*fakeFilter
+	// the hash table of each priority of an interface, and the next handle in it
+	hts    map[string]int
+	htNext map[int]int
+	// the rules of the chains of the easytc table, nil without the table
+	nft     map[string][]fakeNftRule
+	nftNext int
+	// a command which contains fail fails, as if tc or nft rejected it
+	fail     string
+	commands []string
+}
+
+type fakeFilter struct {
+	pref   int
+	kind   string
+	proto  string
+	fh     string
+	flowid string
+	ht     int
+	mask   uint32
+	keys   []fakeKey
+}
+
+type fakeKey struct {
+	value uint32
+	mask  uint32
+	off   int
+}
+
+type fakeNftRule struct {
+	handle int
+	rule   string
+}
+
+// the interfaces of the host but lo, which ListIface lists; skips the test if there are none
+func hostIfaces(t *testing.T) []string {
+	t.Helper()
+	l, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ifaces := []string{}
+	for _, i := range l {
+		if i.Name != "lo" {
+			ifaces = append(ifaces, i.Name)
+		}
+	}
+	if len(ifaces) == 0 {
+		t.Skip("no network interface but lo")
+	}
+	return ifaces
+}
+
+// a client of the interfaces of the host, whose commands are run by a fake runner
+func newFakeClient(t *testing.T) (*Client, *fakeRunner, string) {
+	t.Helper()
+	f := &fakeRunner{devs: hostIfaces(t), filters: map[string][]*fakeFilter{}, hts: map[string]int{}, htNext: map[int]int{}}
+	for _, dev := range f.devs {
+		f.qdiscs = append(f.qdiscs, &Qdisc{Kind: Ptr("noqueue"), Handle: Ptr("0:"), Dev: Ptr(dev), Root: Ptr(true), Options: &QdiscOptions{}})
+	}
+	return New(WithRunner(f), WithStateDir(t.TempDir())), f, f.devs[0]
+}
+
+func fakeFailure(format string, a ...any) ([]byte, error) {
+	return []byte(fmt.Sprintf(format, a...) + "\n"), errors.New("exit status 2")
+}
+
+func (f *fakeRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	line := strings.Join(append([]string{name}, args...), " ")
+	f.commands = append(f.commands, line)
+	if f.fail != "" && strings.Contains(line, f.fail) {
+		return fakeFailure("RTNETLINK answers: Invalid argument")
+	}
+	switch name {
+	case "tc":
+		return f.tc(args)
+	case "nft":
+		return f.nftRun(args)
+	case "lsmod":
+		return []byte("Module                  Size  Used by\nsch_netem              20480  0\n"), nil
+	case "modprobe":
+		return nil, nil
+	}
+	return fakeFailure("%s: command not found", name)
+}
+
+// the value after key in args, or "" without one
+func argAfter(args []string, key string) string {
+	i := slices.Index(args, key)
+	if i < 0 || i+1 >= len(args) {
+		return ""
+	}
+	return args[i+1]
+}
+
+func (f *fakeRunner) tc(args []string) ([]byte, error) {
+	jsonOut := false
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		jsonOut = jsonOut || args[0] == "-j"
+		args = args[1:]
+	}
+	if len(args) < 2 {
+		return fakeFailure("Usage: tc [ OPTIONS ] OBJECT { COMMAND | help }")
+	}
+	object, cmd, args := args[0], args[1], args[2:]
+	if cmd == "show" && !jsonOut {
+		return fakeFailure("the fake lists as json only")
+	}
+	if object == "qdisc" && cmd == "show" {
+		return json.Marshal(f.qdiscs)
+	}
+	dev := argAfter(args, "dev")
+	if !slices.Contains(f.devs, dev) {
+		return []byte(fmt.Sprintf("Cannot find device %q\n", dev)), errors.New("exit status 1")
+	}
+	switch object {
+	case "qdisc":
+		return f.qdisc(cmd, dev, args)
+	case "filter":
+		if cmd == "show" {
+			return []byte(f.filtersJSON(dev)), nil
+		}
+		return f.filter(cmd, dev, args)
+	}
+	return fakeFailure("Object %q is unknown, try \"tc help\".", object)
+}
+
+func (f *fakeRunner) rootQdisc(dev string) *Qdisc {
+	for _, q := range f.qdiscs {
+		if *q.Dev == dev && q.Root != nil && *q.Root {
+			return q
+		}
+	}
+	return nil
+}
+
+func (f *fakeRunner) qdisc(cmd string, dev string, args []string) ([]byte, error) {
+	root := slices.Contains(args, "root")
+	parent := argAfter(args, "parent")
+	if cmd == "del" {
+		if root {
+			if f.rootQdisc(dev) == nil || *f.rootQdisc(dev).Handle == "0:" {
+				return fakeFailure("Error: Cannot delete qdisc with handle of zero.")
+			}
+			f.resetDev(dev, &Qdisc{Kind: Ptr("noqueue"), Handle: Ptr("0:"), Dev: Ptr(dev), Root: Ptr(true), Options: &QdiscOptions{}})
+			return nil, nil
+		}
+		n := len(f.qdiscs)
+		f.qdiscs = slices.DeleteFunc(f.qdiscs, func(q *Qdisc) bool {
+			return *q.Dev == dev && q.Parent != nil && *q.Parent == parent
+		})
+		if n == len(f.qdiscs) {
+			return fakeFailure("Error: Invalid handle.")
+		}
+		return nil, nil
+	}
+	if cmd != "add" && cmd != "replace" && cmd != "change" {
+		return fakeFailure("Command %q is unknown, try \"tc qdisc help\".", cmd)
+	}
+	handle := argAfter(args, "handle")
+	var rest []string
+	switch {
+	case handle != "":
+		rest = args[slices.Index(args, "handle")+2:]
+	case !root:
+		rest = args[slices.Index(args, "parent")+2:]
+	default:
+		rest = args[slices.Index(args, "root")+1:]
+	}
+	if len(rest) == 0 {
+		return fakeFailure("Error: no qdisc kind")
+	}
+	kind, params := rest[0], rest[1:]
+	q := &Qdisc{Kind: Ptr(kind), Handle: Ptr(handle), Dev: Ptr(dev)}
+	switch kind {
+	case "prio":
+		bands, _ := strconv.Atoi(argAfter(params, "bands"))
+		priomap := []int{}
+		if i := slices.Index(params, "priomap"); i >= 0 {
+			for _, p := range params[i+1:] {
+				n, _ := strconv.Atoi(p)
+				priomap = append(priomap, n)
+			}
+		}
+		q.Options = &QdiscOptions{PrioBands: &bands, PrioMap: &priomap}
+	case "netem":
+		opts, err := fakeNetem(params)
+		if err != nil {
+			return fakeFailure("%v", err)
+		}
+		q.Options = opts
+	default:
+		return fakeFailure("Error: Specified qdisc kind is unknown.")
+	}
+	if root {
+		if cur := f.rootQdisc(dev); cur != nil && *cur.Handle != "0:" && cmd == "add" {
+			return fakeFailure("Error: Exclusivity flag on, cannot modify.")
+		}
+		q.Root = Ptr(true)
+		f.resetDev(dev, q)
+		return nil, nil
+	}
+	if cur := f.rootQdisc(dev); cur == nil || *cur.Kind != "prio" {
+		return fakeFailure("Error: Failed to find specified qdisc.")
+	}
+	q.Parent = Ptr(parent)
+	for i, cur := range f.qdiscs {
+		if *cur.Dev != dev || cur.Parent == nil || *cur.Parent != parent {
+			continue
+		}
+		if cmd == "add" {
+			return fakeFailure("Error: Exclusivity flag on, cannot modify.")
+		}
+		f.qdiscs[i] = q
+		return nil, nil
+	}
+	f.qdiscs = append(f.qdiscs, q)
+	return nil, nil
+}
+
+// replace the root qdisc of dev, which drops its other qdiscs and its filters
+func (f *fakeRunner) resetDev(dev string, root *Qdisc) {
+	f.qdiscs = slices.DeleteFunc(f.qdiscs, func(q *Qdisc) bool {
+		return *q.Dev == dev
+	})
+	f.qdiscs = append(f.qdiscs, root)
+	delete(f.filters, dev)
+	for k := range f.hts {
+		if strings.HasPrefix(k, dev+"/") {
+			delete(f.hts, k)
+		}
+	}
+}
+
+// the netem options as tc lists them, in seconds, bytes per second and fractions
+func fakeNetem(params []string) (*QdiscOptions, error) {
+	o := &QdiscOptions{NetemLimit: Ptr(1000)}
+	for i := 0; i < len(params); i++ {
+		value := ""
+		if i+1 < len(params) {
+			value = params[i+1]
+		}
+		switch params[i] {
+		case "delay":
+			d, err := ParseDuration(value)
+			if err != nil {
+				return nil, err
+			}
+			o.NetemDelay = &NetemDelay{Delay: d.Seconds()}
+			i++
+			if i+1 < len(params) {
+				if j, err := ParseDuration(params[i+1]); err == nil {
+					o.NetemDelay.Jitter = j.Seconds()
+					i++
+				}
+			}
+			if i+1 < len(params) && params[i+1] == "distribution" {
+				i += 2
+			}
+			continue
+		case "loss":
+			p, err := ParsePercent(value)
+			if err != nil {
+				return nil, err
+			}
+			o.NetemLossRandom = &NetemLossRandom{Loss: float64(p) / 100}
+		case "corrupt":
+			p, err := ParsePercent(value)
+			if err != nil {
+				return nil, err
+			}
+			o.NetemCorrupt = &NetemCorrupt{Corrupt: float64(p) / 100}
+		case "rate":
+			r, err := ParseRate(value)
+			if err != nil {
+				return nil, err
+			}
+			o.NetemRate = &NetemRate{Rate: int(r.BytesPerSecond())}
+		case "limit":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, err
+			}
+			o.NetemLimit = &n
+		default:
+			return nil, fmt.Errorf("What is %q?", params[i])
+		}
+		i++
+	}
+	return o, nil
+}
+
+func (f *fakeRunner) filter(cmd string, dev string, args []string) ([]byte, error) {
+	pref, _ := strconv.Atoi(argAfter(args, "prio"))
+	proto := argAfter(args, "protocol")
+	kindAt := slices.IndexFunc(args, func(a string) bool {
+		return a == "u32" || a == "fw" || a == "basic"
+	})
+	handle := ""
+	if kindAt >= 0 {
+		handle = argAfter(args[:kindAt], "handle")
+	} else {
+		handle = argAfter(args, "handle")
+	}
+	filters := f.filters[dev]
+	if cmd == "del" {
+		if handle != "" && slices.Contains(args, "fw") {
+			mark, _ := ParseFwMark(handle)
+			handle = fmt.Sprintf("0x%x", mark.Value)
+		}
+		n := len(filters)
+		f.filters[dev] = slices.DeleteFunc(filters, func(ff *fakeFilter) bool {
+			return ff.pref == pref && (handle == "" || ff.fh == handle)
+		})
+		if n == len(f.filters[dev]) {
+			return fakeFailure("Error: Filter with specified priority/protocol not found.")
+		}
+		return nil, nil
+	}
+	if cmd != "add" && cmd != "replace" {
+		return fakeFailure("Command %q is unknown, try \"tc filter help\".", cmd)
+	}
+	if root := f.rootQdisc(dev); root == nil || *root.Kind != "prio" {
+		return fakeFailure("Error: Parent Qdisc doesn't exists.")
+	}
+	if kindAt < 0 {
+		return fakeFailure("Unknown filter kind")
+	}
+	kind, rest := args[kindAt], args[kindAt+1:]
+	var others []*fakeFilter
+	for _, ff := range filters {
+		if ff.pref == pref {
+			others = append(others, ff)
+		}
+	}
+	if len(others) > 0 && (others[0].kind != kind || others[0].proto != proto) {
+		return fakeFailure("Error: Filter kind and protocol must match.")
+	}
+	flowid := argAfter(rest, "flowid")
+	if flowid == "" {
+		flowid = argAfter(rest, "classid")
+	}
+	switch kind {
+	case "fw":
+		mark, err := ParseFwMark(handle)
+		if err != nil {
+			return fakeFailure("Illegal \"handle\"")
+		}
+		fh := fmt.Sprintf("0x%x", mark.Value)
+		if len(others) > 0 && others[0].mask != mark.Mask {
+			return fakeFailure("Error: Mask mismatch.")
+		}
+		for _, ff := range others {
+			if ff.fh == fh {
+				if cmd == "add" {
+					return fakeFailure("Error: Exclusivity flag on, cannot modify.")
+				}
+				ff.flowid = flowid
+				return nil, nil
+			}
+		}
+		if cmd == "replace" {
+			return fakeFailure("Error: Filter with specified priority/protocol not found.")
+		}
+		f.filters[dev] = append(filters, &fakeFilter{pref: pref, kind: kind, proto: proto, fh: fh, flowid: flowid, mask: mark.Mask})
+		return nil, nil
+	case "u32":
+		keys, err := fakeU32Keys(rest)
+		if err != nil {
+			return fakeFailure("%v", err)
+		}
+		if handle != "" {
+			for _, ff := range others {
+				if ff.fh == handle {
+					ff.flowid = flowid
+					if len(keys) > 0 {
+						ff.keys = keys
+					}
+					return nil, nil
+				}
+			}
+		}
+		if cmd == "replace" {
+			return fakeFailure("Error: Filter with specified priority/protocol not found.")
+		}
+		key := fmt.Sprintf("%s/%d", dev, pref)
+		ht, ok := f.hts[key]
+		if !ok {
+			ht = 0x800
+			for _, used := range f.hts {
+				ht = max(ht, used+1)
+			}
+			f.hts[key] = ht
+			f.htNext[ht] = max(f.htNext[ht], 0x800)
+		}
+		fh := fmt.Sprintf("%x::%x", ht, f.htNext[ht])
+		if handle != "" {
+			fh = handle
+			n, _ := strconv.ParseUint(handle[strings.LastIndex(handle, ":")+1:], 16, 32)
+			f.htNext[ht] = max(f.htNext[ht], int(n))
+		}
+		f.htNext[ht]++
+		f.filters[dev] = append(filters, &fakeFilter{pref: pref, kind: kind, proto: proto, fh: fh, flowid: flowid, ht: ht, keys: keys})
+		return nil, nil
+	}
+	return fakeFailure("the fake has no %s filters", kind)
+}
+
+// the keys of u32 matches, packed into the words at their offsets as the kernel keeps them
+func fakeU32Keys(args []string) ([]fakeKey, error) {
+	keys := []fakeKey{}
+	pack := func(value uint32, mask uint32, off int) {
+		for i := range keys {
+			if keys[i].off == off {
+				keys[i].value |= value
+				keys[i].mask |= mask
+				return
+			}
+		}
+		keys = append(keys, fakeKey{value, mask, off})
+	}
+	num := func(s string) uint32 {
+		n, _ := strconv.ParseUint(s, 0, 32)
+		return uint32(n)
+	}
+	for i := 0; i < len(args); i++ {
+		if args[i] == "flowid" || args[i] == "classid" {
+			i++
+			continue
+		}
+		if args[i] != "match" || i+2 >= len(args) {
+			return nil, fmt.Errorf("What is %q?", args[i])
+		}
+		switch args[i+1] {
+		case "ip":
+			field := args[i+2]
+			switch field {
+			case "src", "dst":
+				p, err := netip.ParsePrefix(args[i+3])
+				if err != nil {
+					return nil, err
+				}
+				mask := ^uint32(0) << (32 - p.Bits())
+				if p.Bits() == 0 {
+					mask = 0
+				}
+				a := p.Addr().As4()
+				value := uint32(a[0])<<24 | uint32(a[1])<<16 | uint32(a[2])<<8 | uint32(a[3])
+				off := 12
+				if field == "dst" {
+					off = 16
+				}
+				pack(value&mask, mask, off)
+				i += 3
+			case "sport", "dport":
+				value, mask := num(args[i+3]), num(args[i+4])
+				if field == "sport" {
+					pack((value&mask)<<16, mask<<16, 20)
+				} else {
+					pack(value&mask, mask, 20)
+				}
+				i += 4
+			case "tos", "protocol":
+				value, mask := num(args[i+3]), num(args[i+4])
+				off := offsetTOSLength
+				if field == "protocol" {
+					off = offsetProtocol
+				}
+				pack((value&mask)<<16, mask<<16, off)
+				i += 4
+			default:
+				return nil, fmt.Errorf("Illegal \"match ip %s\"", field)
+			}
+		case "u32", "u16", "u8":
+			value, mask := num(args[i+2]), num(args[i+3])
+			off, _ := strconv.Atoi(args[i+5])
+			width := map[string]int{"u32": 4, "u16": 2, "u8": 1}[args[i+1]]
+			shift := (4 - width - off%4) * 8
+			pack((value&mask)<<shift, mask<<shift, off-off%4)
+			i += 5
+		default:
+			return nil, fmt.Errorf("Illegal \"match %s\"", args[i+1])
+		}
+	}
+	return keys, nil
+}
+
+// the filters of dev as tc -j lists them: the matches of a u32 filter are repeated "match" keys
+func (f *fakeRunner) filtersJSON(dev string) string {
+	filters := slices.Clone(f.filters[dev])
+	sort.SliceStable(filters, func(i, j int) bool {
+		return filters[i].pref < filters[j].pref
+	})
+	parts := []string{}
+	for i, ff := range filters {
+		head := fmt.Sprintf(`{"parent":"1:","protocol":%q,"pref":%d,"kind":%q,"chain":0`, ff.proto, ff.pref, ff.kind)
+		if i == 0 || filters[i-1].pref != ff.pref {
+			parts = append(parts, head+"}")
+			if ff.kind == "u32" {
+				parts = append(parts, fmt.Sprintf(`%s,"options":{"fh":"%x:","ht_divisor":1}}`, head, ff.ht))
+			}
+		}
+		switch ff.kind {
+		case "fw":
+			fh := fmt.Sprintf(`{"mark":%q}`, ff.fh)
+			if ff.mask != ^uint32(0) {
+				fh = fmt.Sprintf(`{"mark":%q,"mask":"0x%x"}`, ff.fh, ff.mask)
+			}
+			parts = append(parts, fmt.Sprintf(`%s,"options":{"fh":%s,"classid":%q}}`, head, fh, ff.flowid))
+		case "u32":
+			order, _ := strconv.ParseUint(ff.fh[strings.LastIndex(ff.fh, ":")+1:], 16, 32)
+			options := fmt.Sprintf(`{"fh":%q,"order":%d,"key_ht":"%x","bkt":"0","flowid":%q,"not_in_hw":true`, ff.fh, order, ff.ht, ff.flowid)
+			for _, k := range ff.keys {
+				options += fmt.Sprintf(`,"match":{"value":"%x","mask":"%x","offmask":"","off":%d}`, k.value, k.mask, k.off)
+			}
+			parts = append(parts, head+`,"options":`+options+"}}")
+		}
+	}
+	return "[" + strings.Join(parts, ",") + "]"
+}
+
+func (f *fakeRunner) nftRun(args []string) ([]byte, error) {
+	args = slices.DeleteFunc(slices.Clone(args), func(a string) bool {
+		return a == "-a"
+	})
+	noChain := func() ([]byte, error) {
+		return []byte("Error: No such file or directory\n"), errors.New("exit status 1")
+	}
+	if len(args) < 5 && !(len(args) == 4 && args[1] == "table") {
+		return fakeFailure("Error: syntax error")
+	}
+	switch args[0] + " " + args[1] {
+	case "add table":
+		if f.nft == nil {
+			f.nft = map[string][]fakeNftRule{}
+		}
+		return nil, nil
+	case "add chain":
+		if f.nft == nil {
+			return noChain()
+		}
+		if _, ok := f.nft[args[4]]; !ok {
+			f.nft[args[4]] = []fakeNftRule{}
+		}
+		return nil, nil
+	case "add rule":
+		if _, ok := f.nft[args[4]]; !ok {
+			return noChain()
+		}
+		f.nftNext++
+		f.nft[args[4]] = append(f.nft[args[4]], fakeNftRule{f.nftNext, strings.Join(args[5:], " ")})
+		return nil, nil
+	case "delete rule":
+		handle, _ := strconv.Atoi(argAfter(args, "handle"))
+		n := len(f.nft[args[4]])
+		f.nft[args[4]] = slices.DeleteFunc(f.nft[args[4]], func(r fakeNftRule) bool {
+			return r.handle == handle
+		})
+		if n == len(f.nft[args[4]]) {
+			return noChain()
+		}
+		return nil, nil
+	case "list chain":
+		rules, ok := f.nft[args[4]]
+		if !ok {
+			return noChain()
+		}
+		out := fmt.Sprintf("table inet %s {\n\tchain %s {\n\t\ttype filter hook %s priority mangle; policy accept;\n", args[3], args[4], args[4])
+		for _, r := range rules {
+			out += fmt.Sprintf("\t\t%s # handle %d\n", r.rule, r.handle)
+		}
+		return []byte(out + "\t}\n}\n"), nil
+	}
+	return fakeFailure("Error: syntax error")
+}
+
+// the filters of dev in a form easy to compare, one per line: priority, handle, flow and matches
+func (f *fakeRunner) filterLines(dev string) []string {
+	lines := []string{}
+	for _, ff := range f.filters[dev] {
+		line := fmt.Sprintf("%d %s %s %s", ff.pref, ff.kind, ff.fh, ff.flowid)
+		for _, k := range ff.keys {
+			line += fmt.Sprintf(" %08x/%08x@%d", k.value, k.mask, k.off)
+		}
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// the qdiscs of dev in a form easy to compare, one per line
+func (f *fakeRunner) qdiscLines(dev string) []string {
+	lines := []string{}
+	for _, q := range f.qdiscs {
+		if *q.Dev != dev {
+			continue
+		}
+		opts, _ := json.Marshal(q.Options)
+		lines = append(lines, fmt.Sprintf("%s %s %s %s", *q.Kind, *q.Handle, PtrToString(q.Parent), opts))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// the nftables rules of all chains in a form easy to compare, without their handles
+func (f *fakeRunner) nftLines() []string {
+	lines := []string{}
+	for chain, rules := range f.nft {
+		for _, r := range rules {
+			lines = append(lines, chain+": "+r.rule)
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
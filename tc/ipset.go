@@ -0,0 +1,206 @@
+package tc
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+// rules with SourceSet or DestinationSet match the members of a kernel ipset, of networks and addresses, with the ipset ematch of a
+// basic filter; the sets are changed without changing the filters
+const setType = "hash:net"
+
+// ipset names are at most 31 characters
+var setNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,30}$`)
+
+// read the addresses or networks of a set, one per line; empty lines and comments from '#' are skipped
+func ReadAddrs(r io.Reader) ([]netip.Prefix, error) {
+	addrs := []netip.Prefix{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		p, err := ParsePrefix(text)
+		if err != nil || !p.Addr().Is4() {
+			return nil, fmt.Errorf("line %d: invalid IPv4 address or network %q", line, text)
+		}
+		addrs = append(addrs, p.Masked())
+	}
+	return addrs, scanner.Err()
+}
+
+// the ematch arguments of a basic filter for the sets of a rule
+func ipsetMatches(r *Rule) []string {
+	params := []string{"match"}
+	if r.SourceSet != nil {
+		params = append(params, "ipset("+*r.SourceSet+" src)")
+	}
+	if r.DestinationSet != nil {
+		if len(params) > 1 {
+			params = append(params, "and")
+		}
+		params = append(params, "ipset("+*r.DestinationSet+" dst)")
+	}
+	return params
+}
+
+func (r *Rule) hasSet() bool {
+	return r.SourceSet != nil || r.DestinationSet != nil
+}
+
+// ipset ematches as tc prints them, for example ipset(bad-peers dst)
+var ipsetMatchRe = regexp.MustCompile(`ipset\(([^ )]+) (src|dst)\)`)
+
+// decode the ematches of a basic filter
+func (m *FilterMatchParsed) parseIpset(line string) {
+	for _, match := range ipsetMatchRe.FindAllStringSubmatch(line, -1) {
+		if match[2] == "src" {
+			m.SourceSet = Ptr(match[1])
+		} else {
+			m.DestSet = Ptr(match[1])
+		}
+	}
+}
+
+// run ipset in the client's namespace
+func (c *Client) ipset(ctx context.Context, args ...string) ([]byte, error) {
+	return c.runInNamespace(ctx, "ipset", args...)
+}
+
+// create a set unless it exists
+func (c *Client) ensureSet(ctx context.Context, name string) error {
+	_, err := c.ipset(ctx, "create", name, setType, "family", "inet", "-exist")
+	return err
+}
+
+// the members of a set; ErrSetNotFound if there is no such set
+func (c *Client) SetMembers(ctx context.Context, name string) ([]netip.Prefix, error) {
+	out, err := c.ipset(ctx, "list", name)
+	if err != nil {
+		return nil, err
+	}
+	members := []netip.Prefix{}
+	inMembers := false
+	for _, line := range outputLines(out) {
+		if line == "Members:" {
+			inMembers = true
+			continue
+		}
+		if !inMembers || line == "" {
+			continue
+		}
+		// hash:net sets may have options after the member, such as a timeout
+		p, err := ParsePrefix(strings.Fields(line)[0])
+		if err != nil {
+			return nil, fmt.Errorf("set %s: invalid member %q", name, line)
+		}
+		members = append(members, p)
+	}
+	return members, nil
+}
+
+// add addresses or networks to a set, creating it if it does not exist
+func (c *Client) AddSetMembers(ctx context.Context, name string, members []netip.Prefix) error {
+	err := checkSet(name, members)
+	if err != nil {
+		return err
+	}
+	unlock, err := c.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	lines := []string{createSetLine(name)}
+	for _, m := range members {
+		lines = append(lines, "add "+name+" "+m.String())
+	}
+	return c.ipsetRestore(ctx, lines)
+}
+
+// remove addresses or networks from a set, or remove the set if members is empty; a set which rules use cannot be removed
+func (c *Client) DelSetMembers(ctx context.Context, name string, members []netip.Prefix) error {
+	err := checkSet(name, members)
+	if err != nil {
+		return err
+	}
+	unlock, err := c.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if len(members) == 0 {
+		_, err = c.ipset(ctx, "destroy", name)
+		return err
+	}
+	lines := []string{}
+	for _, m := range members {
+		lines = append(lines, "del "+name+" "+m.String())
+	}
+	return c.ipsetRestore(ctx, lines)
+}
+
+// the set the members of ReplaceSetMembers are added to before it is swapped with the replaced set; set names given to easytc
+// cannot start with '_', so it is none of the user's sets
+const replaceSetName = "_easytc_replace"
+
+// make the members of a set the given ones, creating it if it does not exist. The members are added to a new set which is then
+// swapped with the set, so that filters matching it never see only some of them
+func (c *Client) ReplaceSetMembers(ctx context.Context, name string, members []netip.Prefix) error {
+	err := checkSet(name, members)
+	if err != nil {
+		return err
+	}
+	unlock, err := c.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// the new set may be left from a replace which failed
+	lines := []string{createSetLine(name), createSetLine(replaceSetName), "flush " + replaceSetName}
+	for _, m := range members {
+		lines = append(lines, "add "+replaceSetName+" "+m.String())
+	}
+	lines = append(lines, "swap "+replaceSetName+" "+name, "destroy "+replaceSetName)
+	err = c.ipsetRestore(ctx, lines)
+	if err != nil {
+		// for example the set has another type, with which it cannot be swapped
+		_, derr := c.ipset(ctx, "destroy", replaceSetName)
+		if derr != nil && !errors.Is(derr, ErrSetNotFound) {
+			c.log.Warn("cannot remove set", "set", replaceSetName, "err", derr)
+		}
+	}
+	return err
+}
+
+// the ipset command which creates a set unless it exists, for ipsetRestore
+func createSetLine(name string) string {
+	return "create " + name + " " + setType + " family inet"
+}
+
+// run ipset commands in one ipset restore, such as "add NAME ADDRESS"; members which are already added, or not there to
+// delete, and sets which already exist are not errors
+func (c *Client) ipsetRestore(ctx context.Context, lines []string) error {
+	_, err := c.runInputInNamespace(ctx, []byte(strings.Join(lines, "\n")+"\n"), "ipset", "restore", "-exist")
+	return err
+}
+
+func checkSet(name string, members []netip.Prefix) error {
+	e := &ValidationError{}
+	if !setNameRe.MatchString(name) {
+		e.add("", "set name %q must start with a letter or digit, contain only letters, digits, '.', '_' and '-', and be at most 31 characters", name)
+	}
+	for _, m := range members {
+		if !m.IsValid() || !m.Addr().Is4() {
+			e.add("", "%s is not an IPv4 address or network", m)
+		}
+	}
+	return e.errOrNil()
+}
@@ -3,20 +3,21 @@ package tc
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"math/bits"
 	"net"
-	"os/exec"
+	"net/netip"
+	"slices"
 	"strconv"
 	"strings"
 
 	"github.com/bestmethod/inslice"
 )
 
-func ListKernelMods(verbose bool) (mods []string, err error) {
-	logf(verbose, "(ListKernelMods) Running [lsmod]")
-	out, err := exec.Command("lsmod").CombinedOutput()
+func (c *Client) ListKernelMods(ctx context.Context) (mods []string, err error) {
+	out, err := c.run(ctx, "lsmod")
 	if err != nil {
 		return nil, err
 	}
@@ -24,7 +25,6 @@ func ListKernelMods(verbose bool) (mods []string, err error) {
 	for scanner.Scan() {
 		mods = append(mods, strings.Trim(strings.Split(strings.Split(strings.Trim(scanner.Text(), "\r\n\t "), " ")[0], "\t")[0], "\r\n\t "))
 	}
-	logf(verbose, "(ListKernelMods) return")
 	return
 }
 
@@ -41,13 +41,52 @@ func (f *FilterMatches) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// fw filters print their handle as the mark and mask they match, and their flow as classid
+func (o *FilterOptions) UnmarshalJSON(data []byte) error {
+	type options FilterOptions
+	aux := struct {
+		*options
+		FH      json.RawMessage `json:"fh"`
+		ClassID *string         `json:"classid"`
+	}{options: (*options)(o)}
+	err := json.Unmarshal(data, &aux)
+	if err != nil {
+		return err
+	}
+	if o.FlowId == nil {
+		o.FlowId = aux.ClassID
+	}
+	if len(aux.FH) == 0 || string(aux.FH) == "null" {
+		return nil
+	}
+	fh := ""
+	if json.Unmarshal(aux.FH, &fh) == nil {
+		o.FH = &fh
+		return nil
+	}
+	mark := map[string]json.RawMessage{}
+	err = json.Unmarshal(aux.FH, &mark)
+	if err != nil {
+		return err
+	}
+	fh = jsonNumber(mark["mark"])
+	if mask := jsonNumber(mark["mask"]); mask != "" {
+		fh += "/" + mask
+	}
+	o.FH = &fh
+	return nil
+}
+
+// a number, which tc prints either as a JSON number or as a hex string
+func jsonNumber(data json.RawMessage) string {
+	return strings.Trim(string(data), `"`)
+}
+
 // no-json fallback for qdisc list
-func qdiscListNoJson(verbose bool) ([]*Qdisc, error) {
-	comm := []string{"tc", "qdisc", "show"}
-	logf(verbose, "(qdiscListNoJson) Running %v", comm)
-	out, err := exec.Command(comm[0], comm[1:]...).CombinedOutput()
+func (c *Client) qdiscListNoJson(ctx context.Context) ([]*Qdisc, error) {
+	out, err := c.tc(ctx, "qdisc", "show")
 	if err != nil {
-		return nil, fmt.Errorf("%s: %s", err, string(out))
+		return nil, err
 	}
 	qdiscs := []*Qdisc{}
 
@@ -93,13 +132,9 @@ func qdiscListNoJson(verbose bool) ([]*Qdisc, error) {
 						// netem device
 						qd.Parent = &items[6]
 						// parse limit, delay, loss, rate
-						offset := 9
-						for len(items) >= offset {
-							if qd.Options == nil {
-								qd.Options = &QdiscOptions{}
-							}
-							qdiscListNoJsonParseNetem(qd, items[offset-2], items[offset-1])
-							offset = offset + 2
+						if len(items) >= 9 {
+							qd.Options = &QdiscOptions{}
+							qdiscListNoJsonParseNetem(qd, items[7:])
 						}
 					}
 				}
@@ -107,97 +142,82 @@ func qdiscListNoJson(verbose bool) ([]*Qdisc, error) {
 			qdiscs = append(qdiscs, qd)
 		}
 	}
-
-	logf(verbose, "(qdiscListNoJson) return")
 	return qdiscs, nil
 }
 
-func qdiscListNoJsonParseNetem(qd *Qdisc, name string, value string) {
-	switch name {
-	case "limit":
-		lim, _ := strconv.Atoi(value)
-		qd.Options.NetemLimit = &lim
-	case "corrupt":
-		corrupt, _ := strconv.Atoi(strings.TrimSuffix(value, "%"))
-		corruptFloat := float64(corrupt) / 100
-		qd.Options.NetemCorrupt = &NetemCorrupt{
-			Corrupt: corruptFloat,
-		}
-	case "loss":
-		loss, _ := strconv.Atoi(strings.TrimSuffix(value, "%"))
-		lossFloat := float64(loss) / 100
-		qd.Options.NetemLossRandom = &NetemLossRandom{
-			Loss: lossFloat,
-		}
-	case "delay":
-		multiplier := float64(1)
-		if strings.HasSuffix(value, "us") {
-			value = strings.TrimSuffix(value, "us")
-			multiplier = 1000000
-		} else if strings.HasSuffix(value, "ms") {
-			multiplier = 1000
-			value = strings.TrimSuffix(value, "ms")
-		} else {
-			value = strings.TrimSuffix(value, "s")
-		}
-		delay, _ := strconv.Atoi(value)
-		multiplier = float64(delay) / multiplier
-		qd.Options.NetemDelay = &NetemDelay{
-			Delay: multiplier,
-		}
-	case "rate":
-		multiplier := 1
-		if strings.HasSuffix(value, "Gbit") {
-			multiplier = 1024 * 1024 * 1024 / 8
-			value = strings.TrimSuffix(value, "Gbit")
-		} else if strings.HasSuffix(value, "Mbit") {
-			multiplier = 1024 * 1024 / 8
-			value = strings.TrimSuffix(value, "Mbit")
-		} else if strings.HasSuffix(value, "Kbit") {
-			multiplier = 1024 / 8
-			value = strings.TrimSuffix(value, "Kbit")
-		} else if strings.HasSuffix(value, "bit") {
-			multiplier = 8
-			value = strings.TrimSuffix(value, "bit")
-		}
-		rate, _ := strconv.Atoi(value)
-		multiplier = rate * multiplier
-		qd.Options.NetemRate = &NetemRate{
-			Rate: multiplier,
+// the netem options of a qdisc line, such as "limit 1000 delay 100ms  10ms loss 0.5% rate 10Mbit", in the units of the json output
+func qdiscListNoJsonParseNetem(qd *Qdisc, items []string) {
+	items = slices.DeleteFunc(slices.Clone(items), func(item string) bool {
+		return item == ""
+	})
+	for i := 0; i+1 < len(items); i++ {
+		value := items[i+1]
+		switch items[i] {
+		case "limit":
+			if lim, err := strconv.Atoi(value); err == nil {
+				qd.Options.NetemLimit = &lim
+			}
+		case "corrupt":
+			if corrupt, err := ParsePercent(value); err == nil {
+				qd.Options.NetemCorrupt = &NetemCorrupt{
+					Corrupt: float64(corrupt) / 100,
+				}
+			}
+		case "loss":
+			if loss, err := ParsePercent(value); err == nil {
+				qd.Options.NetemLossRandom = &NetemLossRandom{
+					Loss: float64(loss) / 100,
+				}
+			}
+		case "delay":
+			delay, err := ParseDuration(value)
+			if err != nil {
+				continue
+			}
+			qd.Options.NetemDelay = &NetemDelay{
+				Delay: delay.Seconds(),
+			}
+			// the jitter follows the delay
+			if i+2 < len(items) {
+				if jitter, err := ParseDuration(items[i+2]); err == nil {
+					qd.Options.NetemDelay.Jitter = jitter.Seconds()
+				}
+			}
+		case "rate":
+			if rate, err := ParseRate(value); err == nil {
+				qd.Options.NetemRate = &NetemRate{
+					Rate: int(rate.BytesPerSecond()),
+				}
+			}
 		}
 	}
 }
 
 // List tc qdisc
-func ListQdisc(verbose bool) ([]*Qdisc, error) {
-	comm := []string{"tc", "-j", "qdisc", "show"}
-	logf(verbose, "(ListQdisc) Running %v", comm)
-	out, err := exec.Command(comm[0], comm[1:]...).CombinedOutput()
+func (c *Client) ListQdisc(ctx context.Context) ([]*Qdisc, error) {
+	out, err := c.tc(ctx, "-j", "qdisc", "show")
 	if err != nil {
-		logf(verbose, "(ListQdisc) invoking tc with '-j' failed, failing back to old iproute2")
-		defer logf(verbose, "(ListQdisc) return")
-		return qdiscListNoJson(verbose)
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		c.log.Debug("invoking tc with '-j' failed, falling back to old iproute2", "func", "ListQdisc", "err", err)
+		return c.qdiscListNoJson(ctx)
 	}
 	qdiscs := []*Qdisc{}
-	logf(verbose, "(ListQdisc) json.Unmarshal")
 	err = json.Unmarshal(out, &qdiscs)
 	if err != nil {
-		logf(verbose, "(ListQdisc) invoking tc with '-j' failed on unmarshal, failing back to old iproute2")
-		defer logf(verbose, "(ListQdisc) return")
-		return qdiscListNoJson(verbose)
+		c.log.Debug("invoking tc with '-j' failed on unmarshal, falling back to old iproute2", "func", "ListQdisc", "err", err)
+		return c.qdiscListNoJson(ctx)
 	}
-	logf(verbose, "(ListQdisc) return")
 	return qdiscs, nil
 }
 
 // no-json fallback for filter list
-func filterListNoJson(iface string, verbose bool) ([]*Filter, error) {
+func (c *Client) filterListNoJson(ctx context.Context, iface string) ([]*Filter, error) {
 	filters := []*Filter{}
-	comm := []string{"tc", "filter", "show", "dev", iface}
-	logf(verbose, "(filterListNoJson) Running %v", comm)
-	out, err := exec.Command(comm[0], comm[1:]...).CombinedOutput()
+	out, err := c.tc(ctx, "filter", "show", "dev", iface)
 	if err != nil {
-		return nil, fmt.Errorf("%s: %s", err, string(out))
+		return nil, err
 	}
 	scanner := bufio.NewScanner(bytes.NewReader(out))
 	var filter *Filter
@@ -222,7 +242,15 @@ func filterListNoJson(iface string, verbose bool) ([]*Filter, error) {
 						if len(items) >= 10 && items[8] == "chain" {
 							chain, _ := strconv.Atoi(items[9])
 							filter.Chain = &chain
-							if len(items) >= 12 && items[10] == "fh" {
+							if len(items) >= 12 && items[10] == "handle" {
+								// fw or basic filter
+								filter.Options = &FilterOptions{
+									FH: &items[11],
+								}
+								if len(items) >= 14 && (items[12] == "classid" || items[12] == "flowid") {
+									filter.Options.FlowId = &items[13]
+								}
+							} else if len(items) >= 12 && items[10] == "fh" {
 								filter.Options = &FilterOptions{
 									FH: &items[11],
 								}
@@ -251,6 +279,9 @@ func filterListNoJson(iface string, verbose bool) ([]*Filter, error) {
 					}
 				}
 			}
+		} else if filter.Options != nil && strings.Contains(line, "ipset(") {
+			// ematches of a basic filter
+			filter.Options.MatchParsed.parseIpset(line)
 		} else if len(items) == 4 && items[0] == "match" && items[2] == "at" {
 			offset, _ := strconv.Atoi(items[3])
 			valueMask := strings.Split(items[1], "/")
@@ -269,41 +300,59 @@ func filterListNoJson(iface string, verbose bool) ([]*Filter, error) {
 	if filter != nil {
 		filters = append(filters, filter)
 	}
-	logf(verbose, "(filterListNoJson) return")
 	return filters, nil
 }
 
 // List tc filters
-func ListFilter(iface string, verbose bool) ([]*Filter, error) {
+func (c *Client) ListFilter(ctx context.Context, iface string) ([]*Filter, error) {
 	filters := []*Filter{}
-	comm := []string{"tc", "-j", "filter", "show", "dev", iface}
-	logf(verbose, "(ListFilter) Running %v", comm)
-	out, err := exec.Command(comm[0], comm[1:]...).CombinedOutput()
+	out, err := c.tc(ctx, "-j", "filter", "show", "dev", iface)
 	if err != nil {
-		logf(verbose, "(ListFilter) invoking tc with '-j' failed, failing back to old iproute2")
-		filters, err = filterListNoJson(iface, verbose)
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		c.log.Debug("invoking tc with '-j' failed, falling back to old iproute2", "func", "ListFilter", "iface", iface, "err", err)
+		filters, err = c.filterListNoJson(ctx, iface)
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		logf(verbose, "(ListFilter) json.Unmarshal")
 		err = json.Unmarshal(out, &filters)
 		if err != nil {
-			logf(verbose, "(ListFilter) json failed - old iproute2 - attempting to fallback on string parsing")
-			filters, err = filterListNoJson(iface, verbose)
+			c.log.Debug("json failed - old iproute2 - attempting to fallback on string parsing", "func", "ListFilter", "iface", iface, "err", err)
+			filters, err = c.filterListNoJson(ctx, iface)
+			if err != nil {
+				return nil, err
+			}
+		} else if slices.ContainsFunc(filters, isBasicFilter) {
+			// tc prints the ematches of basic filters as text only
+			c.log.Debug("listing basic filters with string parsing", "func", "ListFilter", "iface", iface)
+			filters, err = c.filterListNoJson(ctx, iface)
 			if err != nil {
 				return nil, err
 			}
 		}
 	}
 	for i, filter := range filters {
-		logf(verbose, "(ListFilter) Enum, filter=%d", i)
 		filters[i].Iface = iface
 		if filter.Options == nil {
 			continue
 		}
-		for matchi, match := range filter.Options.Match {
-			logf(verbose, "(ListFilter) Enum, filter=%d match=%d", i, matchi)
+		if isFwFilter(filter) && filter.Options.FH != nil {
+			if mark, err := ParseFwMark(*filter.Options.FH); err == nil {
+				filter.Options.FH = Ptr(mark.String())
+				filter.Options.MatchParsed.FwMark = &mark
+			}
+			continue
+		}
+		// basic filter handles are numbered from 1 in each priority, shown in decimal so they differ from fw marks
+		if isBasicFilter(filter) && filter.Options.FH != nil {
+			if n, err := strconv.ParseUint(*filter.Options.FH, 0, 32); err == nil {
+				filter.Options.FH = Ptr(strconv.FormatUint(n, 10))
+			}
+			continue
+		}
+		for _, match := range filter.Options.Match {
 			for len(match.Value) < 8 {
 				match.Value = "0" + match.Value
 			}
@@ -311,77 +360,85 @@ func ListFilter(iface string, verbose bool) ([]*Filter, error) {
 				match.Mask = "0" + match.Mask
 			}
 			switch match.Offset {
-			case 12: // source ip
-				ip, err := parseOctets(match.Value)
+			// the TCP flags are in the word at offset 32
+			case offsetTOSLength, offsetProtocol, offsetTCPFlags - 1:
+				value, err := strconv.ParseUint(match.Value, 16, 32)
 				if err != nil {
 					continue
 				}
-				maskInt, err := strconv.ParseUint(match.Mask, 16, 32)
+				mask, err := strconv.ParseUint(match.Mask, 16, 32)
 				if err != nil {
 					continue
 				}
-				mask := "/" + strconv.Itoa(bits.OnesCount(uint(maskInt)))
-				if mask == "/32" {
-					mask = ""
+				parsed := &filters[i].Options.MatchParsed
+				switch match.Offset {
+				case offsetTOSLength:
+					parsed.parseTOSLength(uint32(value), uint32(mask))
+				case offsetProtocol:
+					if uint8(mask>>16) == 0xff {
+						parsed.Protocol = Ptr(uint8(value >> 16))
+					}
+				default:
+					parsed.parseTCPFlags(uint32(value), uint32(mask))
+				}
+			case 12: // source ip
+				ip, err := parseMatchPrefix(match.Value, match.Mask)
+				if err != nil {
+					continue
 				}
-				filters[i].Options.MatchParsed.SourceIPMask = StringToPtr(ip + mask)
+				filters[i].Options.MatchParsed.SourceIPMask = &ip
 			case 16: // dest ip
-				ip, err := parseOctets(match.Value)
+				ip, err := parseMatchPrefix(match.Value, match.Mask)
 				if err != nil {
 					continue
 				}
-				maskInt, err := strconv.ParseUint(match.Mask, 16, 32)
+				filters[i].Options.MatchParsed.DestIPMask = &ip
+			case 20: // ports
+				value, err := strconv.ParseUint(match.Value, 16, 32)
 				if err != nil {
 					continue
 				}
-				mask := "/" + strconv.Itoa(bits.OnesCount(uint(maskInt)))
-				if mask == "/32" {
-					mask = ""
+				mask, err := strconv.ParseUint(match.Mask, 16, 32)
+				if err != nil {
+					continue
 				}
-				filters[i].Options.MatchParsed.DestIPMask = StringToPtr(ip + mask)
-			case 20: // ports
-				if strings.HasPrefix(match.Mask, "ffff") {
-					// parse source IP from first 2 bytes
-					port, err := strconv.ParseUint(match.Value[0:4], 16, 16)
-					if err != nil {
-						continue
+				if mask>>16 != 0 {
+					// source port in the first 2 bytes
+					if port, ok := portRangeFromMask(uint16(value>>16), uint16(mask>>16)); ok {
+						filters[i].Options.MatchParsed.SourcePort = &port
 					}
-					portInt := int(port)
-					filters[i].Options.MatchParsed.SourcePort = &portInt
 				}
-				if strings.HasSuffix(match.Mask, "ffff") {
-					// parse dest IP from last 2 bytes
-					port, err := strconv.ParseUint(match.Value[4:8], 16, 16)
-					if err != nil {
-						continue
+				if mask&0xffff != 0 {
+					// dest port in the last 2 bytes
+					if port, ok := portRangeFromMask(uint16(value), uint16(mask)); ok {
+						filters[i].Options.MatchParsed.DestPort = &port
 					}
-					portInt := int(port)
-					filters[i].Options.MatchParsed.DestPort = &portInt
 				}
 			}
 		}
 	}
-	logf(verbose, "(ListFilter) return")
 	return filters, nil
 }
 
-func parseOctets(val string) (string, error) {
-	v, err := strconv.ParseUint(val[0:2], 16, 8)
+// parse an IPv4 u32 match, value and mask in hex
+func parseMatchPrefix(value string, mask string) (netip.Prefix, error) {
+	v, err := strconv.ParseUint(value, 16, 32)
 	if err != nil {
-		return "", err
-	}
-	if len(val) == 2 {
-		return strconv.Itoa(int(v)), nil
+		return netip.Prefix{}, err
 	}
-	n, err := parseOctets(val[2:])
+	m, err := strconv.ParseUint(mask, 16, 32)
 	if err != nil {
-		return "", err
+		return netip.Prefix{}, err
 	}
-	return strconv.Itoa(int(v)) + "." + n, nil
+	ip := netip.AddrFrom4([4]byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+	return netip.PrefixFrom(ip, bits.OnesCount32(uint32(m))).Masked(), nil
 }
 
 // List interfaces
-func ListIface() ([]string, error) {
+func (c *Client) ListIface(ctx context.Context) ([]string, error) {
+	if c.namespace != "" {
+		return c.listNamespaceIface(ctx)
+	}
 	l, err := net.Interfaces()
 	if err != nil {
 		return nil, err
@@ -398,9 +455,8 @@ func ListIface() ([]string, error) {
 }
 
 // Calls all the listing systems and combines them into a single full listing output
-func ListRules(verbose bool) (*Rules, error) {
-	logf(verbose, "(ListRules) ListIface")
-	ifaces, err := ListIface()
+func (c *Client) ListRules(ctx context.Context) (*Rules, error) {
+	ifaces, err := c.ListIface(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -408,15 +464,13 @@ func ListRules(verbose bool) (*Rules, error) {
 		Interfaces: ifaces,
 	}
 	for _, iface := range ifaces {
-		logf(verbose, "(ListRules) ListFilter iface=%s", iface)
-		filter, err := ListFilter(iface, verbose)
+		filter, err := c.ListFilter(ctx, iface)
 		if err != nil {
 			return nil, err
 		}
 		r.Filters = append(r.Filters, filter...)
 	}
-	logf(verbose, "(ListRules) ListQdisc")
-	qd, err := ListQdisc(verbose)
+	qd, err := c.ListQdisc(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -424,15 +478,33 @@ func ListRules(verbose bool) (*Rules, error) {
 	// join qdisk and filter to make rules
 	qdiscs := []int{}
 	for fi, f := range r.Filters {
-		logf(verbose, "(ListRules) Enum, filter=%d", fi)
 		if f.Options == nil {
 			continue
 		}
 		if f.Options.FlowId == nil {
 			continue
 		}
+		if isPassFilter(f) {
+			r.Rules = append(r.Rules, &Rule{
+				Iface:           &f.Iface,
+				SourceIP:        f.Options.MatchParsed.SourceIPMask,
+				SourcePort:      f.Options.MatchParsed.SourcePort,
+				DestinationIP:   f.Options.MatchParsed.DestIPMask,
+				DestinationPort: f.Options.MatchParsed.DestPort,
+				DSCP:            f.Options.MatchParsed.DSCP,
+				TOS:             f.Options.MatchParsed.TOS,
+				Length:          f.Options.MatchParsed.Length,
+				TCPFlags:        f.Options.MatchParsed.TCPFlags,
+				Protocol:        f.Options.MatchParsed.protocol(),
+				PassThrough:     true,
+				Priority:        f.Pref,
+				FlowID:          f.Options.FlowId,
+				FilterNo:        fi,
+				FilterHandle:    f.Options.FH,
+			})
+			continue
+		}
 		for qi, q := range r.Qdisc {
-			logf(verbose, "(ListRules) Enum, filter=%d qdisc=%d", fi, qi)
 			if q.Kind == nil || *q.Kind != "netem" {
 				continue
 			}
@@ -445,54 +517,35 @@ func ListRules(verbose bool) (*Rules, error) {
 			if q.Options == nil {
 				continue
 			}
-			var latency *string
-			var linkSpeed *string
-			var packetLoss *string
-			var corruptPct *string
-			if q.Options.NetemDelay != nil {
-				latency = StringToPtr(fmt.Sprintf("%0.0f", q.Options.NetemDelay.Delay*1000))
-			}
-			if q.Options.NetemRate != nil {
-				linkSpeed = StringToPtr(fmt.Sprintf("%d", q.Options.NetemRate.Rate))
-			}
-			if q.Options.NetemLossRandom != nil {
-				packetLoss = StringToPtr(fmt.Sprintf("%0.2f", q.Options.NetemLossRandom.Loss*100))
-			}
-			if q.Options.NetemCorrupt != nil {
-				corruptPct = StringToPtr(fmt.Sprintf("%0.2f", q.Options.NetemCorrupt.Corrupt*100))
-			}
 			if !inslice.HasInt(qdiscs, qi) {
 				qdiscs = append(qdiscs, qi)
 			}
-			var sport *string
-			var dport *string
-			if f.Options.MatchParsed.SourcePort != nil {
-				sport = StringToPtr(strconv.Itoa(*f.Options.MatchParsed.SourcePort))
-			}
-			if f.Options.MatchParsed.DestPort != nil {
-				dport = StringToPtr(strconv.Itoa(*f.Options.MatchParsed.DestPort))
-			}
-			r.Rules = append(r.Rules, &Rule{
-				Iface:              &f.Iface,
-				SourceIP:           f.Options.MatchParsed.SourceIPMask,
-				SourcePort:         sport,
-				DestinationIP:      f.Options.MatchParsed.DestIPMask,
-				DestinationPort:    dport,
-				LatencyMs:          latency,
-				PacketLossPct:      packetLoss,
-				LinkSpeedRateBytes: linkSpeed,
-				CorruptPct:         corruptPct,
-				FlowID:             f.Options.FlowId,
-				FilterNo:           fi,
-				QdiscNo:            qi,
-				FilterHandle:       f.Options.FH,
-				QdiscHandle:        q.Handle,
-			})
+			rule := netemRule(q)
+			rule.Iface = &f.Iface
+			rule.SourceIP = f.Options.MatchParsed.SourceIPMask
+			rule.SourcePort = f.Options.MatchParsed.SourcePort
+			rule.DestinationIP = f.Options.MatchParsed.DestIPMask
+			rule.DestinationPort = f.Options.MatchParsed.DestPort
+			rule.DSCP = f.Options.MatchParsed.DSCP
+			rule.TOS = f.Options.MatchParsed.TOS
+			rule.Length = f.Options.MatchParsed.Length
+			rule.TCPFlags = f.Options.MatchParsed.TCPFlags
+			rule.Protocol = f.Options.MatchParsed.protocol()
+			rule.FwMark = f.Options.MatchParsed.FwMark
+			rule.SourceSet = f.Options.MatchParsed.SourceSet
+			rule.DestinationSet = f.Options.MatchParsed.DestSet
+			rule.AllTraffic = isAllTrafficFilter(f)
+			rule.Priority = f.Pref
+			rule.FlowID = f.Options.FlowId
+			rule.FilterNo = fi
+			rule.QdiscNo = qi
+			rule.FilterHandle = f.Options.FH
+			rule.QdiscHandle = q.Handle
+			r.Rules = append(r.Rules, rule)
 			break
 		}
 	}
 	for qi, q := range qd {
-		logf(verbose, "(ListRules) Enum, qdisc=%d", qi)
 		if inslice.HasInt(qdiscs, qi) {
 			continue
 		}
@@ -508,32 +561,52 @@ func ListRules(verbose bool) (*Rules, error) {
 		if q.Options == nil {
 			continue
 		}
-		var latency *string
-		var linkSpeed *string
-		var packetLoss *string
-		if q.Options.NetemDelay != nil {
-			latency = StringToPtr(fmt.Sprintf("%0.0f", q.Options.NetemDelay.Delay*1000))
-		}
-		if q.Options.NetemRate != nil {
-			linkSpeed = StringToPtr(fmt.Sprintf("%d", q.Options.NetemRate.Rate))
-		}
-		if q.Options.NetemLossRandom != nil {
-			packetLoss = StringToPtr(fmt.Sprintf("%0.2f", q.Options.NetemLossRandom.Loss*100))
-		}
-		r.Rules = append(r.Rules, &Rule{
-			Iface:              q.Dev,
-			LatencyMs:          latency,
-			PacketLossPct:      packetLoss,
-			LinkSpeedRateBytes: linkSpeed,
-			FlowID:             q.Parent,
-			QdiscNo:            qi,
-			QdiscHandle:        q.Handle,
-		})
-	}
-	logf(verbose, "(ListRules) return")
+		rule := netemRule(q)
+		rule.Iface = q.Dev
+		rule.FlowID = q.Parent
+		rule.QdiscNo = qi
+		rule.QdiscHandle = q.Handle
+		r.Rules = append(r.Rules, rule)
+	}
+	err = c.readMeta(r)
+	if err != nil {
+		return nil, err
+	}
 	return r, nil
 }
 
+// interfaces a rule applies to: the given one, or all interfaces if nil
+func (r *Rules) selectIfaces(iface *string) ([]string, error) {
+	if iface == nil {
+		return r.Interfaces, nil
+	}
+	if !inslice.HasString(r.Interfaces, *iface) {
+		return nil, fmt.Errorf("%w: %s", ErrInterfaceNotFound, *iface)
+	}
+	return []string{*iface}, nil
+}
+
+// rule with the actions of a netem qdisc
+func netemRule(q *Qdisc) *Rule {
+	r := &Rule{}
+	if q.Options.NetemDelay != nil {
+		r.Latency = Ptr(seconds(q.Options.NetemDelay.Delay))
+		if q.Options.NetemDelay.Jitter != 0 {
+			r.Jitter = Ptr(seconds(q.Options.NetemDelay.Jitter))
+		}
+	}
+	if q.Options.NetemRate != nil {
+		r.Rate = Ptr(Rate(q.Options.NetemRate.Rate) * 8)
+	}
+	if q.Options.NetemLossRandom != nil {
+		r.PacketLoss = Ptr(fractionPercent(q.Options.NetemLossRandom.Loss))
+	}
+	if q.Options.NetemCorrupt != nil {
+		r.Corrupt = Ptr(fractionPercent(q.Options.NetemCorrupt.Corrupt))
+	}
+	return r
+}
+
 func PtrToString(ptr *string) string {
 	if ptr == nil {
 		return ""
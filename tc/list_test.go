@@ -0,0 +1,196 @@
+package tc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// a Runner which answers tc with canned output, keyed by the arguments; other commands fail like an old tc without -j
+type cannedRunner map[string]string
+
+func (f cannedRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	out, ok := f[strings.Join(append([]string{name}, args...), " ")]
+	if !ok {
+		return fakeFailure("Option \"-j\" is unknown, try \"tc -help\".")
+	}
+	return []byte(out), nil
+}
+
+// the decoded matches of a filter, in a form easy to compare
+func describeParsed(m *FilterMatchParsed) string {
+	s := []string{}
+	if m.SourceIPMask != nil {
+		s = append(s, "src "+m.SourceIPMask.String())
+	}
+	if m.DestIPMask != nil {
+		s = append(s, "dst "+m.DestIPMask.String())
+	}
+	if m.SourcePort != nil {
+		s = append(s, "sport "+m.SourcePort.String())
+	}
+	if m.DestPort != nil {
+		s = append(s, "dport "+m.DestPort.String())
+	}
+	if m.DSCP != nil {
+		s = append(s, fmt.Sprintf("dscp %d", *m.DSCP))
+	}
+	if m.TOS != nil {
+		s = append(s, fmt.Sprintf("tos 0x%02x", *m.TOS))
+	}
+	if m.Length != nil {
+		s = append(s, "length "+m.Length.String())
+	}
+	if m.Protocol != nil {
+		s = append(s, fmt.Sprintf("proto %d", *m.Protocol))
+	}
+	if m.TCPFlags != nil {
+		s = append(s, "flags "+m.TCPFlags.String())
+	}
+	if m.FwMark != nil {
+		s = append(s, "mark "+m.FwMark.String())
+	}
+	return strings.Join(s, " ")
+}
+
+// the keys of a u32 filter are decoded alike from the json of tc -j, which prints their values and masks in hex without leading
+// zeros, and from the text of an old tc
+func TestListFilterU32(t *testing.T) {
+	type key struct {
+		value, mask uint32
+		off         int
+	}
+	tests := []struct {
+		keys []key
+		want string
+	}{
+		// the first word of the IP header: TOS or DSCP, and the total length
+		{[]key{{0x00b80000, 0x00fc0000, 0}}, "dscp 46"},
+		{[]key{{0x00100000, 0x00ff0000, 0}}, "tos 0x10"},
+		{[]key{{0x0000003c, 0x0000ffff, 0}}, "length 60"},
+		{[]key{{0x00000400, 0x0000fc00, 0}}, "length 1024-2047"},
+		{[]key{{0x00b80040, 0x00fcffc0, 0}}, "dscp 46 length 64-127"},
+		// a TOS mask which is neither the whole byte nor the DSCP bits
+		{[]key{{0x00100000, 0x00f00000, 0}}, ""},
+		// a length mask which is no range
+		{[]key{{0x00000005, 0x00000005, 0}}, ""},
+		// the protocol, in the third byte of the word at offset 8
+		{[]key{{0x00110000, 0x00ff0000, 8}}, "proto 17"},
+		{[]key{{0x00100000, 0x00f00000, 8}}, ""},
+		// the TCP flags, in the second byte of the word at offset 32, come with protocol tcp, which the rule leaves out
+		{[]key{{0x00060000, 0x00ff0000, 8}, {0x00020000, 0x00120000, 32}}, "proto 6 flags syn,!ack"},
+		{[]key{{0x00060000, 0x00ff0000, 8}, {0x00120000, 0x00120000, 32}}, "proto 6 flags syn,ack"},
+		{[]key{{0x00000000, 0x00010000, 32}}, "flags !fin"},
+		// other bytes of the word at offset 32 are no flags
+		{[]key{{0x00000400, 0x0000ffff, 32}}, ""},
+		// the addresses and ports after them
+		{[]key{{0x00b80000, 0x00fc0000, 0}, {0x0a000000, 0xff000000, 16}, {0x00000050, 0x0000ffff, 20}}, "dst 10.0.0.0/8 dport 80 dscp 46"},
+		{[]key{{0xc0a80001, 0xffffffff, 12}, {0x04000000, 0xfc000000, 20}}, "src 192.168.0.1/32 sport 1024-2047"},
+	}
+	for _, tt := range tests {
+		matches := []string{}
+		lines := []string{}
+		for _, k := range tt.keys {
+			matches = append(matches, fmt.Sprintf(`"match":{"value":"%x","mask":"%x","offmask":"","off":%d}`, k.value, k.mask, k.off))
+			lines = append(lines, fmt.Sprintf("  match %08x/%08x at %d", k.value, k.mask, k.off))
+		}
+		jsonOut := `[{"parent":"1:","protocol":"ip","pref":100,"kind":"u32","chain":0},` +
+			`{"parent":"1:","protocol":"ip","pref":100,"kind":"u32","chain":0,"options":{"fh":"800:","ht_divisor":1}},` +
+			`{"parent":"1:","protocol":"ip","pref":100,"kind":"u32","chain":0,"options":{"fh":"800::800","order":2048,"key_ht":"800","bkt":"0","flowid":"1:4","not_in_hw":true,` +
+			strings.Join(matches, ",") + `}}]`
+		textOut := "filter parent 1: protocol ip pref 100 u32 chain 0 \n" +
+			"filter parent 1: protocol ip pref 100 u32 chain 0 fh 800: ht divisor 1 \n" +
+			"filter parent 1: protocol ip pref 100 u32 chain 0 fh 800::800 order 2048 key ht 800 bkt 0 flowid 1:4 not_in_hw \n" +
+			strings.Join(lines, "\n") + "\n"
+		for _, r := range []cannedRunner{
+			{"tc -j filter show dev eth0": jsonOut},
+			{"tc filter show dev eth0": textOut},
+		} {
+			how := "json"
+			if _, ok := r["tc filter show dev eth0"]; ok {
+				how = "text"
+			}
+			filters, err := New(WithRunner(r)).ListFilter(context.Background(), "eth0")
+			if err != nil {
+				t.Fatalf("%s %v: %v", how, tt.keys, err)
+			}
+			if len(filters) != 3 {
+				t.Fatalf("%s %v: got %d filters, want 3", how, tt.keys, len(filters))
+			}
+			f := filters[2]
+			if f.Iface != "eth0" || PtrToString(f.Kind) != "u32" || f.Pref == nil || *f.Pref != 100 || f.Options == nil ||
+				PtrToString(f.Options.FH) != "800::800" || PtrToString(f.Options.FlowId) != "1:4" || len(f.Options.Match) != len(tt.keys) {
+				t.Errorf("%s %v: filter %+v, options %+v", how, tt.keys, f, f.Options)
+				continue
+			}
+			for i, m := range f.Options.Match {
+				if want := fmt.Sprintf("%08x/%08x at %d", tt.keys[i].value, tt.keys[i].mask, tt.keys[i].off); fmt.Sprintf("%s/%s at %d", m.Value, m.Mask, m.Offset) != want {
+					t.Errorf("%s %v: match %d is %s/%s at %d, want %s", how, tt.keys, i, m.Value, m.Mask, m.Offset, want)
+				}
+			}
+			if got := describeParsed(&f.Options.MatchParsed); got != tt.want {
+				t.Errorf("%s %v: decoded as %q, want %q", how, tt.keys, got, tt.want)
+			}
+		}
+	}
+}
+
+// fw filters have the mark as their handle: tc -j prints it as an object with the mark and its mask, and the flow as classid
+func TestListFilterFw(t *testing.T) {
+	tests := []struct {
+		json string
+		text string
+		want string
+	}{
+		{`{"fh":{"mark":"0x10"},"classid":"1:4"}`, "handle 0x10 classid 1:4", "0x10"},
+		{`{"fh":{"mark":16},"classid":"1:4"}`, "handle 16 classid 1:4", "0x10"},
+		{`{"fh":{"mark":"0x10","mask":"0xff"},"classid":"1:4"}`, "handle 0x10/0xff classid 1:4", "0x10/0xff"},
+		{`{"fh":"0x10","flowid":"1:4"}`, "handle 0x10 flowid 1:4", "0x10"},
+	}
+	for _, tt := range tests {
+		for _, r := range []cannedRunner{
+			{"tc -j filter show dev eth0": `[{"parent":"1:","protocol":"all","pref":50,"kind":"fw","chain":0,"options":` + tt.json + `}]`},
+			{"tc filter show dev eth0": "filter parent 1: protocol all pref 50 fw chain 0 " + tt.text + " \n"},
+		} {
+			filters, err := New(WithRunner(r)).ListFilter(context.Background(), "eth0")
+			if err != nil {
+				t.Fatalf("%s: %v", tt.json, err)
+			}
+			if len(filters) != 1 || filters[0].Options == nil {
+				t.Fatalf("%s: got filters %+v", tt.json, filters)
+			}
+			o := filters[0].Options
+			if PtrToString(o.FH) != tt.want || PtrToString(o.FlowId) != "1:4" || describeParsed(&o.MatchParsed) != "mark "+tt.want {
+				t.Errorf("%s / %s: handle %s, flow %s, decoded as %q, want handle %s", tt.json, tt.text, PtrToString(o.FH), PtrToString(o.FlowId),
+					describeParsed(&o.MatchParsed), tt.want)
+			}
+		}
+	}
+}
+
+// the qdiscs of an old tc without json
+func TestListQdiscText(t *testing.T) {
+	r := cannedRunner{"tc qdisc show": "qdisc noqueue 0: dev lo root refcnt 2 \n" +
+		"qdisc prio 1: dev eth0 root refcnt 2 bands 16 priomap 2 2 2 2 2 2 2 2 2 2 2 2 2 2 2 2\n" +
+		"qdisc netem 10: dev eth0 parent 1:4 limit 1000 delay 100ms  10ms loss 0.5% rate 10Mbit seed 123\n"}
+	qdiscs, err := New(WithRunner(r)).ListQdisc(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(qdiscs) != 3 {
+		t.Fatalf("got %d qdiscs, want 3", len(qdiscs))
+	}
+	prio := qdiscs[1]
+	if PtrToString(prio.Kind) != "prio" || PtrToString(prio.Handle) != "1:" || PtrToString(prio.Dev) != "eth0" || prio.Root == nil || !*prio.Root ||
+		prio.Options == nil || prio.Options.PrioBands == nil || *prio.Options.PrioBands != 16 || prio.Options.PrioMap == nil || len(*prio.Options.PrioMap) != 16 {
+		t.Errorf("root qdisc %+v, options %+v", prio, prio.Options)
+	}
+	netem := qdiscs[2]
+	if PtrToString(netem.Kind) != "netem" || PtrToString(netem.Parent) != "1:4" || netem.Options == nil {
+		t.Fatalf("netem qdisc %+v", netem)
+	}
+	if got := describeActions(netemRule(netem)); got != "latency 100ms, jitter 10ms, loss 0.5, rate 10000000bit" {
+		t.Errorf("netem qdisc read as %q", got)
+	}
+}
@@ -0,0 +1,118 @@
+package tc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// default time to wait for another process or goroutine to finish changing tc rules
+const defaultLockTimeout = 30 * time.Second
+
+// how often a lock held by another process is retried
+const lockRetry = 50 * time.Millisecond
+
+// one semaphore per lock file, serializing goroutines of this process before they take the file lock
+var lockSems sync.Map
+
+// take the advisory lock of the client's network namespace, held while tc rules are read, computed and changed;
+// the returned function releases it
+func (c *Client) lock(ctx context.Context) (unlock func(), err error) {
+	if c.recorder() != nil {
+		// a dry run changes nothing
+		return func() {}, nil
+	}
+	dir, err := c.nsStateDir()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "lock")
+	lctx, cancel := context.WithTimeout(ctx, c.lockTimeout)
+	defer cancel()
+
+	semv, _ := lockSems.LoadOrStore(path, make(chan struct{}, 1))
+	sem := semv.(chan struct{})
+	select {
+	case sem <- struct{}{}:
+	case <-lctx.Done():
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("%w: %s is held by another goroutine of this process after waiting %s", ErrLocked, path, c.lockTimeout)
+	}
+
+	f, err := openLockFile(dir, path)
+	if err != nil {
+		<-sem
+		return nil, err
+	}
+	start := time.Now()
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			f.Close()
+			<-sem
+			return nil, fmt.Errorf("locking %s: %w", path, err)
+		}
+		select {
+		case <-time.After(lockRetry):
+			continue
+		case <-lctx.Done():
+		}
+		holder := lockHolder(path)
+		f.Close()
+		<-sem
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("%w: %s is held by %s after waiting %s", ErrLocked, path, holder, c.lockTimeout)
+	}
+	c.log.Debug("locked", "path", path, "waited", time.Since(start))
+
+	// record the holder, for the error message of whoever waits for it
+	if f.Truncate(0) == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+		<-sem
+		c.log.Debug("unlocked", "path", path)
+	}, nil
+}
+
+func openLockFile(dir string, path string) (*os.File, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		if errors.Is(err, fs.ErrPermission) {
+			return nil, fmt.Errorf("%w: %s", ErrPermissionDenied, err)
+		}
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if errors.Is(err, fs.ErrPermission) {
+		return nil, fmt.Errorf("%w: %s", ErrPermissionDenied, err)
+	}
+	return f, err
+}
+
+// process holding a lock, as recorded in the lock file
+func lockHolder(path string) string {
+	data, err := os.ReadFile(path)
+	pid := strings.TrimSpace(string(data))
+	if err != nil || pid == "" {
+		return "another process"
+	}
+	return "pid " + pid
+}
@@ -0,0 +1,197 @@
+package tc
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// TCP flags which must be set (in Mask and Value) or unset (in Mask only); flags which are not in Mask are ignored
+type TCPFlags struct {
+	Value uint8
+	Mask  uint8
+}
+
+// TCP flag bits, in the order of the TCP header
+var tcpFlagNames = []string{"fin", "syn", "rst", "psh", "ack", "urg", "ece", "cwr"}
+
+// parse comma separated TCP flag names, which must be set, or unset with a leading '!': "syn,!ack" matches connection requests,
+// "syn,ack" their replies
+func ParseTCPFlags(s string) (TCPFlags, error) {
+	f := TCPFlags{}
+	for _, name := range strings.Split(s, ",") {
+		unset := strings.HasPrefix(name, "!")
+		bit := -1
+		for i, n := range tcpFlagNames {
+			if n == strings.ToLower(strings.TrimPrefix(name, "!")) {
+				bit = i
+			}
+		}
+		if bit < 0 {
+			return TCPFlags{}, fmt.Errorf("invalid TCP flag %q, must be one of %s, or unset with a leading '!'", name, strings.Join(tcpFlagNames, ","))
+		}
+		f.Mask |= 1 << bit
+		if !unset {
+			f.Value |= 1 << bit
+		}
+	}
+	return f, nil
+}
+
+func (f TCPFlags) String() string {
+	names := []string{}
+	for i, n := range tcpFlagNames {
+		switch {
+		case f.Mask&(1<<i) == 0:
+		case f.Value&(1<<i) != 0:
+			names = append(names, n)
+		default:
+			names = append(names, "!"+n)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func (f TCPFlags) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+func (f *TCPFlags) UnmarshalText(text []byte) error {
+	p, err := ParseTCPFlags(string(text))
+	if err != nil {
+		return err
+	}
+	*f = p
+	return nil
+}
+
+// DSCP class names
+var dscpNames = map[string]uint8{
+	"cs0": 0, "cs1": 8, "cs2": 16, "cs3": 24, "cs4": 32, "cs5": 40, "cs6": 48, "cs7": 56,
+	"af11": 10, "af12": 12, "af13": 14,
+	"af21": 18, "af22": 20, "af23": 22,
+	"af31": 26, "af32": 28, "af33": 30,
+	"af41": 34, "af42": 36, "af43": 38,
+	"ef": 46,
+}
+
+// parse a DSCP value, 0-63, or a class name such as "ef" or "af41"
+func ParseDSCP(s string) (uint8, error) {
+	if v, ok := dscpNames[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.ParseUint(s, 0, 8)
+	if err != nil || v > 63 {
+		return 0, fmt.Errorf("invalid DSCP %q, must be 0-63 or a class name such as ef or af41", s)
+	}
+	return uint8(v), nil
+}
+
+// u32 offsets of the matches on the first words of the IP header, and of the TCP flags of packets without IP options
+const (
+	offsetTOSLength = 0
+	offsetProtocol  = 8
+	offsetTCPFlags  = 33
+	protocolTCP     = 6
+)
+
+// decode a u32 key on the first IP header word into the TOS or DSCP, and the total length
+func (m *FilterMatchParsed) parseTOSLength(value uint32, mask uint32) {
+	tos, tosMask := uint8(value>>16), uint8(mask>>16)
+	switch tosMask {
+	case 0xfc:
+		m.DSCP = Ptr(tos >> 2)
+	case 0xff:
+		m.TOS = Ptr(tos)
+	}
+	if mask&0xffff != 0 {
+		if length, ok := portRangeFromMask(uint16(value), uint16(mask)); ok {
+			m.Length = &length
+		}
+	}
+}
+
+// decode a u32 key on the word holding the TCP flags, at offset 32
+func (m *FilterMatchParsed) parseTCPFlags(value uint32, mask uint32) {
+	if flagsMask := uint8(mask >> 16); flagsMask != 0 {
+		m.TCPFlags = &TCPFlags{Value: uint8(value>>16) & flagsMask, Mask: flagsMask}
+	}
+}
+
+// the protocol of a u32 filter, unless it only comes with its TCP flags
+func (m *FilterMatchParsed) protocol() *uint8 {
+	if m.TCPFlags != nil && m.Protocol != nil && *m.Protocol == protocolTCP {
+		return nil
+	}
+	return m.Protocol
+}
+
+// IP protocol names
+var protocolNames = map[string]uint8{"icmp": 1, "igmp": 2, "tcp": 6, "udp": 17, "gre": 47, "esp": 50, "ah": 51, "sctp": 132}
+
+// parse an IP protocol number, 0-255, or a name such as tcp, udp or icmp
+func ParseProtocol(s string) (uint8, error) {
+	if v, ok := protocolNames[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid protocol %q, must be 0-255 or a name such as tcp, udp or icmp", s)
+	}
+	return uint8(v), nil
+}
+
+// the name of an IP protocol, or its number
+func ProtocolName(p uint8) string {
+	for name, v := range protocolNames {
+		if v == p {
+			return name
+		}
+	}
+	return strconv.Itoa(int(p))
+}
+
+// a firewall mark, as set by iptables or nftables, matched under a mask; a full mask matches the whole mark
+type FwMark struct {
+	Value uint32
+	Mask  uint32
+}
+
+// parse a mark with an optional mask, in hex or decimal: "0x10", "0x10/0xff"
+func ParseFwMark(s string) (FwMark, error) {
+	value, mask, hasMask := strings.Cut(s, "/")
+	v, err := strconv.ParseUint(value, 0, 32)
+	if err != nil {
+		return FwMark{}, fmt.Errorf("invalid firewall mark %q, must be a number with an optional mask, such as 0x10/0xff", s)
+	}
+	m := uint64(math.MaxUint32)
+	if hasMask {
+		m, err = strconv.ParseUint(mask, 0, 32)
+		if err != nil {
+			return FwMark{}, fmt.Errorf("invalid firewall mark mask %q", mask)
+		}
+	}
+	return FwMark{Value: uint32(v), Mask: uint32(m)}, nil
+}
+
+// the mark in the form of a fw filter handle
+func (m FwMark) String() string {
+	if m.Mask == math.MaxUint32 {
+		return fmt.Sprintf("0x%x", m.Value)
+	}
+	return fmt.Sprintf("0x%x/0x%x", m.Value, m.Mask)
+}
+
+func (m FwMark) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *FwMark) UnmarshalText(text []byte) error {
+	p, err := ParseFwMark(string(text))
+	if err != nil {
+		return err
+	}
+	*m = p
+	return nil
+}
@@ -0,0 +1,212 @@
+package tc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// identity of a rule, which tc cannot store; kept in the state file of its interface, by filter handle
+type ruleMeta struct {
+	ID     string            `json:"id,omitempty"`
+	Name   string            `json:"name,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// the matches of the filter, so that a handle reused by another filter is not mistaken for the rule
+	Match string `json:"match"`
+	// pass-through filters: the ID of the rule they are an exception of, or whether they are protected
+	Owner     string `json:"owner,omitempty"`
+	Protected bool   `json:"protected,omitempty"`
+	// fw filters: the nftables expression of the rule which sets the mark, and the cgroup it matches
+	Nft    string `json:"nft,omitempty"`
+	Cgroup string `json:"cgroup,omitempty"`
+	// the distribution table of the netem qdisc, which tc does not list
+	Distribution string `json:"distribution,omitempty"`
+}
+
+var (
+	nameRe       = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+	labelKeyRe   = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+	labelValueRe = regexp.MustCompile(`^[A-Za-z0-9._-]*$`)
+)
+
+// whether the rule has all the given labels
+func (r *Rule) HasLabels(labels map[string]string) bool {
+	for k, v := range labels {
+		if have, ok := r.Labels[k]; !ok || have != v {
+			return false
+		}
+	}
+	return true
+}
+
+// key=value pairs of the labels of a rule, sorted by key
+func (r *Rule) LabelString() string {
+	pairs := []string{}
+	for k, v := range r.Labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	slices.Sort(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func matchKey(r *Rule) string {
+	if r.FwMark != nil {
+		return "fw " + r.FwMark.String()
+	}
+	return strings.Join(matchArgs(r), " ")
+}
+
+func newRuleID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// fill in the identity of the rules from the state files of their interfaces
+func (c *Client) readMeta(rules *Rules) error {
+	states := make(map[string]*ifaceState)
+	for _, rule := range rules.Rules {
+		if rule.Iface == nil || rule.FilterHandle == nil {
+			continue
+		}
+		state, ok := states[*rule.Iface]
+		if !ok {
+			var err error
+			state, err = c.readState(*rule.Iface)
+			if err != nil {
+				return err
+			}
+			states[*rule.Iface] = state
+		}
+		if state == nil {
+			continue
+		}
+		meta := state.Rules[*rule.FilterHandle]
+		if meta == nil || meta.Match != matchKey(rule) {
+			continue
+		}
+		if rule.PassThrough {
+			if meta.Owner != "" {
+				rule.ExceptionOf = Ptr(meta.Owner)
+			}
+			rule.Protected = meta.Protected
+			continue
+		}
+		rule.ID = Ptr(meta.ID)
+		if meta.Name != "" {
+			rule.Name = Ptr(meta.Name)
+		}
+		rule.Labels = meta.Labels
+		if meta.Nft != "" {
+			rule.NftMatch = Ptr(meta.Nft)
+		}
+		if meta.Cgroup != "" {
+			rule.Cgroup = Ptr(meta.Cgroup)
+		}
+		// a qdisc without jitter was replaced by one without the distribution
+		if meta.Distribution != "" && rule.Jitter != nil {
+			rule.Distribution = Ptr(meta.Distribution)
+		}
+	}
+	return nil
+}
+
+// record the identity of a rule which was set with the filter handle fh; the name and labels are kept unless r sets them,
+// the distribution is the one of r, whose actions replaced the previous ones. A created filter gets a new ID, even if its
+// handle was used by an earlier filter with the same matches.
+func (c *Client) writeMeta(iface string, fh string, r *Rule, created bool) error {
+	return c.changeMeta(iface, fh, func(meta *ruleMeta) *ruleMeta {
+		if created || meta == nil || meta.Match != matchKey(r) {
+			meta = &ruleMeta{ID: newRuleID(), Match: matchKey(r)}
+		}
+		if r.Name != nil {
+			meta.Name = *r.Name
+		}
+		if r.Labels != nil {
+			meta.Labels = r.Labels
+		}
+		if r.NftMatch != nil {
+			meta.Nft = *r.NftMatch
+		}
+		if r.Cgroup != nil {
+			meta.Cgroup = *r.Cgroup
+		}
+		meta.Distribution = PtrToString(r.Distribution)
+		r.ID = Ptr(meta.ID)
+		return meta
+	})
+}
+
+// forget the identity of a deleted filter
+func (c *Client) dropMeta(iface string, fh string) error {
+	return c.changeMeta(iface, fh, func(*ruleMeta) *ruleMeta {
+		return nil
+	})
+}
+
+// move the identity of a filter which was added again with another handle; an fw filter keeps its handle, the mark
+func (c *Client) moveMeta(iface string, from string, to string) error {
+	if from == to {
+		return nil
+	}
+	state, err := c.readState(iface)
+	if err != nil || state == nil || state.Rules[from] == nil {
+		return err
+	}
+	state.Rules[to] = state.Rules[from]
+	delete(state.Rules, from)
+	return c.writeState(state)
+}
+
+// replace the identity of the filter fh in the state file of its interface with the result of fn, which removes it if nil
+func (c *Client) changeMeta(iface string, fh string, fn func(meta *ruleMeta) *ruleMeta) error {
+	state, err := c.readState(iface)
+	if err != nil || state == nil {
+		return err
+	}
+	meta := fn(state.Rules[fh])
+	if meta == nil {
+		if state.Rules[fh] == nil {
+			return nil
+		}
+		delete(state.Rules, fh)
+		return c.writeState(state)
+	}
+	if state.Rules == nil {
+		state.Rules = make(map[string]*ruleMeta)
+	}
+	state.Rules[fh] = meta
+	return c.writeState(state)
+}
+
+// handle of the filter which was just added for r, found among the filters of its interface which were not there before;
+// an fw filter which moved to another priority is added again with the same handle, the mark, so the priority is compared too
+func (c *Client) addedFilterHandle(ctx context.Context, r *Rule, rules *Rules) (string, error) {
+	filters, err := c.ListFilter(ctx, *r.Iface)
+	if err != nil {
+		return "", err
+	}
+	before := ownFilters(rules, *r.Iface)
+	for _, f := range filters {
+		if f.Options == nil || f.Options.FH == nil || f.Options.FlowId == nil || hadFilter(before, f) {
+			continue
+		}
+		if sameFilter(filterRule(f), r) && *f.Options.FlowId == *r.FlowID {
+			return *f.Options.FH, nil
+		}
+	}
+	return "", fmt.Errorf("cannot find the filter which was added to interface %s", *r.Iface)
+}
+
+func hadFilter(before []*Filter, f *Filter) bool {
+	for _, b := range before {
+		if *b.Options.FH == *f.Options.FH && equalPtr(b.Pref, f.Pref) {
+			return true
+		}
+	}
+	return false
+}
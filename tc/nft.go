@@ -0,0 +1,140 @@
+package tc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// the nftables rules which set the marks of fw rules are in a table of their own, in a chain of the postrouting hook, which runs
+// before the root qdisc classifies a packet; each is tagged with a comment naming the interface and mark of its rule
+const (
+	nftTable = "easytc"
+	nftChain = "postrouting"
+)
+
+// run nft in the client's namespace
+func (c *Client) nft(ctx context.Context, args ...string) ([]byte, error) {
+	return c.runInNamespace(ctx, c.nftPath, args...)
+}
+
+// the comment of the nftables rule of a fw rule
+func nftComment(iface string, mark FwMark) string {
+	return "easytc " + iface + " " + mark.String()
+}
+
+// whether a listed nftables rule is the one of a fw rule, or one of the interface if mark is nil
+func isNftRuleOf(rule string, iface string, mark *FwMark) bool {
+	if mark == nil {
+		return strings.Contains(rule, `comment "easytc `+iface+` `)
+	}
+	return strings.Contains(rule, `comment "`+nftComment(iface, *mark)+`"`)
+}
+
+// replace the nftables rule of a fw rule which was set on its interface by the one of r, unless r gives none or the same
+func (c *Client) setNft(ctx context.Context, r *Rule, existing *Rule) error {
+	if r.FwMark == nil || r.NftMatch == nil || (existing != nil && equalPtr(existing.NftMatch, r.NftMatch)) {
+		return nil
+	}
+	if existing != nil && existing.NftMatch != nil {
+		err := c.dropNft(ctx, *r.Iface, r.FwMark)
+		if err != nil {
+			return err
+		}
+	}
+	if *r.NftMatch == "" {
+		return nil
+	}
+	return c.addNft(ctx, *r.Iface, *r.FwMark, *r.NftMatch, nftChainOf(r.Cgroup != nil))
+}
+
+// add an nftables rule to chain which sets mark on the packets leaving iface which match expr, and the table and chain if they are missing
+func (c *Client) addNft(ctx context.Context, iface string, mark FwMark, expr string, chain string) error {
+	_, err := c.nft(ctx, "add", "table", "inet", nftTable)
+	if err != nil {
+		return err
+	}
+	_, err = c.nft(ctx, "add", "chain", "inet", nftTable, chain, "{ type filter hook "+chain+" priority mangle; }")
+	if err != nil {
+		return err
+	}
+	// only the bits of the mask are set, the others are kept for whoever else uses the mark
+	set := []string{"meta", "mark", "set", fmt.Sprintf("0x%x", mark.Value)}
+	if mark.Mask != ^uint32(0) {
+		set = []string{"meta", "mark", "set", "meta", "mark", "and", fmt.Sprintf("0x%x", ^mark.Mask), "or", fmt.Sprintf("0x%x", mark.Value)}
+	}
+	args := append([]string{"add", "rule", "inet", nftTable, chain, "oifname", strconv.Quote(iface), expr}, set...)
+	_, err = c.nft(ctx, append(args, "comment", strconv.Quote(nftComment(iface, mark)))...)
+	return err
+}
+
+// delete the nftables rule of a fw rule, or all of the interface if mark is nil
+func (c *Client) dropNft(ctx context.Context, iface string, mark *FwMark) error {
+	for _, chain := range []string{nftChain, nftOutputChain} {
+		out, err := c.nft(ctx, "-a", "list", "chain", "inet", nftTable, chain)
+		if err != nil {
+			// no table or chain, no rules
+			var cerr *CommandError
+			if errors.As(err, &cerr) && strings.Contains(cerr.Stderr, "No such file or directory") {
+				continue
+			}
+			return err
+		}
+		for _, line := range outputLines(out) {
+			rule, handle, ok := strings.Cut(line, " # handle ")
+			if !ok || !isNftRuleOf(rule, iface, mark) {
+				continue
+			}
+			_, err = c.nft(ctx, "delete", "rule", "inet", nftTable, chain, "handle", strings.TrimSpace(handle))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// whether the rules of a state file have nftables rules
+func hasNft(state *ifaceState) bool {
+	if state == nil {
+		return false
+	}
+	for _, meta := range state.Rules {
+		if meta.Nft != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// put back the nftables rules of an interface as recorded in its state file before a change, if it or the current state has any;
+// fw filter handles are their marks
+func (c *Client) rollbackNft(ctx context.Context, iface string, before *txSnapshot) error {
+	now, err := c.readState(iface)
+	if err != nil {
+		return err
+	}
+	if !hasNft(now) && !hasNft(before.states[iface]) {
+		return nil
+	}
+	err = c.dropNft(ctx, iface, nil)
+	if err != nil || before.states[iface] == nil {
+		return err
+	}
+	for fh, meta := range before.states[iface].Rules {
+		if meta.Nft == "" {
+			continue
+		}
+		mark, err := ParseFwMark(fh)
+		if err != nil {
+			continue
+		}
+		err = c.addNft(ctx, iface, mark, meta.Nft, nftChainOf(meta.Cgroup != ""))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,385 @@
+package tc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// default directory for the ownership state of interfaces; /run is cleared on reboot, as are qdiscs
+const defaultStateDir = "/run/easytc"
+
+// ownership of the qdisc tree of an interface; the state file exists while easytc owns the root qdisc
+type ifaceState struct {
+	Iface string `json:"iface"`
+	// the foreign qdisc tree which was adopted; nil if the interface had the kernel default, which comes back by itself
+	Snapshot *treeSnapshot `json:"snapshot,omitempty"`
+	// identity of the rules, by filter handle
+	Rules map[string]*ruleMeta `json:"rules,omitempty"`
+}
+
+// qdiscs and classes of an interface, as printed by tc qdisc show and tc class show
+type treeSnapshot struct {
+	Qdiscs  []string `json:"qdiscs"`
+	Classes []string `json:"classes"`
+}
+
+// directory of the state files of the client's network namespace, named after the namespace inode
+func (c *Client) nsStateDir() (string, error) {
+	path := "/proc/self/ns/net"
+	if c.namespace != "" {
+		path = "/run/netns/" + c.namespace
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) && c.namespace != "" {
+			return "", fmt.Errorf("network namespace %s: %w", c.namespace, err)
+		}
+		return "", err
+	}
+	sys, ok := st.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("cannot identify network namespace %s", path)
+	}
+	return filepath.Join(c.stateDir, "net-"+strconv.FormatUint(sys.Ino, 10)), nil
+}
+
+func (c *Client) statePath(iface string) (string, error) {
+	dir, err := c.nsStateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, iface+".json"), nil
+}
+
+// state of an interface; nil if easytc does not own its root qdisc
+func (c *Client) readState(iface string) (*ifaceState, error) {
+	path, err := c.statePath(iface)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &ifaceState{}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return state, nil
+}
+
+// write the state file of an interface, atomically
+func (c *Client) writeState(state *ifaceState) error {
+	if c.recorder() != nil {
+		return nil
+	}
+	path, err := c.statePath(state.Iface)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = os.WriteFile(path+".tmp", data, 0644)
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if errors.Is(err, fs.ErrPermission) {
+		return fmt.Errorf("%w: %s", ErrPermissionDenied, err)
+	}
+	return err
+}
+
+func (c *Client) removeState(iface string) error {
+	if c.recorder() != nil {
+		return nil
+	}
+	path, err := c.statePath(iface)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// whether a root qdisc was created by the kernel; those have handle 0: and come back when the root qdisc is deleted
+func isDefaultRoot(q *Qdisc) bool {
+	return q == nil || q.Kind == nil || PtrToString(q.Handle) == "0:"
+}
+
+// make sure easytc owns the root qdisc of an interface, creating its prio qdisc if the interface has the kernel default
+func (c *Client) initRoot(ctx context.Context, iface string, qdiscs []*Qdisc) error {
+	root := rootQdisc(qdiscs, iface)
+	state, err := c.readState(iface)
+	if err != nil {
+		return err
+	}
+	if isOwnRoot(root) {
+		if state == nil {
+			// created by an earlier version, which did not record ownership
+			c.log.Debug("claiming existing easytc root qdisc", "iface", iface)
+			return c.writeState(&ifaceState{Iface: iface})
+		}
+		return nil
+	}
+	if !isDefaultRoot(root) {
+		return fmt.Errorf("%w: interface %s has root qdisc %s %s; adopt it to replace it and restore it on reset", ErrForeignQdisc, iface, *root.Kind, PtrToString(root.Handle))
+	}
+	// record ownership first, so that reset can clean up if adding the qdisc fails half way; keep the snapshot of a tree which was adopted earlier
+	if state == nil {
+		state = &ifaceState{Iface: iface}
+	}
+	err = c.writeState(state)
+	if err != nil {
+		return err
+	}
+	c.log.Debug("creating root qdisc", "iface", iface)
+	return c.tcExec(ctx, "qdisc", "add", "dev", iface, "root", "handle", "1:", "prio", "bands", strconv.Itoa(prioBands), "priomap", "2", "2", "2", "2", "2", "2", "2", "2", "2", "2", "2", "2", "2", "2", "2", "2")
+}
+
+// replace foreign root qdiscs with the easytc prio qdisc, after taking a snapshot which Reset restores;
+// if interface is not given, adopts all interfaces; trees with filters are refused, as those cannot be restored exactly
+func (c *Client) Adopt(ctx context.Context, iface *string) error {
+	unlock, err := c.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	rules, err := c.ListRules(ctx)
+	if err != nil {
+		return err
+	}
+	ifaces, err := rules.selectIfaces(iface)
+	if err != nil {
+		return err
+	}
+	for _, i := range ifaces {
+		root := rootQdisc(rules.Qdisc, i)
+		if isOwnRoot(root) || isDefaultRoot(root) {
+			err = c.initRoot(ctx, i, rules.Qdisc)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		snap, err := c.snapshot(ctx, i)
+		if err != nil {
+			return err
+		}
+		c.log.Debug("adopting root qdisc", "iface", i, "snapshot", snap)
+		err = c.writeState(&ifaceState{Iface: i, Snapshot: snap})
+		if err != nil {
+			return err
+		}
+		err = c.tcExec(ctx, "qdisc", "del", "dev", i, "root")
+		if err != nil {
+			return err
+		}
+		err = c.initRoot(ctx, i, nil)
+		if err != nil {
+			// put the adopted tree back; if that fails too, Reset retries from the state file
+			if c.restore(ctx, i, snap) == nil {
+				c.removeState(i)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshot of the qdisc tree of an interface
+func (c *Client) snapshot(ctx context.Context, iface string) (*treeSnapshot, error) {
+	out, err := c.tc(ctx, "filter", "show", "dev", iface)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(string(out)) != "" {
+		return nil, fmt.Errorf("%w: the root qdisc of interface %s has filters, which cannot be restored exactly; remove them first", ErrForeignQdisc, iface)
+	}
+	snap := &treeSnapshot{}
+	out, err = c.tc(ctx, "qdisc", "show", "dev", iface)
+	if err != nil {
+		return nil, err
+	}
+	snap.Qdiscs = outputLines(out)
+	out, err = c.tc(ctx, "class", "show", "dev", iface)
+	if err != nil {
+		return nil, err
+	}
+	snap.Classes = outputLines(out)
+	return snap, nil
+}
+
+func outputLines(out []byte) []string {
+	lines := []string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// qdiscs kinds whose classes are created with tc class add; the classes of other kinds are implicit
+var classfulKinds = []string{"htb", "hfsc", "drr", "qfq"}
+
+// recreate an adopted qdisc tree, and check that tc shows the same tree as before
+func (c *Client) restore(ctx context.Context, iface string, snap *treeSnapshot) error {
+	qdiscs := [][]string{}
+	for _, line := range snap.Qdiscs {
+		q := strings.Fields(line)
+		// qdiscs with handle 0: are created by the kernel with their parent, ingress and clsact are not part of the root tree
+		if len(q) < 4 || q[2] == "0:" || q[1] == "ingress" || q[1] == "clsact" {
+			continue
+		}
+		qdiscs = append(qdiscs, q)
+	}
+	created := []string{}
+	for _, q := range qdiscs {
+		if q[3] != "root" {
+			continue
+		}
+		kind, handle, opts := q[1], q[2], restoreOptions(q[4:])
+		err := c.tcExec(ctx, append([]string{"qdisc", "add", "dev", iface, "root", "handle", handle, kind}, opts...)...)
+		if err != nil {
+			return err
+		}
+		created = append(created, handle)
+		if slices.Contains(classfulKinds, kind) {
+			err = c.restoreClasses(ctx, iface, kind, handle, snap.Classes, &created)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// child qdiscs, after their parent class or qdisc
+	for pending := qdiscs; len(pending) > 0; {
+		next := [][]string{}
+		for _, q := range pending {
+			if q[3] != "parent" || len(q) < 5 {
+				continue
+			}
+			if !slices.Contains(created, q[4]) && !slices.Contains(created, majorHandle(q[4])) {
+				next = append(next, q)
+				continue
+			}
+			err := c.tcExec(ctx, append([]string{"qdisc", "add", "dev", iface, "parent", q[4], "handle", q[2], q[1]}, restoreOptions(q[5:])...)...)
+			if err != nil {
+				return err
+			}
+			created = append(created, q[2])
+		}
+		if len(next) == len(pending) {
+			return fmt.Errorf("cannot restore qdiscs of interface %s, their parents do not exist: %v", iface, next)
+		}
+		pending = next
+	}
+
+	out, err := c.tc(ctx, "qdisc", "show", "dev", iface)
+	if err != nil {
+		return err
+	}
+	if !sameLines(outputLines(out), snap.Qdiscs) {
+		return fmt.Errorf("restored qdiscs of interface %s differ from the snapshot: %v, expected %v", iface, outputLines(out), snap.Qdiscs)
+	}
+	out, err = c.tc(ctx, "class", "show", "dev", iface)
+	if err != nil {
+		return err
+	}
+	if !sameLines(outputLines(out), snap.Classes) {
+		return fmt.Errorf("restored classes of interface %s differ from the snapshot: %v, expected %v", iface, outputLines(out), snap.Classes)
+	}
+	return nil
+}
+
+// add the classes of a classful qdisc, parents first
+func (c *Client) restoreClasses(ctx context.Context, iface string, kind string, handle string, classes []string, created *[]string) error {
+	pending := [][]string{}
+	for _, line := range classes {
+		cl := strings.Fields(line)
+		if len(cl) < 4 || cl[1] != kind || majorHandle(cl[2]) != handle {
+			continue
+		}
+		pending = append(pending, cl)
+	}
+	for len(pending) > 0 {
+		next := [][]string{}
+		for _, cl := range pending {
+			parent, opts := handle, cl[4:]
+			if cl[3] == "parent" && len(cl) > 4 {
+				parent, opts = cl[4], cl[5:]
+			}
+			if !slices.Contains(*created, parent) {
+				next = append(next, cl)
+				continue
+			}
+			err := c.tcExec(ctx, append([]string{"class", "add", "dev", iface, "parent", parent, "classid", cl[2], kind}, restoreOptions(opts)...)...)
+			if err != nil {
+				return err
+			}
+			*created = append(*created, cl[2])
+		}
+		if len(next) == len(pending) {
+			return fmt.Errorf("cannot restore classes of interface %s, their parents do not exist: %v", iface, next)
+		}
+		pending = next
+	}
+	return nil
+}
+
+// turn options printed by tc show into options tc add accepts
+func restoreOptions(opts []string) []string {
+	params := []string{}
+	for i := 0; i < len(opts); i++ {
+		switch opts[i] {
+		case "refcnt", "leaf", "direct_packets_stat":
+			// read-only values
+			i++
+			continue
+		}
+		// packet counts are printed with a p suffix
+		if n, ok := strings.CutSuffix(opts[i], "p"); ok {
+			if _, err := strconv.ParseUint(n, 10, 64); err == nil {
+				params = append(params, n)
+				continue
+			}
+		}
+		params = append(params, opts[i])
+	}
+	return params
+}
+
+// major handle of a class or qdisc handle, for example 1: for 1:10
+func majorHandle(handle string) string {
+	major, _, _ := strings.Cut(handle, ":")
+	return major + ":"
+}
+
+// compare lines regardless of their order; tc lists classes in hash order
+func sameLines(a []string, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
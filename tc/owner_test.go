@@ -0,0 +1,199 @@
+package tc
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRestoreOptions(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"refcnt 2 r2q 10 default 0x10 direct_packets_stat 0 direct_qlen 1000", "r2q 10 default 0x10 direct_qlen 1000"},
+		// packet counts lose their p suffix
+		{"limit 10240p flows 1024 quantum 1514 target 5ms interval 100ms memory_limit 32Mb ecn drop_batch 64",
+			"limit 10240 flows 1024 quantum 1514 target 5ms interval 100ms memory_limit 32Mb ecn drop_batch 64"},
+		{"leaf 10: prio 0 rate 10Mbit ceil 10Mbit burst 1600b cburst 1600b", "prio 0 rate 10Mbit ceil 10Mbit burst 1600b cburst 1600b"},
+		{"limit 100p drop p 0xp", "limit 100 drop p 0xp"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(restoreOptions(strings.Fields(tt.in)), " "); got != tt.want {
+			t.Errorf("restoreOptions(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// a Runner which keeps the qdiscs and classes of one interface as the lines tc prints for them; the qdiscs and classes which may be
+// added are given with the lines they make
+type treeRunner struct {
+	dev      string
+	others   []string
+	qdiscs   []string
+	classes  []string
+	filters  string
+	adds     map[string][]string
+	commands []string
+}
+
+func (f *treeRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	cmd := strings.Join(args, " ")
+	f.commands = append(f.commands, cmd)
+	if name != "tc" {
+		return fakeFailure("%s: command not found", name)
+	}
+	switch {
+	case strings.HasPrefix(cmd, "-j "):
+		return fakeFailure("Option \"-j\" is unknown, try \"tc -help\".")
+	case cmd == "qdisc show":
+		lines := []string{}
+		for _, q := range f.qdiscs {
+			// "qdisc <kind> <handle> dev <dev> ..."
+			fields := strings.SplitN(q, " ", 4)
+			lines = append(lines, strings.Join(fields[:3], " ")+" dev "+f.dev+" "+fields[3])
+		}
+		for _, dev := range f.others {
+			lines = append(lines, "qdisc noqueue 0: dev "+dev+" root refcnt 2")
+		}
+		return []byte(strings.Join(lines, "\n") + "\n"), nil
+	case strings.HasPrefix(cmd, "filter show dev "):
+		if strings.HasSuffix(cmd, " "+f.dev) {
+			return []byte(f.filters), nil
+		}
+		return nil, nil
+	case cmd == "qdisc show dev "+f.dev:
+		return []byte(strings.Join(f.qdiscs, "\n") + "\n"), nil
+	case cmd == "class show dev "+f.dev:
+		return []byte(strings.Join(f.classes, "\n") + "\n"), nil
+	case cmd == "qdisc del dev "+f.dev+" root":
+		// the ingress qdisc is not part of the root tree
+		f.qdiscs = slices.DeleteFunc(f.qdiscs, func(q string) bool {
+			return !strings.HasPrefix(q, "qdisc ingress ")
+		})
+		f.qdiscs = append([]string{"qdisc noqueue 0: root refcnt 2"}, f.qdiscs...)
+		f.classes = nil
+		return nil, nil
+	case strings.HasPrefix(cmd, "qdisc add dev "+f.dev+" root handle 1: prio bands 16 "):
+		f.qdiscs[0] = "qdisc prio 1: root refcnt 2 bands 16 priomap 2 2 2 2 2 2 2 2 2 2 2 2 2 2 2 2"
+		return nil, nil
+	}
+	lines, ok := f.adds[cmd]
+	if !ok {
+		return fakeFailure("unexpected command: tc %s", cmd)
+	}
+	for _, line := range lines {
+		if strings.HasPrefix(line, "class ") {
+			f.classes = append(f.classes, line)
+			continue
+		}
+		if strings.Contains(line, " root ") {
+			f.qdiscs = slices.DeleteFunc(f.qdiscs, func(q string) bool {
+				return strings.HasPrefix(q, "qdisc noqueue 0: root ")
+			})
+		}
+		f.qdiscs = append(f.qdiscs, line)
+	}
+	return nil, nil
+}
+
+// an adopted tree is replaced by the easytc root qdisc, and recreated on reset from the lines tc printed for it
+func TestAdoptRestore(t *testing.T) {
+	ifaces := hostIfaces(t)
+	dev := ifaces[0]
+	tests := []struct {
+		name    string
+		qdiscs  []string
+		classes []string
+		// the commands which restore the tree, in order, and the lines they make
+		adds [][2]string
+	}{
+		{
+			"htb",
+			[]string{
+				"qdisc htb 1: root refcnt 2 r2q 10 default 0x10 direct_packets_stat 0 direct_qlen 1000",
+				"qdisc fq_codel 10: parent 1:10 limit 10240p flows 1024 quantum 1514 target 5ms interval 100ms memory_limit 32Mb ecn drop_batch 64",
+			},
+			[]string{
+				"class htb 1:10 parent 1:1 leaf 10: prio 0 rate 10Mbit ceil 10Mbit burst 1600b cburst 1600b",
+				"class htb 1:1 root rate 100Mbit ceil 100Mbit burst 1600b cburst 1600b",
+			},
+			[][2]string{
+				{"qdisc add dev " + dev + " root handle 1: htb r2q 10 default 0x10 direct_qlen 1000", "qdisc htb 1: root refcnt 2 r2q 10 default 0x10 direct_packets_stat 0 direct_qlen 1000"},
+				// parents first
+				{"class add dev " + dev + " parent 1: classid 1:1 htb rate 100Mbit ceil 100Mbit burst 1600b cburst 1600b", "class htb 1:1 root rate 100Mbit ceil 100Mbit burst 1600b cburst 1600b"},
+				{"class add dev " + dev + " parent 1:1 classid 1:10 htb prio 0 rate 10Mbit ceil 10Mbit burst 1600b cburst 1600b", "class htb 1:10 parent 1:1 leaf 10: prio 0 rate 10Mbit ceil 10Mbit burst 1600b cburst 1600b"},
+				{"qdisc add dev " + dev + " parent 1:10 handle 10: fq_codel limit 10240 flows 1024 quantum 1514 target 5ms interval 100ms memory_limit 32Mb ecn drop_batch 64",
+					"qdisc fq_codel 10: parent 1:10 limit 10240p flows 1024 quantum 1514 target 5ms interval 100ms memory_limit 32Mb ecn drop_batch 64"},
+			},
+		},
+		{
+			// the class of tbf is implicit, and the ingress qdisc stays
+			"tbf",
+			[]string{
+				"qdisc tbf 8001: root refcnt 2 rate 1Mbit burst 4Kb lat 50ms",
+				"qdisc netem 10: parent 8001:1 limit 1000 delay 100ms",
+				"qdisc ingress ffff: parent ffff:fff1 ----------------",
+			},
+			[]string{"class tbf 8001:1 parent 8001: leaf 10:"},
+			[][2]string{
+				{"qdisc add dev " + dev + " root handle 8001: tbf rate 1Mbit burst 4Kb lat 50ms", "qdisc tbf 8001: root refcnt 2 rate 1Mbit burst 4Kb lat 50ms\nclass tbf 8001:1 parent 8001: leaf 10:"},
+				{"qdisc add dev " + dev + " parent 8001:1 handle 10: netem limit 1000 delay 100ms", "qdisc netem 10: parent 8001:1 limit 1000 delay 100ms"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		f := &treeRunner{dev: dev, others: ifaces[1:], qdiscs: slices.Clone(tt.qdiscs), classes: slices.Clone(tt.classes), adds: map[string][]string{}}
+		want := []string{}
+		for _, add := range tt.adds {
+			f.adds[add[0]] = strings.Split(add[1], "\n")
+			want = append(want, add[0])
+		}
+		c := New(WithRunner(f), WithStateDir(t.TempDir()))
+		ctx := context.Background()
+		if err := c.Set(ctx, &Rule{Iface: Ptr(dev), AllTraffic: true, Latency: Ptr(time.Millisecond)}); !errors.Is(err, ErrForeignQdisc) {
+			t.Errorf("%s: setting a rule before adopting: got error %v, want %v", tt.name, err, ErrForeignQdisc)
+		}
+		err := c.Adopt(ctx, &dev)
+		if err != nil {
+			t.Fatalf("%s: adopting: %v", tt.name, err)
+		}
+		state, err := c.readState(dev)
+		if err != nil || state == nil || state.Snapshot == nil || !sameLines(state.Snapshot.Qdiscs, tt.qdiscs) || !sameLines(state.Snapshot.Classes, tt.classes) {
+			t.Fatalf("%s: state %+v, error %v, want the snapshot of the tree", tt.name, state, err)
+		}
+		if !strings.HasPrefix(f.qdiscs[0], "qdisc prio 1: root ") {
+			t.Errorf("%s: qdiscs after adopting:\n%s", tt.name, strings.Join(f.qdiscs, "\n"))
+		}
+
+		f.commands = nil
+		err = c.Reset(ctx, &dev)
+		if err != nil {
+			t.Fatalf("%s: reset: %v", tt.name, err)
+		}
+		got := slices.DeleteFunc(f.commands, func(cmd string) bool {
+			return !strings.HasPrefix(cmd, "qdisc add ") && !strings.HasPrefix(cmd, "class add ")
+		})
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: restored with\n%s\nwant\n%s", tt.name, strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+		if !sameLines(f.qdiscs, tt.qdiscs) || !sameLines(f.classes, tt.classes) {
+			t.Errorf("%s: restored tree\n%s\n%s", tt.name, strings.Join(f.qdiscs, "\n"), strings.Join(f.classes, "\n"))
+		}
+		if state, err := c.readState(dev); state != nil || err != nil {
+			t.Errorf("%s: state %+v, error %v after reset, want none", tt.name, state, err)
+		}
+	}
+
+	// filters cannot be recreated exactly
+	f := &treeRunner{dev: dev, others: ifaces[1:], qdiscs: []string{"qdisc htb 1: root refcnt 2 r2q 10 default 0 direct_packets_stat 0"},
+		filters: "filter parent 1: protocol ip pref 1 u32 chain 0\n"}
+	c := New(WithRunner(f), WithStateDir(t.TempDir()))
+	if err := c.Adopt(context.Background(), &dev); !errors.Is(err, ErrForeignQdisc) || !strings.Contains(err.Error(), "has filters") {
+		t.Errorf("adopting a tree with filters: got error %v, want %v", err, ErrForeignQdisc)
+	}
+}
@@ -0,0 +1,160 @@
+package tc
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	ChangeCreate = "create"
+	ChangeModify = "modify"
+	ChangeRemove = "remove"
+)
+
+// a rule which is created, modified or removed
+type Change struct {
+	Action string
+	Rule   *Rule
+	// the rule before it was modified
+	Previous *Rule
+}
+
+// a Runner for dry runs: commands which change anything are recorded instead of run, commands which only read are run with Runner.
+// A client using it also records the rule changes it would make, and does not touch its state directory.
+type RecordingRunner struct {
+	// runs the commands which only read; default: ExecRunner
+	Runner   Runner
+	mu       sync.Mutex
+	commands [][]string
+	inputs   [][]byte
+	changes  []*Change
+}
+
+func (r *RecordingRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return r.RunInput(ctx, nil, name, args...)
+}
+
+// run or record a command with input on its stdin, or without any if input is nil; Runner must be an InputRunner for
+// commands with input which only read
+func (r *RecordingRunner) RunInput(ctx context.Context, input []byte, name string, args ...string) ([]byte, error) {
+	if !isMutating(name, args) {
+		runner := r.Runner
+		if runner == nil {
+			runner = ExecRunner{}
+		}
+		if input == nil {
+			return runner.Run(ctx, name, args...)
+		}
+		ir, ok := runner.(InputRunner)
+		if !ok {
+			return nil, fmt.Errorf("runner %T cannot pass input to a command", runner)
+		}
+		return ir.RunInput(ctx, input, name, args...)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.commands = append(r.commands, append([]string{name}, args...))
+	r.inputs = append(r.inputs, slices.Clone(input))
+	return nil, nil
+}
+
+// the commands which would have run, in order
+func (r *RecordingRunner) Commands() [][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.commands)
+}
+
+// the input of each command of Commands, nil for commands without input
+func (r *RecordingRunner) Inputs() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.inputs)
+}
+
+// the rule changes which would have been made, in order
+func (r *RecordingRunner) Changes() []*Change {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.changes)
+}
+
+func (r *RecordingRunner) addChange(ch *Change) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.changes = append(r.changes, ch)
+}
+
+// whether a command changes anything; unknown commands are assumed to
+func isMutating(name string, args []string) bool {
+	switch filepath.Base(name) {
+	case "lsmod":
+		return false
+	case "modprobe":
+		return !slices.Contains(args, "-n") && !slices.Contains(args, "--dry-run")
+	case "ipset":
+		return len(args) == 0 || !slices.Contains([]string{"list", "save", "test"}, args[0])
+	case "nft":
+		for _, arg := range args {
+			if !strings.HasPrefix(arg, "-") {
+				return arg != "list"
+			}
+		}
+		return true
+	case "tc", "ip":
+		// skip global options, then the object, for example tc -n ns -j qdisc show
+		words := []string{}
+		for i := 0; i < len(args); i++ {
+			if args[i] == "-n" || args[i] == "-netns" {
+				i++
+				continue
+			}
+			if strings.HasPrefix(args[i], "-") {
+				continue
+			}
+			words = append(words, args[i])
+		}
+		if len(words) < 2 {
+			// for example tc -V
+			return false
+		}
+		// a command run in a namespace, for example ip netns exec ns nft list ruleset
+		if words[0] == "netns" && words[1] == "exec" {
+			i := slices.Index(args, "exec")
+			return i+2 >= len(args) || isMutating(args[i+2], args[i+3:])
+		}
+		switch words[1] {
+		case "show", "list", "ls", "lst", "get":
+			return false
+		}
+		return true
+	}
+	return true
+}
+
+// the recording runner if this is a dry run
+func (c *Client) recorder() *RecordingRunner {
+	rec, _ := c.runner.(*RecordingRunner)
+	return rec
+}
+
+// record a rule change for a dry run, and log it
+func (c *Client) recordChange(action string, r *Rule, previous *Rule) {
+	c.log.Debug("rule change", "action", action, "iface", PtrToString(r.Iface), "flowid", PtrToString(r.FlowID))
+	if rec := c.recorder(); rec != nil {
+		rec.addChange(&Change{Action: action, Rule: r.clone(), Previous: previous.clone()})
+	}
+}
+
+// copy of a rule, as the rules passed to Set are modified while it runs
+func (r *Rule) clone() *Rule {
+	if r == nil {
+		return nil
+	}
+	n := *r
+	return &n
+}
@@ -0,0 +1,369 @@
+package tc
+
+import (
+	"fmt"
+	"math/bits"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// inclusive range of ports; a single port has First == Last
+type PortRange struct {
+	First uint16
+	Last  uint16
+}
+
+func Port(p uint16) PortRange {
+	return PortRange{First: p, Last: p}
+}
+
+// parse a port ("443") or a port range ("1024-2047")
+func ParsePortRange(s string) (PortRange, error) {
+	first, last, isRange := strings.Cut(s, "-")
+	a, err := strconv.ParseUint(first, 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port %q", s)
+	}
+	if !isRange {
+		return Port(uint16(a)), nil
+	}
+	b, err := strconv.ParseUint(last, 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return PortRange{First: uint16(a), Last: uint16(b)}, nil
+}
+
+func (p PortRange) String() string {
+	if p.First == p.Last {
+		return strconv.Itoa(int(p.First))
+	}
+	return strconv.Itoa(int(p.First)) + "-" + strconv.Itoa(int(p.Last))
+}
+
+func (p PortRange) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *PortRange) UnmarshalText(text []byte) error {
+	r, err := ParsePortRange(string(text))
+	if err != nil {
+		return err
+	}
+	*p = r
+	return nil
+}
+
+// u32 matches a value under a mask, so only ranges which are a power of 2 in size and aligned to their size can be matched
+func (p PortRange) valueMask() (value uint16, mask uint16, ok bool) {
+	if p.First > p.Last {
+		return 0, 0, false
+	}
+	size := uint32(p.Last) - uint32(p.First) + 1
+	if bits.OnesCount32(size) != 1 || uint32(p.First)%size != 0 {
+		return 0, 0, false
+	}
+	return p.First, uint16(^(size - 1)), true
+}
+
+// port range matched by a u32 value/mask pair, if the mask is contiguous
+func portRangeFromMask(value uint16, mask uint16) (PortRange, bool) {
+	size := uint32(^mask) + 1
+	if bits.OnesCount32(size) != 1 {
+		return PortRange{}, false
+	}
+	return PortRange{First: value & mask, Last: value&mask + uint16(size-1)}, true
+}
+
+// parse an IPv4 prefix ("10.0.0.0/8") or a single address ("10.0.0.1", same as /32)
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(a, a.BitLen()), nil
+}
+
+// returns a pointer to a copy of v, for filling in the optional fields of a Rule
+func Ptr[T any](v T) *T {
+	return &v
+}
+
+// compare two optional values
+func equalPtr[T comparable](a *T, b *T) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
+
+// a problem with a single field of a rule; Field is the Rule field name, or empty if the problem is with the rule as a whole
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	if e.Field == "" {
+		return e.Err.Error()
+	}
+	return e.Field + ": " + e.Err.Error()
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// all problems found when validating a rule
+type ValidationError struct {
+	Fields []*FieldError
+}
+
+func (e *ValidationError) Error() string {
+	items := []string{}
+	for _, f := range e.Fields {
+		items = append(items, f.Error())
+	}
+	return "invalid rule: " + strings.Join(items, "; ")
+}
+
+func (e *ValidationError) Unwrap() []error {
+	errs := []error{}
+	for _, f := range e.Fields {
+		errs = append(errs, f)
+	}
+	return errs
+}
+
+func (e *ValidationError) add(field string, format string, v ...interface{}) {
+	e.Fields = append(e.Fields, &FieldError{Field: field, Err: fmt.Errorf(format, v...)})
+}
+
+func (e *ValidationError) errOrNil() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+// check a rule before it is set: all values must be valid, and at least one filter and one action must be given
+func (r *Rule) Validate() error {
+	e := r.check()
+	r.checkHasFilter(e)
+	r.checkHasAction(e)
+	if r.Jitter != nil && r.Latency == nil {
+		e.add("Jitter", "requires Latency to be set")
+	}
+	if r.Distribution != nil && r.Jitter == nil {
+		e.add("Distribution", "requires Latency and Jitter to be set")
+	}
+	return e.errOrNil()
+}
+
+// check a rule which is only used to select existing rules by their filter, name or filter handle
+func (r *Rule) ValidateFilter() error {
+	e := r.check()
+	r.checkHasSelector(e)
+	return e.errOrNil()
+}
+
+// whether an existing rule is selected by the name, filter handle and filter given in r
+func (r *Rule) selects(rule *Rule) bool {
+	if r.Name != nil && !equalPtr(r.Name, rule.Name) {
+		return false
+	}
+	if r.FilterHandle != nil && !equalPtr(r.FilterHandle, rule.FilterHandle) {
+		return false
+	}
+	return !r.hasFilter() || sameFilter(r, rule)
+}
+
+func (r *Rule) checkHasSelector(e *ValidationError) {
+	if r.Name == nil && r.FilterHandle == nil && !r.hasFilter() {
+		e.add("", "a rule must be selected by Name, FilterHandle, AllTraffic or at least one filter from: %s", filterFieldNames)
+	}
+	// filter handles are per interface
+	if r.FilterHandle != nil && r.Iface == nil {
+		e.add("FilterHandle", "requires Iface to be set")
+	}
+}
+
+func (r *Rule) hasFilter() bool {
+	return r.AllTraffic || r.hasMatch()
+}
+
+// the filter fields of a rule, other than AllTraffic
+const filterFieldNames = "SourceIP,SourcePort,DestinationIP,DestinationPort,DSCP,TOS,Length,TCPFlags,Protocol,FwMark,Cgroup,SourceSet,DestinationSet"
+
+func (r *Rule) hasMatch() bool {
+	return r.hasU32Match() || r.FwMark != nil || r.Cgroup != nil || r.hasSet()
+}
+
+// the filter fields which are matched by u32
+func (r *Rule) hasU32Match() bool {
+	return r.SourceIP != nil || r.SourcePort != nil || r.DestinationIP != nil || r.DestinationPort != nil ||
+		r.DSCP != nil || r.TOS != nil || r.Length != nil || r.TCPFlags != nil || r.Protocol != nil
+}
+
+// a copy of the interface and filter of a rule, without its actions, to select the rule or to set other actions for the same traffic
+func (r *Rule) Filter() *Rule {
+	return &Rule{
+		Iface:           r.Iface,
+		SourceIP:        r.SourceIP,
+		SourcePort:      r.SourcePort,
+		DestinationIP:   r.DestinationIP,
+		DestinationPort: r.DestinationPort,
+		DSCP:            r.DSCP,
+		TOS:             r.TOS,
+		Length:          r.Length,
+		TCPFlags:        r.TCPFlags,
+		Protocol:        r.Protocol,
+		FwMark:          r.FwMark,
+		Cgroup:          r.Cgroup,
+		SourceSet:       r.SourceSet,
+		DestinationSet:  r.DestinationSet,
+		AllTraffic:      r.AllTraffic,
+	}
+}
+
+func (r *Rule) checkHasFilter(e *ValidationError) {
+	if !r.hasFilter() {
+		e.add("", "at least one filter must be provided from: %s, or AllTraffic", filterFieldNames)
+	}
+}
+
+func (r *Rule) checkHasAction(e *ValidationError) {
+	if r.Latency == nil && r.Rate == nil && r.PacketLoss == nil && r.Corrupt == nil && r.Distribution == nil {
+		e.add("", "at least one action must be specified from: Latency,Distribution,Rate,PacketLoss,Corrupt")
+	}
+}
+
+// check the values of all fields which are set
+func (r *Rule) check() *ValidationError {
+	e := &ValidationError{}
+	if r.Iface != nil && *r.Iface == "" {
+		e.add("Iface", "must not be empty")
+	}
+	checkPrefix := func(field string, p *netip.Prefix) {
+		if p == nil {
+			return
+		}
+		switch {
+		case !p.IsValid():
+			e.add(field, "invalid prefix")
+		case !p.Addr().Is4():
+			e.add(field, "%s is not an IPv4 prefix", p)
+		case p.Masked() != *p:
+			e.add(field, "%s has host bits set, did you mean %s", p, p.Masked())
+		}
+	}
+	if r.AllTraffic && r.hasMatch() {
+		e.add("AllTraffic", "cannot be combined with %s", filterFieldNames)
+	}
+	if r.DSCP != nil && *r.DSCP > 63 {
+		e.add("DSCP", "must be between 0 and 63")
+	}
+	if r.DSCP != nil && r.TOS != nil {
+		e.add("TOS", "cannot be combined with DSCP, which is part of the TOS byte")
+	}
+	if r.TCPFlags != nil && r.TCPFlags.Mask == 0 {
+		e.add("TCPFlags", "at least one flag must be given")
+	}
+	if r.TCPFlags != nil && r.Protocol != nil {
+		e.add("Protocol", "cannot be combined with TCPFlags, which only match TCP packets")
+	}
+	if r.FwMark != nil && r.hasU32Match() {
+		e.add("FwMark", "cannot be combined with the other filter fields, the mark is matched by a fw filter")
+	}
+	if r.FwMark != nil && r.FwMark.Mask == 0 {
+		e.add("FwMark", "mask must not be 0")
+	}
+	if r.FwMark != nil && r.FwMark.Value&^r.FwMark.Mask != 0 {
+		e.add("FwMark", "%s has bits set outside its mask", r.FwMark)
+	}
+	if r.Cgroup != nil && (r.hasU32Match() || r.hasSet()) {
+		e.add("Cgroup", "cannot be combined with the other filter fields except FwMark, the cgroup is matched by a fw filter")
+	}
+	if r.Cgroup != nil && r.NftMatch != nil {
+		e.add("NftMatch", "cannot be combined with Cgroup, whose nftables rule matches the sockets of the cgroup")
+	}
+	if r.Cgroup != nil {
+		if p, err := ParseCgroup(*r.Cgroup); err != nil {
+			e.add("Cgroup", "%s", err)
+		} else if p != *r.Cgroup || strings.ContainsAny(p, "\"\n") {
+			e.add("Cgroup", "%q must be relative to the cgroup root, such as system.slice/foo.service, see ParseCgroup", *r.Cgroup)
+		}
+	}
+	if r.hasSet() && (r.hasU32Match() || r.FwMark != nil) {
+		e.add("", "SourceSet and DestinationSet cannot be combined with the other filter fields, the sets are matched by a basic filter")
+	}
+	checkSetName := func(field string, name *string) {
+		if name != nil && !setNameRe.MatchString(*name) {
+			e.add(field, "%q must start with a letter or digit, contain only letters, digits, '.', '_' and '-', and be at most 31 characters", *name)
+		}
+	}
+	checkSetName("SourceSet", r.SourceSet)
+	checkSetName("DestinationSet", r.DestinationSet)
+	if r.NftMatch != nil && *r.NftMatch != "" && r.FwMark == nil && r.Cgroup == nil {
+		e.add("NftMatch", "requires FwMark to be set, which the nftables rule sets")
+	}
+	if r.NftMatch != nil && strings.ContainsAny(*r.NftMatch, ";\n") {
+		e.add("NftMatch", "must be a single nftables expression, without ';' or newlines")
+	}
+	if r.Priority != nil && (*r.Priority < MinPriority || *r.Priority > MaxPriority) {
+		e.add("Priority", "must be between %d and %d", MinPriority, MaxPriority)
+	}
+	if r.AllTraffic && r.Priority != nil {
+		e.add("Priority", "cannot be combined with AllTraffic, which is always tried last")
+	}
+	checkPrefix("SourceIP", r.SourceIP)
+	checkPrefix("DestinationIP", r.DestinationIP)
+	checkPort := func(field string, p *PortRange) {
+		if p == nil {
+			return
+		}
+		if p.First > p.Last {
+			e.add(field, "range %s is reversed", p)
+			return
+		}
+		if _, _, ok := p.valueMask(); !ok {
+			e.add(field, "range %s cannot be matched by a single mask, it must be a power of 2 in size and start at a multiple of its size", p)
+		}
+	}
+	checkPort("SourcePort", r.SourcePort)
+	checkPort("DestinationPort", r.DestinationPort)
+	checkPort("Length", r.Length)
+	if r.Latency != nil && *r.Latency < 0 {
+		e.add("Latency", "must not be negative")
+	}
+	if r.Jitter != nil && *r.Jitter < 0 {
+		e.add("Jitter", "must not be negative")
+	}
+	if r.Distribution != nil && (*r.Distribution == "" || strings.ContainsAny(*r.Distribution, "/\\")) {
+		e.add("Distribution", "must be a table name, not a path")
+	}
+	checkPercent := func(field string, p *Percent) {
+		if p != nil && !(*p >= 0 && *p <= 100) {
+			e.add(field, "must be between 0 and 100")
+		}
+	}
+	checkPercent("PacketLoss", r.PacketLoss)
+	checkPercent("Corrupt", r.Corrupt)
+	if r.Name != nil && !nameRe.MatchString(*r.Name) {
+		e.add("Name", "%q must start with a letter or digit, and contain only letters, digits, '.', '_' and '-'", *r.Name)
+	}
+	for k, v := range r.Labels {
+		if !labelKeyRe.MatchString(k) {
+			e.add("Labels", "key %q must start with a letter or digit, and contain only letters, digits, '.', '_', '/' and '-'", k)
+		}
+		if !labelValueRe.MatchString(v) {
+			e.add("Labels", "value %q of %s may contain only letters, digits, '.', '_' and '-'", v, k)
+		}
+	}
+	r.checkExcept(e)
+	return e
+}
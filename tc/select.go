@@ -0,0 +1,173 @@
+package tc
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+)
+
+// selects existing rules, for example for DeleteMatching; every field which is set must match.
+// If any filter field is set, the filter fields which are not set must be unset in the rule as well, unless AnyIP or AnyPort is set;
+// if none is set, the filter is not compared. A cgroup rule is selected by its Cgroup whatever its mark, or by its FwMark whatever its cgroup.
+type Selector struct {
+	Iface           *string
+	SourceIP        *netip.Prefix
+	SourcePort      *PortRange
+	DestinationIP   *netip.Prefix
+	DestinationPort *PortRange
+	DSCP            *uint8
+	TOS             *uint8
+	Length          *PortRange
+	TCPFlags        *TCPFlags
+	Protocol        *uint8
+	FwMark          *FwMark
+	Cgroup          *string
+	SourceSet       *string
+	DestinationSet  *string
+	// the filter of the rule must also match this expression
+	Match *MatchExpr
+	// select the all-traffic rule
+	AllTraffic bool
+	// match any source and destination IP and set which is not set
+	AnyIP bool
+	// match any source and destination port which is not set
+	AnyPort bool
+	// match any DSCP, TOS, length, TCP flags, protocol, firewall mark and cgroup which are not set
+	AnyMatch bool
+	Name     *string
+	Labels   map[string]string
+	// handles and flow IDs are per interface: without Iface, they must not match on more than one interface
+	FilterHandle *string
+	FlowID       *string
+	// the rule must have the action, above the given value
+	LatencyOver    *time.Duration
+	PacketLossOver *Percent
+	CorruptOver    *Percent
+}
+
+func (s *Selector) hasFilter() bool {
+	return s.AllTraffic || s.SourceIP != nil || s.SourcePort != nil || s.DestinationIP != nil || s.DestinationPort != nil ||
+		s.DSCP != nil || s.TOS != nil || s.Length != nil || s.TCPFlags != nil || s.Protocol != nil || s.FwMark != nil || s.Cgroup != nil ||
+		s.SourceSet != nil || s.DestinationSet != nil
+}
+
+// check the values of the selector; at least one field other than Iface must be set, so that it does not select all rules by accident
+func (s *Selector) Validate() error {
+	r := &Rule{
+		Iface:           s.Iface,
+		SourceIP:        s.SourceIP,
+		SourcePort:      s.SourcePort,
+		DestinationIP:   s.DestinationIP,
+		DestinationPort: s.DestinationPort,
+		DSCP:            s.DSCP,
+		TOS:             s.TOS,
+		Length:          s.Length,
+		TCPFlags:        s.TCPFlags,
+		Protocol:        s.Protocol,
+		FwMark:          s.FwMark,
+		Cgroup:          s.Cgroup,
+		SourceSet:       s.SourceSet,
+		DestinationSet:  s.DestinationSet,
+		AllTraffic:      s.AllTraffic,
+		Name:            s.Name,
+		Labels:          s.Labels,
+	}
+	e := r.check()
+	if s.LatencyOver != nil && *s.LatencyOver < 0 {
+		e.add("LatencyOver", "must not be negative")
+	}
+	checkPercent := func(field string, p *Percent) {
+		if p != nil && !(*p >= 0 && *p <= 100) {
+			e.add(field, "must be between 0 and 100")
+		}
+	}
+	checkPercent("PacketLossOver", s.PacketLossOver)
+	checkPercent("CorruptOver", s.CorruptOver)
+	if !s.hasFilter() && s.Match == nil && s.Name == nil && len(s.Labels) == 0 && s.FilterHandle == nil && s.FlowID == nil && s.LatencyOver == nil && s.PacketLossOver == nil && s.CorruptOver == nil {
+		e.add("", "at least one of the filter fields, Match, Name, Labels, FilterHandle, FlowID, LatencyOver, PacketLossOver or CorruptOver must be set")
+	}
+	return e.errOrNil()
+}
+
+// whether a rule is selected; rules without a filter, whose netem qdisc is unused, are never selected,
+// and pass-through filters only by their FilterHandle
+func (s *Selector) Matches(rule *Rule) bool {
+	if rule.Iface == nil || rule.FilterHandle == nil || (rule.PassThrough && s.FilterHandle == nil) {
+		return false
+	}
+	if s.Iface != nil && *s.Iface != *rule.Iface {
+		return false
+	}
+	if s.Name != nil && !equalPtr(s.Name, rule.Name) {
+		return false
+	}
+	if !rule.HasLabels(s.Labels) {
+		return false
+	}
+	if s.FilterHandle != nil && !equalPtr(s.FilterHandle, rule.FilterHandle) {
+		return false
+	}
+	if s.FlowID != nil && !equalPtr(s.FlowID, rule.FlowID) {
+		return false
+	}
+	if s.hasFilter() {
+		if s.AllTraffic && !rule.AllTraffic {
+			return false
+		}
+		if !matchField(s.SourceIP, rule.SourceIP, s.AnyIP) || !matchField(s.DestinationIP, rule.DestinationIP, s.AnyIP) ||
+			!matchField(s.SourceSet, rule.SourceSet, s.AnyIP) || !matchField(s.DestinationSet, rule.DestinationSet, s.AnyIP) {
+			return false
+		}
+		if !matchField(s.SourcePort, rule.SourcePort, s.AnyPort) || !matchField(s.DestinationPort, rule.DestinationPort, s.AnyPort) {
+			return false
+		}
+		if !matchField(s.DSCP, rule.DSCP, s.AnyMatch) || !matchField(s.TOS, rule.TOS, s.AnyMatch) ||
+			!matchField(s.Length, rule.Length, s.AnyMatch) || !matchField(s.TCPFlags, rule.TCPFlags, s.AnyMatch) || !matchField(s.Protocol, rule.Protocol, s.AnyMatch) || !matchField(s.FwMark, rule.FwMark, s.AnyMatch || s.Cgroup != nil) ||
+			!matchField(s.Cgroup, rule.Cgroup, s.AnyMatch || s.FwMark != nil) {
+			return false
+		}
+	}
+	if s.Match != nil && !s.Match.Matches(rule) {
+		return false
+	}
+	if s.LatencyOver != nil && (rule.Latency == nil || *rule.Latency <= *s.LatencyOver) {
+		return false
+	}
+	if s.PacketLossOver != nil && (rule.PacketLoss == nil || *rule.PacketLoss <= *s.PacketLossOver || rule.PacketLoss.equal(*s.PacketLossOver)) {
+		return false
+	}
+	if s.CorruptOver != nil && (rule.Corrupt == nil || *rule.Corrupt <= *s.CorruptOver || rule.Corrupt.equal(*s.CorruptOver)) {
+		return false
+	}
+	return true
+}
+
+// a filter field which is not set matches any value if any is set, and only an unset value otherwise
+func matchField[T comparable](want *T, have *T, any bool) bool {
+	if want == nil && any {
+		return true
+	}
+	return equalPtr(want, have)
+}
+
+// the rules selected by s; an error if a handle or flow ID without interface matches on more than one interface
+func (s *Selector) selectRules(rules *Rules) ([]*Rule, error) {
+	selected := []*Rule{}
+	ifaces := []string{}
+	for _, rule := range rules.Rules {
+		if !s.Matches(rule) {
+			continue
+		}
+		selected = append(selected, rule)
+		if !slices.Contains(ifaces, *rule.Iface) {
+			ifaces = append(ifaces, *rule.Iface)
+		}
+	}
+	if s.Iface == nil && (s.FilterHandle != nil || s.FlowID != nil) && len(ifaces) > 1 {
+		e := &ValidationError{}
+		e.add("Iface", "must be set, the handle or flow ID matches on interfaces %s", strings.Join(ifaces, ", "))
+		return nil, e
+	}
+	return selected, nil
+}
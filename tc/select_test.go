@@ -0,0 +1,120 @@
+package tc
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelectorMatches(t *testing.T) {
+	tcp, udp := Ptr(uint8(protocolTCP)), Ptr(uint8(17))
+	rule := func(name string, iface string, fh string, r *Rule) *Rule {
+		r.Name, r.Iface = Ptr(name), Ptr(iface)
+		if fh != "" {
+			r.FilterHandle = Ptr(fh)
+		}
+		return r
+	}
+	rules := &Rules{Rules: []*Rule{
+		rule("web", "eth0", "800::800", &Rule{DestinationIP: prefix("10.1.0.0/16"), DestinationPort: Ptr(Port(443)), Protocol: tcp, FlowID: Ptr("1:4"),
+			Latency: Ptr(100 * time.Millisecond), PacketLoss: Ptr(Percent(5)), Labels: map[string]string{"team": "a"}}),
+		rule("dns", "eth0", "800::801", &Rule{DestinationIP: prefix("10.0.0.53/32"), DestinationPort: Ptr(Port(53)), Protocol: udp, FlowID: Ptr("1:5"),
+			Latency: Ptr(10 * time.Millisecond)}),
+		rule("marked", "eth0", "0x10", &Rule{FwMark: mark(t, "0x10"), Cgroup: Ptr("system.slice/foo.service"), FlowID: Ptr("1:6"), PacketLoss: Ptr(Percent(0.5))}),
+		rule("all", "eth0", "803::800", &Rule{AllTraffic: true, FlowID: Ptr("1:7"), Corrupt: Ptr(Percent(1))}),
+		rule("pass", "eth0", "802::800", &Rule{DestinationIP: prefix("10.0.0.1/32"), PassThrough: true, FlowID: Ptr(passFlow)}),
+		// a netem qdisc without a filter
+		rule("unused", "eth0", "", &Rule{FlowID: Ptr("1:8"), Latency: Ptr(time.Second)}),
+		rule("web1", "eth1", "800::800", &Rule{DestinationIP: prefix("10.1.0.0/16"), DestinationPort: Ptr(Port(443)), Protocol: tcp, FlowID: Ptr("1:4"),
+			Latency: Ptr(50 * time.Millisecond)}),
+	}}
+	expr, err := ParseMatch("dst net 10.0.0.0/8 and tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		s    *Selector
+		want string
+	}{
+		{"nothing", &Selector{}, "web dns marked all web1"},
+		{"interface", &Selector{Iface: Ptr("eth1")}, "web1"},
+		// the filter fields which are not set must be unset in the rule, unless any is allowed
+		{"partial filter", &Selector{DestinationIP: prefix("10.1.0.0/16")}, ""},
+		{"partial filter, any port and match", &Selector{DestinationIP: prefix("10.1.0.0/16"), AnyPort: true, AnyMatch: true}, "web web1"},
+		{"partial filter, any port", &Selector{DestinationIP: prefix("10.1.0.0/16"), AnyPort: true}, ""},
+		{"whole filter", &Selector{DestinationIP: prefix("10.1.0.0/16"), DestinationPort: Ptr(Port(443)), Protocol: tcp}, "web web1"},
+		{"prefixes are compared, not contained", &Selector{DestinationIP: prefix("10.0.0.0/8"), AnyPort: true, AnyMatch: true}, ""},
+		{"any ip", &Selector{Iface: Ptr("eth0"), DestinationPort: Ptr(Port(443)), AnyIP: true, AnyMatch: true}, "web"},
+		{"other protocol", &Selector{DestinationPort: Ptr(Port(443)), Protocol: udp, AnyIP: true}, ""},
+		// a cgroup rule is selected by its mark or its cgroup
+		{"mark", &Selector{FwMark: mark(t, "0x10")}, "marked"},
+		{"cgroup", &Selector{Cgroup: Ptr("system.slice/foo.service")}, "marked"},
+		{"other mark", &Selector{FwMark: mark(t, "0x20")}, ""},
+		{"all traffic", &Selector{AllTraffic: true}, "all"},
+		{"name", &Selector{Name: Ptr("web")}, "web"},
+		{"labels", &Selector{Labels: map[string]string{"team": "a"}}, "web"},
+		{"other labels", &Selector{Labels: map[string]string{"team": "b"}}, ""},
+		// thresholds are exclusive
+		{"latency over", &Selector{LatencyOver: Ptr(10 * time.Millisecond)}, "web web1"},
+		{"latency over less", &Selector{LatencyOver: Ptr(9 * time.Millisecond)}, "web dns web1"},
+		{"loss over its value", &Selector{PacketLossOver: Ptr(Percent(5))}, ""},
+		{"loss over", &Selector{PacketLossOver: Ptr(Percent(0.4))}, "web marked"},
+		{"corrupt over", &Selector{CorruptOver: Ptr(Percent(0.5))}, "all"},
+		{"latency over and name", &Selector{LatencyOver: Ptr(10 * time.Millisecond), Name: Ptr("dns")}, ""},
+		// pass-through filters are only selected by their handle
+		{"pass-through by filter", &Selector{DestinationIP: prefix("10.0.0.1/32")}, ""},
+		{"pass-through by handle", &Selector{FilterHandle: Ptr("802::800")}, "pass"},
+		{"handle", &Selector{Iface: Ptr("eth1"), FilterHandle: Ptr("800::800")}, "web1"},
+		{"flow", &Selector{FlowID: Ptr("1:5")}, "dns"},
+		{"expression", &Selector{Match: expr}, "web web1"},
+		{"expression and interface", &Selector{Match: expr, Iface: Ptr("eth0")}, "web"},
+	}
+	for _, tt := range tests {
+		selected, err := tt.s.selectRules(rules)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		names := []string{}
+		for _, r := range selected {
+			names = append(names, *r.Name)
+		}
+		if got := strings.Join(names, " "); got != tt.want {
+			t.Errorf("%s: selected %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// handles and flow IDs are per interface
+	for _, s := range []*Selector{{FilterHandle: Ptr("800::800")}, {FlowID: Ptr("1:4")}} {
+		var verr *ValidationError
+		if _, err := s.selectRules(rules); !errors.As(err, &verr) || !strings.Contains(err.Error(), "eth0, eth1") {
+			t.Errorf("%s%s without interface: got error %v, want one naming eth0 and eth1", PtrToString(s.FilterHandle), PtrToString(s.FlowID), err)
+		}
+	}
+}
+
+func TestSelectorValidate(t *testing.T) {
+	tests := []struct {
+		s    *Selector
+		want string
+	}{
+		{&Selector{Name: Ptr("web")}, ""},
+		{&Selector{Iface: Ptr("eth0"), LatencyOver: Ptr(time.Duration(0))}, ""},
+		{&Selector{}, "at least one of the filter fields"},
+		{&Selector{Iface: Ptr("eth0")}, "at least one of the filter fields"},
+		{&Selector{LatencyOver: Ptr(-time.Millisecond)}, "LatencyOver: must not be negative"},
+		{&Selector{PacketLossOver: Ptr(Percent(101))}, "PacketLossOver: must be between 0 and 100"},
+		{&Selector{CorruptOver: Ptr(Percent(-1))}, "CorruptOver: must be between 0 and 100"},
+	}
+	for _, tt := range tests {
+		err := tt.s.Validate()
+		if tt.want == "" && err != nil {
+			t.Errorf("%+v: %v", tt.s, err)
+		}
+		if tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("%+v: got error %v, want one containing %q", tt.s, err, tt.want)
+		}
+	}
+}
@@ -1,76 +1,127 @@
 package tc
 
 import (
+	"context"
 	"fmt"
-	"os/exec"
 	"strconv"
 	"strings"
 
 	"github.com/bestmethod/inslice"
 )
 
-func InsertKernelMod(verbose bool) error {
-	logf(verbose, "(InsertKernelMod) Running [modprobe sch_netem]")
-	out, err := exec.Command("modprobe", "sch_netem").CombinedOutput()
+func (c *Client) InsertKernelMod(ctx context.Context) error {
+	_, err := c.run(ctx, "modprobe", "sch_netem")
+	return err
+}
+
+func (c *Client) Set(ctx context.Context, r *Rule) error {
+	unlock, err := c.lock(ctx)
 	if err != nil {
-		return fmt.Errorf("%s: %s", err, string(out))
+		return err
 	}
-	logf(verbose, "(InsertKernelMod) return")
-	return nil
+	defer unlock()
+	return c.undoOnError(ctx, func() error {
+		return c.setRule(ctx, r)
+	})
 }
 
-func Set(r *Rule, verbose bool) error {
+func (c *Client) setRule(ctx context.Context, r *Rule) error {
 	// list qdisc
-	rules, err := ListRules(verbose)
+	rules, err := c.ListRules(ctx)
 	if err != nil {
 		return err
 	}
 
 	// list ifaces
-	var ifaces []string
-	if r.Iface == nil {
-		ifaces = rules.Interfaces
-	} else {
-		ifaces = append(ifaces, *r.Iface)
-		if !inslice.HasString(ifaces, *r.Iface) {
-			return fmt.Errorf("interface %s does not exist", *r.Iface)
+	ifaces, err := rules.selectIfaces(r.Iface)
+	if err != nil {
+		return err
+	}
+
+	// latency and jitter default to the sample statistics stored in the distribution table
+	if r.Distribution != nil && (r.Latency == nil || r.Jitter == nil) {
+		c.log.Debug("reading distribution table", "func", "Set", "name", *r.Distribution)
+		dist, err := ReadDistTable(*r.Distribution)
+		if err != nil {
+			return err
+		}
+		if r.Latency == nil {
+			r.Latency = Ptr(Milliseconds(dist.MeanMs))
+		}
+		if r.Jitter == nil {
+			r.Jitter = Ptr(Milliseconds(dist.StddevMs))
+		}
+	}
+	err = r.Validate()
+	if err != nil {
+		return err
+	}
+	// a name stands for one filter, set on one or more interfaces
+	if r.Name != nil {
+		for _, rule := range rules.Rules {
+			if rule.Name != nil && *rule.Name == *r.Name && !sameFilter(r, rule) {
+				return fmt.Errorf("%w: name %s is already used by rule %s on interface %s, which has another filter", ErrConflictingRule, *r.Name, PtrToString(rule.ID), *rule.Iface)
+			}
 		}
 	}
 
-	// check if, and initialize qdisc if needed
-	isInit := false
-	for _, q := range rules.Qdisc {
-		if q.Kind == nil || *q.Kind != "prio" {
+	err = c.validateProtected()
+	if err != nil {
+		return err
+	}
+	// the ipset ematch needs its sets to exist when the filter is added
+	for _, name := range []*string{r.SourceSet, r.DestinationSet} {
+		if name == nil {
 			continue
 		}
-		if q.Options == nil || q.Options.PrioBands == nil {
-			continue
+		err = c.ensureSet(ctx, *name)
+		if err != nil {
+			return err
 		}
-		isInit = true
-		break
 	}
-	if !isInit {
-		for _, iface := range rules.Interfaces {
-			if iface == "lo" {
-				continue
-			}
-			comm := []string{"tc", "qdisc", "add", "dev", iface, "root", "handle", "1:", "prio", "bands", "16", "priomap", "2", "2", "2", "2", "2", "2", "2", "2", "2", "2", "2", "2", "2", "2", "2", "2"}
-			logf(verbose, "(Set) Running %v", comm)
-			out, err := exec.Command(comm[0], comm[1:]...).CombinedOutput()
-			if err != nil {
-				return fmt.Errorf("%s: %s", err, string(out))
-			}
+
+	// initialize the root qdisc of each selected interface, unless easytc already owns it, and protect traffic from the rules
+	for _, iface := range ifaces {
+		err = c.initRoot(ctx, iface, rules.Qdisc)
+		if err != nil {
+			return err
+		}
+		err = c.ensureProtected(ctx, iface, rules)
+		if err != nil {
+			return err
+		}
+	}
+	if len(c.protected) > 0 {
+		rules, err = c.ListRules(ctx)
+		if err != nil {
+			return err
 		}
 	}
 
-	// work on each iface
-	stor := r.Iface
+	// work on each iface; cgroup rules get their mark and nftables expression per interface
+	stor, storMark, storNft := r.Iface, r.FwMark, r.NftMatch
 	defer func() {
-		r.Iface = stor
+		r.Iface, r.FwMark, r.NftMatch = stor, storMark, storNft
 	}()
+	// conflicts are collected over all interfaces
+	r.Conflicts = nil
 	for _, iface := range ifaces {
 		r.Iface = &iface
-		err = set(r, rules, verbose)
+		// output parameters are per interface, and may be left over from a previous call
+		r.FlowID = nil
+		r.QdiscHandle = nil
+		r.ID = nil
+		if r.Cgroup != nil {
+			r.FwMark, r.NftMatch = storMark, Ptr(cgroupMatch(*r.Cgroup))
+			if r.FwMark == nil {
+				mark, err := cgroupMark(rules, r)
+				if err != nil {
+					return err
+				}
+				r.FwMark = &mark
+			}
+		}
+		err = c.set(ctx, r, rules)
 		if err != nil {
 			return err
 		}
@@ -79,51 +130,32 @@ func Set(r *Rule, verbose bool) error {
 	return nil
 }
 
-func set(r *Rule, rules *Rules, verbose bool) error {
+// number of bands of the root prio qdisc
+const prioBands = 16
+
+func (c *Client) set(ctx context.Context, r *Rule, rules *Rules) error {
+	// a new filter, or one which moves to another priority, must fit the filters of its priority
+	if existing := findFilter(rules, r); existing == nil || (r.Priority != nil && !equalPtr(r.Priority, existing.Priority)) {
+		err := checkPrio(rules, r)
+		if err != nil {
+			return err
+		}
+	}
+	err := checkExceptOverlaps(rules, r, findFilter(rules, r))
+	if err != nil {
+		return err
+	}
 	// find existing rule if one already there
 	// create/replace qdisc rule
-	newFlowId := 4
 	for _, rule := range rules.Rules {
-		if rule.FlowID != nil {
-			fid := strings.Split(*rule.FlowID, ":")
-			if len(fid) != 2 {
-				continue
-			}
-			if a, _ := strconv.Atoi(fid[1]); a >= newFlowId {
-				newFlowId = a + 1
-			}
-		}
 		if rule.Iface == nil || *rule.Iface != *r.Iface {
 			continue
 		}
-		if (rule.LatencyMs == nil && r.LatencyMs != nil) || (rule.LatencyMs != nil && r.LatencyMs == nil) {
+		if r.Distribution != nil {
+			// tc does not list distribution tables, which are only known for rules with a state file, do not reuse a qdisc
 			continue
 		}
-		if r.LatencyMs != nil && *r.LatencyMs != *rule.LatencyMs {
-			continue
-		}
-		if (rule.PacketLossPct == nil && r.PacketLossPct != nil) || (rule.PacketLossPct != nil && r.PacketLossPct == nil) {
-			continue
-		}
-		if r.PacketLossPct != nil {
-			pctTr, _ := strconv.ParseFloat(*r.PacketLossPct, 64)
-			if fmt.Sprintf("%0.2f", pctTr) != *rule.PacketLossPct {
-				continue
-			}
-		}
-		if (rule.CorruptPct == nil && r.CorruptPct != nil) || (rule.CorruptPct != nil && r.CorruptPct == nil) {
-			continue
-		}
-		if r.CorruptPct != nil {
-			pctTr, _ := strconv.ParseFloat(*r.CorruptPct, 64)
-			if fmt.Sprintf("%0.2f", pctTr) != *rule.CorruptPct {
-				continue
-			}
-		}
-		if (rule.LinkSpeedRateBytes == nil && r.LinkSpeedRateBytes != nil) || (rule.LinkSpeedRateBytes != nil && r.LinkSpeedRateBytes == nil) {
-			continue
-		}
-		if r.LinkSpeedRateBytes != nil && *r.LinkSpeedRateBytes != *rule.LinkSpeedRateBytes {
+		if !sameActions(r, rule) {
 			continue
 		}
 		r.QdiscHandle = rule.QdiscHandle
@@ -132,92 +164,383 @@ func set(r *Rule, rules *Rules, verbose bool) error {
 		break
 	}
 	if r.FlowID == nil {
-		r.FlowID = StringToPtr("1:" + strconv.Itoa(newFlowId))
-		r.QdiscHandle = StringToPtr(strconv.Itoa(newFlowId) + "0:")
-	}
-	params := []string{"qdisc", "replace", "dev", *r.Iface, "parent", *r.FlowID, "handle", *r.QdiscHandle, "netem"}
-	if r.LatencyMs != nil {
-		params = append(params, "delay", *r.LatencyMs+"ms")
-	}
-	if r.LinkSpeedRateBytes != nil {
-		params = append(params, "rate", *r.LinkSpeedRateBytes+"bps")
-	}
-	if r.PacketLossPct != nil {
-		params = append(params, "loss", *r.PacketLossPct+"%")
-	}
-	if r.CorruptPct != nil {
-		params = append(params, "corrupt", *r.CorruptPct+"%")
+		flowId, err := freeFlowId(rules, *r.Iface)
+		if err != nil {
+			return err
+		}
+		r.FlowID, r.QdiscHandle = flowHandles(flowId)
 	}
-	logf(verbose, "(Set) Running %v", append([]string{"tc"}, params...))
-	out, err := exec.Command("tc", params...).CombinedOutput()
+	err = c.tcExec(ctx, append([]string{"qdisc", "replace", "dev", *r.Iface, "parent", *r.FlowID, "handle", *r.QdiscHandle}, netemParams(r)...)...)
 	if err != nil {
-		return fmt.Errorf("%s: %s", err, string(out))
+		return err
+	}
+
+	conflicts := conflictsOf(rules, r, findFilter(rules, r))
+	r.Conflicts = append(r.Conflicts, conflicts...)
+	for _, conflict := range conflicts {
+		c.log.Warn("rules overlap", "iface", conflict.Iface, "winner", PtrToString(conflict.Winner.FilterHandle), "loser", PtrToString(conflict.Loser.FilterHandle), "shadowed", conflict.Shadowed, "samePriority", conflict.SamePriority)
 	}
 
 	// add filter rule as defined, if one does not exist; if one does exist, remove/replace with new flowID
 	filterFound := false
+	var existing *Rule
 	for _, rule := range rules.Rules {
 		if r.Iface == nil || rule.Iface == nil || *r.Iface != *rule.Iface {
 			continue
 		}
-		if (r.SourceIP != nil && rule.SourceIP == nil) || (r.SourceIP == nil && rule.SourceIP != nil) {
-			continue
-		}
-		if (r.DestinationIP != nil && rule.DestinationIP == nil) || (r.DestinationIP == nil && rule.DestinationIP != nil) {
-			continue
-		}
-		if (r.SourcePort != nil && rule.SourcePort == nil) || (r.SourcePort == nil && rule.SourcePort != nil) {
+		if !sameFilter(r, rule) {
 			continue
 		}
-		if (r.DestinationPort != nil && rule.DestinationPort == nil) || (r.DestinationPort == nil && rule.DestinationPort != nil) {
-			continue
-		}
-		if r.SourceIP != nil && *r.SourceIP != *rule.SourceIP {
-			continue
-		}
-		if r.DestinationIP != nil && *r.DestinationIP != *rule.DestinationIP {
-			continue
+		existing = rule
+		if r.Priority != nil && !equalPtr(r.Priority, rule.Priority) {
+			// tc cannot change the priority of a filter, it is added again below
+			err := c.tcExec(ctx, filterArgs("del", *rule.Iface, rule, rule.FilterHandle)...)
+			if err != nil {
+				return err
+			}
+			if *rule.FlowID != *r.FlowID {
+				err = c.dropUnusedFlow(ctx, rules, rule)
+				if err != nil {
+					return err
+				}
+			}
+			break
 		}
-		if r.SourcePort != nil && *r.SourcePort != *rule.SourcePort {
-			continue
+		// we are here, the rule had been found, change flowid to match r.FlowID
+		err := c.tcExec(ctx, append(append(filterArgs("replace", *rule.Iface, rule, rule.FilterHandle), replaceMatches(rule)...), "flowid", *r.FlowID)...)
+		if err != nil {
+			return err
 		}
-		if r.DestinationPort != nil && *r.DestinationPort != *rule.DestinationPort {
-			continue
+		if *rule.FlowID != *r.FlowID {
+			err = c.dropUnusedFlow(ctx, rules, rule)
+			if err != nil {
+				return err
+			}
 		}
-		// we are here, the rule had been found, change flowid to match r.FlowID
-		comm := []string{"tc", "filter", "replace", "dev", *rule.Iface, "protocol", "ip", "parent", "1:0", "prio", "3", "handle", *rule.FilterHandle, "u32", "flowid", *r.FlowID}
-		logf(verbose, "(Set) Running %v", comm)
-		out, err := exec.Command(comm[0], comm[1:]...).CombinedOutput()
+		err = c.writeMeta(*r.Iface, *rule.FilterHandle, r, false)
 		if err != nil {
-			return fmt.Errorf("%s: %s", err, string(out))
+			return err
 		}
+		c.recordChange(ChangeModify, r, rule)
 		filterFound = true
 		break
 	}
 
 	if !filterFound {
 		// we are here, the filter rule is not found, create a new filter for r.FlowID
-		params := []string{"filter", "add", "dev", *r.Iface, "protocol", "ip", "parent", "1:0", "prio", "3", "u32"}
-		if r.SourceIP != nil {
-			params = append(params, "match", "ip", "src", *r.SourceIP)
+		params := append(filterArgs("add", *r.Iface, r, newFilterHandle(rules, r)), matchArgs(r)...)
+		params = append(params, "flowid", *r.FlowID)
+		err := c.tcExec(ctx, params...)
+		if err != nil {
+			return err
 		}
-		if r.DestinationIP != nil {
-			params = append(params, "match", "ip", "dst", *r.DestinationIP)
+		// a dry run added no filter to look up
+		if c.recorder() == nil {
+			fh, err := c.addedFilterHandle(ctx, r, rules)
+			if err != nil {
+				return err
+			}
+			// a rule which moved to another priority keeps its identity
+			if existing != nil {
+				err = c.moveMeta(*r.Iface, *existing.FilterHandle, fh)
+				if err != nil {
+					return err
+				}
+			}
+			err = c.writeMeta(*r.Iface, fh, r, existing == nil)
+			if err != nil {
+				return err
+			}
 		}
-		if r.SourcePort != nil {
-			params = append(params, "match", "ip", "sport", *r.SourcePort, "0xffff")
+		if existing != nil {
+			c.recordChange(ChangeModify, r, existing)
+		} else {
+			c.recordChange(ChangeCreate, r, nil)
 		}
-		if r.DestinationPort != nil {
-			params = append(params, "match", "ip", "dport", *r.DestinationPort, "0xffff")
+	}
+
+	err = c.setNft(ctx, r, existing)
+	if err != nil {
+		return err
+	}
+	err = c.setExceptions(ctx, r, rules)
+	if err != nil {
+		return err
+	}
+	c.cleanupUnusedQdisc(ctx)
+	return nil
+}
+
+// the rule with the filter of r on its interface, if there is one
+func findFilter(rules *Rules, r *Rule) *Rule {
+	for _, rule := range rules.Rules {
+		if rule.Iface != nil && *rule.Iface == *r.Iface && rule.FilterHandle != nil && sameFilter(r, rule) {
+			return rule
 		}
-		params = append(params, "flowid", *r.FlowID)
-		logf(verbose, "(Set) Running %v", append([]string{"tc"}, params...))
-		out, err := exec.Command("tc", params...).CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("%s: %s", err, string(out))
+	}
+	return nil
+}
+
+// remove the netem qdisc of a rule's flow after its filter was moved or deleted, unless other filters still use it
+func (c *Client) dropUnusedFlow(ctx context.Context, rules *Rules, rule *Rule) error {
+	if rule.FlowID == nil || rule.QdiscHandle == nil {
+		return nil
+	}
+	for _, other := range rules.Rules {
+		if other == rule || other.Iface == nil || *other.Iface != *rule.Iface || other.FilterHandle == nil || other.FlowID == nil {
+			continue
+		}
+		if *other.FlowID == *rule.FlowID {
+			return nil
+		}
+	}
+	return c.tcExec(ctx, "qdisc", "del", "dev", *rule.Iface, "parent", *rule.FlowID, "handle", *rule.QdiscHandle)
+}
+
+// netem qdisc parameters for the actions of a rule
+func netemParams(r *Rule) []string {
+	params := []string{"netem"}
+	if r.Latency != nil {
+		params = append(params, "delay", tcTime(*r.Latency))
+		if r.Jitter != nil {
+			params = append(params, tcTime(*r.Jitter))
+			if r.Distribution != nil {
+				params = append(params, "distribution", *r.Distribution)
+			}
+		}
+	}
+	if r.Rate != nil {
+		params = append(params, "rate", r.Rate.String())
+	}
+	if r.PacketLoss != nil {
+		params = append(params, "loss", r.PacketLoss.String()+"%")
+	}
+	if r.Corrupt != nil {
+		params = append(params, "corrupt", r.Corrupt.String()+"%")
+	}
+	return params
+}
+
+// match parameters for the filter of a rule
+func matchArgs(r *Rule) []string {
+	if r.hasSet() {
+		return ipsetMatches(r)
+	}
+	return u32Matches(r)
+}
+
+// match parameters to replace the filter of a rule with: a basic filter loses its ematches unless they are given again,
+// while u32 and fw filters keep their matches
+func replaceMatches(r *Rule) []string {
+	if r.hasSet() {
+		return ipsetMatches(r)
+	}
+	return nil
+}
+
+// u32 match parameters for the filter of a rule; port ranges must have been validated. A fw filter has none, its handle is the mark
+func u32Matches(r *Rule) []string {
+	if r.FwMark != nil || r.hasSet() {
+		return nil
+	}
+	if r.AllTraffic {
+		return []string{"match", "u32", "0", "0", "at", "0"}
+	}
+	params := []string{}
+	if r.SourceIP != nil {
+		params = append(params, "match", "ip", "src", r.SourceIP.String())
+	}
+	if r.DestinationIP != nil {
+		params = append(params, "match", "ip", "dst", r.DestinationIP.String())
+	}
+	if r.SourcePort != nil {
+		value, mask, _ := r.SourcePort.valueMask()
+		params = append(params, "match", "ip", "sport", strconv.Itoa(int(value)), fmt.Sprintf("0x%04x", mask))
+	}
+	if r.DestinationPort != nil {
+		value, mask, _ := r.DestinationPort.valueMask()
+		params = append(params, "match", "ip", "dport", strconv.Itoa(int(value)), fmt.Sprintf("0x%04x", mask))
+	}
+	if r.DSCP != nil {
+		params = append(params, "match", "ip", "tos", fmt.Sprintf("0x%02x", *r.DSCP<<2), "0xfc")
+	}
+	if r.TOS != nil {
+		params = append(params, "match", "ip", "tos", fmt.Sprintf("0x%02x", *r.TOS), "0xff")
+	}
+	if r.Length != nil {
+		value, mask, _ := r.Length.valueMask()
+		params = append(params, "match", "u16", strconv.Itoa(int(value)), fmt.Sprintf("0x%04x", mask), "at", "2")
+	}
+	if r.Protocol != nil {
+		params = append(params, "match", "ip", "protocol", strconv.Itoa(int(*r.Protocol)), "0xff")
+	}
+	if r.TCPFlags != nil {
+		params = append(params, "match", "ip", "protocol", strconv.Itoa(protocolTCP), "0xff")
+		params = append(params, "match", "u8", fmt.Sprintf("0x%02x", r.TCPFlags.Value), fmt.Sprintf("0x%02x", r.TCPFlags.Mask), "at", strconv.Itoa(offsetTCPFlags))
+	}
+	return params
+}
+
+// filter priorities: pass-through filters are tried first, then the rules by their priority, and the all-traffic rule catches the rest
+const (
+	passPrio       = "1"
+	allTrafficPrio = "1000"
+)
+
+// range of rule priorities, and the priority of rules which are set without one; a priority holds filters of a single kind,
+// so fw and ipset rules have defaults of their own, before the u32 rules
+const (
+	MinPriority           = 2
+	MaxPriority           = 999
+	DefaultPriority       = 100
+	DefaultFwMarkPriority = 50
+	DefaultSetPriority    = 60
+)
+
+// the priority of a rule which is set without one
+func defaultPriority(r *Rule) int {
+	switch {
+	case r.Cgroup != nil:
+		return DefaultCgroupPriority
+	case r.FwMark != nil:
+		return DefaultFwMarkPriority
+	case r.hasSet():
+		return DefaultSetPriority
+	}
+	return DefaultPriority
+}
+
+// the classifier of the filter of a rule
+func filterKind(r *Rule) string {
+	switch {
+	case r.FwMark != nil || r.Cgroup != nil:
+		return "fw"
+	case r.hasSet():
+		return "basic"
+	}
+	return "u32"
+}
+
+// the handle to add the filter of a rule with, or nil to let the kernel choose one: fw filter handles are their marks, and
+// basic filters number their handles from 1 in each priority, so they are given the next one after all basic filters of the interface
+func newFilterHandle(rules *Rules, r *Rule) *string {
+	if filterKind(r) != "basic" {
+		return nil
+	}
+	next := uint64(1)
+	for _, f := range rules.Filters {
+		if f.Iface != *r.Iface || !isBasicFilter(f) || f.Options == nil || f.Options.FH == nil {
+			continue
+		}
+		if n, err := strconv.ParseUint(*f.Options.FH, 10, 32); err == nil && n >= next {
+			next = n + 1
 		}
 	}
+	return Ptr(strconv.FormatUint(next, 10))
+}
 
-	CleanupUnusedQdisc(verbose)
+// tc filter arguments up to the classifier options, for the filter of a rule; the all-traffic filter also matches other protocols than IPv4,
+// and a fw filter matches marked packets of any protocol, with the mark as its handle
+func filterArgs(verb string, iface string, r *Rule, handle *string) []string {
+	prio, protocol, kind := strconv.Itoa(defaultPriority(r)), "ip", filterKind(r)
+	switch {
+	case r.PassThrough:
+		prio = passPrio
+	case r.AllTraffic:
+		prio, protocol = allTrafficPrio, "all"
+	case r.Priority != nil:
+		prio = strconv.Itoa(*r.Priority)
+	}
+	if kind == "fw" {
+		protocol, handle = "all", Ptr(r.FwMark.String())
+	}
+	args := []string{"filter", verb, "dev", iface, "protocol", protocol, "parent", "1:0", "prio", prio}
+	if handle != nil {
+		args = append(args, "handle", *handle)
+	}
+	return append(args, kind)
+}
+
+// the kernel keeps the filters of a priority in one classifier, so they must be of the same kind, and fw filters must share their mask
+func checkPrio(rules *Rules, r *Rule) error {
+	prio, kind := defaultPriority(r), filterKind(r)
+	if r.Priority != nil {
+		prio = *r.Priority
+	}
+	for _, f := range rules.Filters {
+		if f.Iface != *r.Iface || f.Pref == nil || *f.Pref != prio || f.Kind == nil {
+			continue
+		}
+		if *f.Kind != kind {
+			return fmt.Errorf("%w: priority %d on interface %s has %s filters, %s filters need another priority", ErrConflictingRule, prio, *r.Iface, *f.Kind, kind)
+		}
+		if f.Options != nil && f.Options.MatchParsed.FwMark != nil && f.Options.MatchParsed.FwMark.Mask != r.FwMark.Mask {
+			return fmt.Errorf("%w: the fw filters of priority %d on interface %s use the mask 0x%x, which all fw filters of a priority share", ErrConflictingRule, prio, *r.Iface, f.Options.MatchParsed.FwMark.Mask)
+		}
+	}
 	return nil
 }
+
+// compare the filter parameters (source/destination IP and port, and the other matches) of two rules, and whether they are pass-through filters
+func sameFilter(a *Rule, b *Rule) bool {
+	return a.AllTraffic == b.AllTraffic && a.PassThrough == b.PassThrough && equalPtr(a.SourceIP, b.SourceIP) && equalPtr(a.DestinationIP, b.DestinationIP) && equalPtr(a.SourcePort, b.SourcePort) && equalPtr(a.DestinationPort, b.DestinationPort) &&
+		equalPtr(a.DSCP, b.DSCP) && equalPtr(a.TOS, b.TOS) && equalPtr(a.Length, b.Length) && equalPtr(a.TCPFlags, b.TCPFlags) && equalPtr(a.Protocol, b.Protocol) && sameMark(a, b) &&
+		equalPtr(a.SourceSet, b.SourceSet) && equalPtr(a.DestinationSet, b.DestinationSet)
+}
+
+// a cgroup rule without a mark yet is the rule of the same cgroup, whatever its mark; a rule of a listed filter, which knows
+// only the mark, is the cgroup rule with that mark
+func sameMark(a *Rule, b *Rule) bool {
+	switch {
+	case a.Cgroup != nil && b.Cgroup != nil:
+		return *a.Cgroup == *b.Cgroup && (a.FwMark == nil || b.FwMark == nil || *a.FwMark == *b.FwMark)
+	case a.Cgroup != nil || b.Cgroup != nil:
+		return a.FwMark != nil && b.FwMark != nil && *a.FwMark == *b.FwMark
+	}
+	return equalPtr(a.FwMark, b.FwMark)
+}
+
+// compare the actions of two rules, at the precision tc reports them with
+func sameActions(a *Rule, b *Rule) bool {
+	if !equalPtr(a.Latency, b.Latency) || !equalPtr(a.Jitter, b.Jitter) || !equalPtr(a.Distribution, b.Distribution) {
+		return false
+	}
+	if (a.PacketLoss == nil) != (b.PacketLoss == nil) || (a.PacketLoss != nil && !a.PacketLoss.equal(*b.PacketLoss)) {
+		return false
+	}
+	if (a.Corrupt == nil) != (b.Corrupt == nil) || (a.Corrupt != nil && !a.Corrupt.equal(*b.Corrupt)) {
+		return false
+	}
+	if (a.Rate == nil) != (b.Rate == nil) || (a.Rate != nil && !a.Rate.equal(*b.Rate)) {
+		return false
+	}
+	return true
+}
+
+// first prio band, on the given interface, which is not used by a netem qdisc; bands 1:1-1:3 are the default bands
+func freeFlowId(rules *Rules, iface string) (int, error) {
+	used := []int{}
+	for _, rule := range rules.Rules {
+		if rule.Iface == nil || *rule.Iface != iface || rule.FlowID == nil {
+			continue
+		}
+		fid := strings.Split(*rule.FlowID, ":")
+		if len(fid) != 2 {
+			continue
+		}
+		if a, err := strconv.ParseInt(fid[1], 16, 32); err == nil {
+			used = append(used, int(a))
+		}
+	}
+	for flowId := 4; flowId <= prioBands; flowId++ {
+		if !inslice.HasInt(used, flowId) {
+			return flowId, nil
+		}
+	}
+	return 0, fmt.Errorf("%w on interface %s, at most %d rules with distinct actions are supported", ErrFlowIDsExhausted, iface, prioBands-3)
+}
+
+// flow ID and netem qdisc handle for a prio band; tc parses both as hex
+func flowHandles(flowId int) (flowID *string, qdiscHandle *string) {
+	return StringToPtr("1:" + strconv.FormatInt(int64(flowId), 16)), StringToPtr(strconv.FormatInt(int64(flowId), 16) + "0:")
+}
@@ -0,0 +1,100 @@
+package tc
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tc cannot change the priority of a filter, so the filter of a rule which moves is added again; an fw filter comes back with the
+// same handle, its mark
+func TestSetMovesFwRule(t *testing.T) {
+	c, f, iface := newFakeClient(t)
+	ctx := context.Background()
+	mark, err := ParseFwMark("0x10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Set(ctx, &Rule{Iface: Ptr(iface), FwMark: &mark, Latency: Ptr(10 * time.Millisecond), Name: Ptr("marked")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := findRule(t, c, iface)
+	err = c.Set(ctx, &Rule{Iface: Ptr(iface), FwMark: &mark, Priority: Ptr(70), Latency: Ptr(10 * time.Millisecond)})
+	if err != nil {
+		t.Fatalf("moving the rule to priority 70: %v\n%s", err, strings.Join(f.commands, "\n"))
+	}
+	after := findRule(t, c, iface)
+	if !equalPtr(after.Priority, Ptr(70)) || !equalPtr(after.FilterHandle, Ptr("0x10")) {
+		t.Errorf("rule with handle %s, want priority 70 and handle 0x10; filters:\n%s", PtrToString(after.FilterHandle), strings.Join(f.filterLines(iface), "\n"))
+	}
+	if !equalPtr(after.ID, before.ID) || !equalPtr(after.Name, Ptr("marked")) {
+		t.Errorf("rule %s named %s, want %s named marked", PtrToString(after.ID), PtrToString(after.Name), PtrToString(before.ID))
+	}
+	if got := f.filterLines(iface); len(got) != 1 || !strings.HasPrefix(got[0], "70 fw 0x10 ") {
+		t.Errorf("filters:\n%s\nwant only the fw filter at priority 70", strings.Join(got, "\n"))
+	}
+}
+
+// the only rule of iface, which is not a pass-through filter
+func findRule(t *testing.T, c *Client, iface string) *Rule {
+	t.Helper()
+	rules, err := c.ListRules(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found *Rule
+	for _, r := range rules.Rules {
+		if *r.Iface != iface || r.PassThrough {
+			continue
+		}
+		if found != nil {
+			t.Fatalf("more than one rule on %s", iface)
+		}
+		found = r
+	}
+	if found == nil {
+		t.Fatalf("no rule on %s", iface)
+	}
+	return found
+}
+
+// the pass-through filter of an exception is tried before every rule, so it must not exempt traffic of rules tried before its own
+func TestSetExceptionOverlaps(t *testing.T) {
+	c, f, iface := newFakeClient(t)
+	ctx := context.Background()
+	latency := Ptr(10 * time.Millisecond)
+	ssh := []*Rule{{DestinationPort: Ptr(Port(22))}}
+	tests := []struct {
+		name string
+		rule *Rule
+		ok   bool
+	}{
+		{"rule", &Rule{DestinationIP: Ptr(netip.MustParsePrefix("10.0.0.0/8"))}, true},
+		{"exception overlapping a rule tried before", &Rule{AllTraffic: true, Except: ssh}, false},
+		{"exception overlapping no rule", &Rule{DestinationIP: Ptr(netip.MustParsePrefix("192.168.0.0/16")), Priority: Ptr(200), Except: ssh}, true},
+		{"rule tried before an overlapping exception", &Rule{DestinationIP: Ptr(netip.MustParsePrefix("192.168.1.0/24")), Priority: Ptr(150)}, false},
+		{"rule tried after an overlapping exception", &Rule{DestinationIP: Ptr(netip.MustParsePrefix("192.168.1.0/24")), Priority: Ptr(300)}, true},
+		{"rule moving before an overlapping exception", &Rule{DestinationIP: Ptr(netip.MustParsePrefix("192.168.1.0/24")), Priority: Ptr(150)}, false},
+	}
+	for _, tt := range tests {
+		tt.rule.Iface, tt.rule.Latency = Ptr(iface), latency
+		before := f.filterLines(iface)
+		err := c.Set(ctx, tt.rule)
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.ok {
+			if !errors.Is(err, ErrConflictingRule) {
+				t.Errorf("%s: got error %v, want %v", tt.name, err, ErrConflictingRule)
+			}
+			if got := f.filterLines(iface); !slices.Equal(got, before) {
+				t.Errorf("%s: filters changed to\n%s\nfrom\n%s", tt.name, strings.Join(got, "\n"), strings.Join(before, "\n"))
+			}
+		}
+	}
+}
@@ -1,7 +1,8 @@
 package tc
 
 import (
-	"log"
+	"net/netip"
+	"time"
 )
 
 /*
@@ -219,20 +220,33 @@ type Filter struct {
 }
 
 type FilterOptions struct {
-	FH          *string       `json:"fh"`
-	HtDivisor   *int          `json:"ht_divisor"`
-	Order       *int          `json:"order"`
-	KeyHt       *string       `json:"key_ht"`
-	Bkt         *string       `json:"bkt"`
-	FlowId      *string       `json:"flowid"`
-	NotInHw     *bool         `json:"not_in_hw"`
-	Match       FilterMatches `json:"match"`
-	MatchParsed struct {
-		SourceIPMask *string `json:"source_ip_mask"`
-		DestIPMask   *string `json:"dest_ip_mask"`
-		SourcePort   *int    `json:"source_port"`
-		DestPort     *int    `json:"dest_port"`
-	} `json:"match_parsed"`
+	FH          *string           `json:"fh"`
+	HtDivisor   *int              `json:"ht_divisor"`
+	Order       *int              `json:"order"`
+	KeyHt       *string           `json:"key_ht"`
+	Bkt         *string           `json:"bkt"`
+	FlowId      *string           `json:"flowid"`
+	NotInHw     *bool             `json:"not_in_hw"`
+	Match       FilterMatches     `json:"match"`
+	MatchParsed FilterMatchParsed `json:"match_parsed"`
+}
+
+// the u32 matches of a filter which easytc knows
+type FilterMatchParsed struct {
+	SourceIPMask *netip.Prefix `json:"source_ip_mask"`
+	DestIPMask   *netip.Prefix `json:"dest_ip_mask"`
+	SourcePort   *PortRange    `json:"source_port"`
+	DestPort     *PortRange    `json:"dest_port"`
+	DSCP         *uint8        `json:"dscp,omitempty"`
+	TOS          *uint8        `json:"tos,omitempty"`
+	Length       *PortRange    `json:"length,omitempty"`
+	Protocol     *uint8        `json:"protocol,omitempty"`
+	TCPFlags     *TCPFlags     `json:"tcp_flags,omitempty"`
+	// the mark of a fw filter, whose handle it is
+	FwMark *FwMark `json:"fw_mark,omitempty"`
+	// the ipset ematches of a basic filter
+	SourceSet *string `json:"source_set,omitempty"`
+	DestSet   *string `json:"dest_set,omitempty"`
 }
 
 type FilterMatch struct {
@@ -254,26 +268,62 @@ type Rules struct {
 type Rule struct {
 	// set, delete
 	Iface           *string
-	SourceIP        *string
-	SourcePort      *string
-	DestinationIP   *string
-	DestinationPort *string
+	SourceIP        *netip.Prefix
+	SourcePort      *PortRange
+	DestinationIP   *netip.Prefix
+	DestinationPort *PortRange
+	// DSCP class, 0-63, or the whole TOS byte; only one of them can be set
+	DSCP *uint8
+	TOS  *uint8
+	// IP total length range, in bytes, matched by a single mask like port ranges
+	Length *PortRange
+	// TCP flags, only matching TCP packets; IP options are not taken into account, as for ports
+	TCPFlags *TCPFlags
+	// IP protocol number, such as 6 for TCP (see ParseProtocol); cannot be combined with TCPFlags, which imply TCP
+	Protocol *uint8
+	// firewall mark set by iptables or nftables, matched by a fw filter instead of u32; cannot be combined with the other filter fields
+	FwMark *FwMark
+	// nftables expression, such as "ct state new", for a rule in the easytc table which sets FwMark on the matching packets leaving
+	// the interface; set only, kept unless given, and removed if empty; filled in by ListRules
+	NftMatch *string
+	// cgroup v2 path relative to the cgroup root, such as system.slice/foo.service (see ParseCgroup and PidCgroup): a fw rule whose
+	// mark, CgroupMarkMask bits unless FwMark is given, is set by an nftables rule on the packets of the sockets of the cgroup;
+	// kept in the easytc state directory and filled in by ListRules
+	Cgroup *string
+	// names of kernel ipsets of IPv4 addresses and networks, matched by a basic filter with the ipset ematch instead of u32; the sets
+	// are created if they do not exist, and their members are changed with AddSetMembers, DelSetMembers and ReplaceSetMembers;
+	// cannot be combined with the other filter fields
+	SourceSet      *string
+	DestinationSet *string
+	// match every packet of the interface which no more specific rule matches, instead of filtering
+	AllTraffic bool
+	// rules with a lower priority are tried first, from MinPriority to MaxPriority; set, kept unless given, and filled in by ListRules
+	Priority *int
 	// set only
-	LatencyMs          *string
-	PacketLossPct      *string
-	LinkSpeedRateBytes *string
-	CorruptPct         *string
+	Latency      *time.Duration
+	Jitter       *time.Duration
+	Distribution *string
+	PacketLoss   *Percent
+	Rate         *Rate
+	Corrupt      *Percent
+	// identity, kept in the easytc state directory; set, and Name also selects the rules to delete
+	Name   *string
+	Labels map[string]string
+	// traffic of the rule's filter which is not impaired, each narrowing the filter by its own filter fields; set only, kept unless given
+	Except []*Rule
 	// output only parameters
-	FlowID       *string
-	FilterNo     int
+	// stable ID, assigned when the rule is created
+	ID *string
+	// a pass-through filter to the default band, which has no actions: an exception of the rule with the ID ExceptionOf, or a protected filter
+	PassThrough bool
+	ExceptionOf *string
+	Protected   bool
+	FlowID      *string
+	FilterNo    int
+	// also selects the rule to update or delete, together with Iface
 	FilterHandle *string
 	QdiscNo      int
 	QdiscHandle  *string
-}
-
-func logf(verbose bool, format string, v ...interface{}) {
-	if !verbose {
-		return
-	}
-	log.Printf("VERBOSE: "+format, v...)
+	// rules on the interface which overlap the rule after Set
+	Conflicts []*Conflict
 }
@@ -0,0 +1,355 @@
+package tc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// the transaction has already been committed or rolled back
+var ErrTxDone = errors.New("transaction has already been committed or rolled back")
+
+// rule changes which are applied together, or rolled back together; create with Client.Begin.
+// The transaction holds the lock of the namespace until it is committed or rolled back, other changes of the namespace wait for it.
+type Tx struct {
+	c      *Client
+	unlock func()
+	before *txSnapshot
+	done   bool
+}
+
+// the rules, root qdisc ownership and rule identities of all interfaces, to roll back to
+type txSnapshot struct {
+	rules *Rules
+	// state files by interface, nil if there was none
+	states map[string]*ifaceState
+}
+
+// start a transaction; the changes made through it are rolled back to the rules at this point, unless it is committed
+func (c *Client) Begin(ctx context.Context) (*Tx, error) {
+	unlock, err := c.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	before, err := c.takeSnapshot(ctx)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	return &Tx{c: c, unlock: unlock, before: before}, nil
+}
+
+// see Client.Set; a failed change is undone, the earlier changes of the transaction remain until Rollback
+func (tx *Tx) Set(ctx context.Context, r *Rule) error {
+	return tx.do(ctx, func() error {
+		return tx.c.setRule(ctx, r)
+	})
+}
+
+// see Client.Update; a failed change is undone, the earlier changes of the transaction remain until Rollback
+func (tx *Tx) Update(ctx context.Context, r *Rule) error {
+	return tx.do(ctx, func() error {
+		return tx.c.updateRule(ctx, r)
+	})
+}
+
+// see Client.Delete; a failed change is undone, the earlier changes of the transaction remain until Rollback
+func (tx *Tx) Delete(ctx context.Context, r *Rule) error {
+	return tx.do(ctx, func() error {
+		return tx.c.deleteRule(ctx, r)
+	})
+}
+
+// see Client.DeleteMatching; a failed change is undone, the earlier changes of the transaction remain until Rollback
+func (tx *Tx) DeleteMatching(ctx context.Context, s *Selector) ([]*Rule, error) {
+	var removed []*Rule
+	err := tx.do(ctx, func() error {
+		var err error
+		removed, err = tx.c.deleteMatching(ctx, s)
+		return err
+	})
+	return removed, err
+}
+
+func (tx *Tx) do(ctx context.Context, fn func() error) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	return tx.c.undoOnError(ctx, fn)
+}
+
+// keep the changes, and release the lock
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	tx.unlock()
+	return nil
+}
+
+// undo all changes made since Begin, and release the lock; returns ErrTxDone after Commit, so that it can be deferred
+func (tx *Tx) Rollback(ctx context.Context) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	defer tx.unlock()
+	return tx.c.rollbackTo(ctx, tx.before)
+}
+
+func (c *Client) takeSnapshot(ctx context.Context) (*txSnapshot, error) {
+	rules, err := c.ListRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	snap := &txSnapshot{rules: rules, states: make(map[string]*ifaceState)}
+	for _, iface := range rules.Interfaces {
+		state, err := c.readState(iface)
+		if err != nil {
+			return nil, err
+		}
+		snap.states[iface] = state
+	}
+	return snap, nil
+}
+
+// run a change, and undo whatever it did if it fails half way; the lock must be held
+func (c *Client) undoOnError(ctx context.Context, fn func() error) error {
+	before, err := c.takeSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	err = fn()
+	if err == nil {
+		return nil
+	}
+	rerr := c.rollbackTo(ctx, before)
+	if rerr != nil {
+		return errors.Join(err, fmt.Errorf("rolling back: %w", rerr))
+	}
+	return err
+}
+
+// change the rules of all interfaces back to a snapshot, touching only what differs
+func (c *Client) rollbackTo(ctx context.Context, before *txSnapshot) error {
+	// roll back also when the change was cancelled
+	ctx = context.WithoutCancel(ctx)
+	now, err := c.ListRules(ctx)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, iface := range before.rules.Interfaces {
+		err = c.rollbackIface(ctx, iface, before, now)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("interface %s: %w", iface, err))
+		}
+	}
+	if len(errs) == 0 {
+		c.log.Debug("rolled back")
+	}
+	return errors.Join(errs...)
+}
+
+// the actions of a netem qdisc, with the distribution table its rules were set with, which tc does not list
+func qdiscActions(rules *Rules, iface string, q *Qdisc) *Rule {
+	r := netemRule(q)
+	for _, rule := range rules.Rules {
+		if rule.Iface != nil && *rule.Iface == iface && equalPtr(rule.QdiscHandle, q.Handle) && rule.Distribution != nil {
+			r.Distribution = rule.Distribution
+			break
+		}
+	}
+	return r
+}
+
+func (c *Client) rollbackIface(ctx context.Context, iface string, before *txSnapshot, now *Rules) error {
+	err := c.rollbackNft(ctx, iface, before)
+	if err != nil {
+		return err
+	}
+	beforeOwn := isOwnRoot(rootQdisc(before.rules.Qdisc, iface))
+	nowOwn := isOwnRoot(rootQdisc(now.Qdisc, iface))
+	if !beforeOwn {
+		if nowOwn {
+			err := c.tcExec(ctx, "qdisc", "del", "dev", iface, "root")
+			if err != nil {
+				return err
+			}
+		}
+		return c.restoreState(iface, before)
+	}
+	if !nowOwn {
+		err := c.initRoot(ctx, iface, now.Qdisc)
+		if err != nil {
+			return err
+		}
+	}
+
+	// netem qdiscs, so that the filters have their flows to point to
+	beforeQ := netemQdiscs(before.rules, iface)
+	nowQ := []*Qdisc{}
+	if nowOwn {
+		nowQ = netemQdiscs(now, iface)
+	}
+	for _, q := range beforeQ {
+		cur := qdiscByParent(nowQ, *q.Parent)
+		if cur != nil && PtrToString(cur.Handle) == PtrToString(q.Handle) && sameActions(qdiscActions(now, iface, cur), qdiscActions(before.rules, iface, q)) {
+			continue
+		}
+		err := c.tcExec(ctx, append([]string{"qdisc", "replace", "dev", iface, "parent", *q.Parent, "handle", PtrToString(q.Handle)}, netemParams(qdiscActions(before.rules, iface, q))...)...)
+		if err != nil {
+			return err
+		}
+	}
+
+	// filters which were added or changed, then the ones which were removed or moved to another flow
+	beforeF := ownFilters(before.rules, iface)
+	nowF := []*Filter{}
+	if nowOwn {
+		nowF = ownFilters(now, iface)
+	}
+	kept := []*Filter{}
+	for _, f := range nowF {
+		if b := filterByHandle(beforeF, *f.Options.FH); b != nil && sameFilter(filterRule(b), filterRule(f)) {
+			kept = append(kept, f)
+			continue
+		}
+		err := c.tcExec(ctx, filterArgs("del", iface, filterRule(f), f.Options.FH)...)
+		if err != nil {
+			return err
+		}
+	}
+	for _, f := range beforeF {
+		cur := filterByHandle(kept, *f.Options.FH)
+		if cur != nil {
+			if *cur.Options.FlowId == *f.Options.FlowId {
+				continue
+			}
+			err := c.tcExec(ctx, append(append(filterArgs("replace", iface, filterRule(f), f.Options.FH), replaceMatches(filterRule(f))...), "flowid", *f.Options.FlowId)...)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		params := append(filterArgs("add", iface, filterRule(f), f.Options.FH), matchArgs(filterRule(f))...)
+		err := c.tcExec(ctx, append(params, "flowid", *f.Options.FlowId)...)
+		if err != nil {
+			return err
+		}
+	}
+
+	// netem qdiscs which did not exist before
+	for _, q := range nowQ {
+		if qdiscByParent(beforeQ, *q.Parent) != nil {
+			continue
+		}
+		err := c.tcExec(ctx, "qdisc", "del", "dev", iface, "parent", *q.Parent, "handle", PtrToString(q.Handle))
+		if err != nil {
+			return err
+		}
+	}
+	return c.restoreState(iface, before)
+}
+
+// write back the state file of an interface as it was, with the identities of its rules
+func (c *Client) restoreState(iface string, before *txSnapshot) error {
+	if before.states[iface] == nil {
+		return c.removeState(iface)
+	}
+	return c.writeState(before.states[iface])
+}
+
+// netem qdiscs of an interface, in the order of their flow IDs
+func netemQdiscs(rules *Rules, iface string) []*Qdisc {
+	qdiscs := []*Qdisc{}
+	for _, q := range rules.Qdisc {
+		if q.Kind == nil || *q.Kind != "netem" || q.Dev == nil || *q.Dev != iface || q.Parent == nil || q.Options == nil {
+			continue
+		}
+		qdiscs = append(qdiscs, q)
+	}
+	slices.SortFunc(qdiscs, func(a, b *Qdisc) int {
+		return flowNo(*a.Parent) - flowNo(*b.Parent)
+	})
+	return qdiscs
+}
+
+// band number of a flow ID, for example 10 for 1:a
+func flowNo(flowID string) int {
+	_, minor, _ := strings.Cut(flowID, ":")
+	n, _ := strconv.ParseInt(minor, 16, 32)
+	return int(n)
+}
+
+func qdiscByParent(qdiscs []*Qdisc, parent string) *Qdisc {
+	for _, q := range qdiscs {
+		if *q.Parent == parent {
+			return q
+		}
+	}
+	return nil
+}
+
+// u32 and fw filters of an interface which point to a flow
+func ownFilters(rules *Rules, iface string) []*Filter {
+	filters := []*Filter{}
+	for _, f := range rules.Filters {
+		if f.Iface != iface || f.Options == nil || f.Options.FH == nil || f.Options.FlowId == nil {
+			continue
+		}
+		filters = append(filters, f)
+	}
+	return filters
+}
+
+func filterByHandle(filters []*Filter, handle string) *Filter {
+	for _, f := range filters {
+		if *f.Options.FH == handle {
+			return f
+		}
+	}
+	return nil
+}
+
+// the catch-all filter of an all-traffic rule, at its own priority; fw filters match all protocols as well
+func isAllTrafficFilter(f *Filter) bool {
+	return f.Protocol != nil && *f.Protocol == "all" && !isFwFilter(f)
+}
+
+func isFwFilter(f *Filter) bool {
+	return f.Kind != nil && *f.Kind == "fw"
+}
+
+func isBasicFilter(f *Filter) bool {
+	return f.Kind != nil && *f.Kind == "basic"
+}
+
+func isPassFilter(f *Filter) bool {
+	return f.Pref != nil && strconv.Itoa(*f.Pref) == passPrio
+}
+
+// rule with the matches of a filter
+func filterRule(f *Filter) *Rule {
+	return &Rule{
+		SourceIP:        f.Options.MatchParsed.SourceIPMask,
+		DestinationIP:   f.Options.MatchParsed.DestIPMask,
+		SourcePort:      f.Options.MatchParsed.SourcePort,
+		DestinationPort: f.Options.MatchParsed.DestPort,
+		DSCP:            f.Options.MatchParsed.DSCP,
+		TOS:             f.Options.MatchParsed.TOS,
+		Length:          f.Options.MatchParsed.Length,
+		TCPFlags:        f.Options.MatchParsed.TCPFlags,
+		Protocol:        f.Options.MatchParsed.protocol(),
+		FwMark:          f.Options.MatchParsed.FwMark,
+		SourceSet:       f.Options.MatchParsed.SourceSet,
+		DestinationSet:  f.Options.MatchParsed.DestSet,
+		AllTraffic:      isAllTrafficFilter(f),
+		PassThrough:     isPassFilter(f),
+		Priority:        f.Pref,
+	}
+}
@@ -0,0 +1,152 @@
+package tc
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the qdiscs, filters and nftables rules of dev, and its state file, in a form easy to compare
+func (f *fakeRunner) tree(t *testing.T, c *Client, dev string) string {
+	t.Helper()
+	path, err := c.statePath(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+	lines := slices.Concat(f.qdiscLines(dev), f.filterLines(dev), f.nftLines(), []string{"state " + string(state)})
+	return strings.Join(lines, "\n")
+}
+
+// a change which fails half way is undone, and the transaction rolls back the changes made before it
+func TestTxUndoOnError(t *testing.T) {
+	mark, err := ParseFwMark("0x10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	web := &Rule{DestinationIP: Ptr(netip.MustParsePrefix("10.0.0.0/8")), Latency: Ptr(10 * time.Millisecond), Name: Ptr("web")}
+	ssh := &Rule{FwMark: &mark, NftMatch: Ptr("tcp dport 22"), Latency: Ptr(20 * time.Millisecond)}
+	tests := []struct {
+		name  string
+		rules []*Rule
+		// a change made in the transaction before the failing one, if not nil
+		first *Rule
+		// the command which fails
+		fail   string
+		change func(ctx context.Context, tx *Tx, iface string) error
+	}{
+		{
+			"set failing after its qdisc was added",
+			[]*Rule{web, ssh},
+			&Rule{DestinationIP: Ptr(netip.MustParsePrefix("172.16.0.0/12")), Latency: Ptr(40 * time.Millisecond)},
+			"match ip dst 192.168.0.0/16",
+			func(ctx context.Context, tx *Tx, iface string) error {
+				return tx.Set(ctx, &Rule{Iface: Ptr(iface), DestinationIP: Ptr(netip.MustParsePrefix("192.168.0.0/16")), Latency: Ptr(30 * time.Millisecond)})
+			},
+		},
+		{
+			// the filter has moved to a new flow, the old qdisc and the nftables rule are gone
+			"set failing on its nftables rule",
+			[]*Rule{web, ssh},
+			&Rule{DestinationIP: Ptr(netip.MustParsePrefix("172.16.0.0/12")), Latency: Ptr(40 * time.Millisecond)},
+			"tcp dport 2222",
+			func(ctx context.Context, tx *Tx, iface string) error {
+				return tx.Set(ctx, &Rule{Iface: Ptr(iface), FwMark: &mark, NftMatch: Ptr("tcp dport 2222"), Latency: Ptr(25 * time.Millisecond)})
+			},
+		},
+		{
+			"delete failing after its filter was removed",
+			[]*Rule{web, ssh},
+			&Rule{FwMark: &mark, NftMatch: Ptr("tcp dport 2222"), Latency: Ptr(20 * time.Millisecond)},
+			"qdisc del",
+			func(ctx context.Context, tx *Tx, iface string) error {
+				return tx.Delete(ctx, &Rule{Iface: Ptr(iface), Name: Ptr("web")})
+			},
+		},
+		{
+			"delete matching failing after its filter was removed",
+			[]*Rule{web, ssh},
+			nil,
+			"qdisc del",
+			func(ctx context.Context, tx *Tx, iface string) error {
+				_, err := tx.DeleteMatching(ctx, &Selector{Iface: Ptr(iface), Name: Ptr("web")})
+				return err
+			},
+		},
+		{
+			// the root qdisc was added for the rule
+			"first rule of the interface",
+			nil,
+			nil,
+			"flowid",
+			func(ctx context.Context, tx *Tx, iface string) error {
+				return tx.Set(ctx, &Rule{Iface: Ptr(iface), DestinationIP: Ptr(netip.MustParsePrefix("192.168.0.0/16")), Latency: Ptr(30 * time.Millisecond)})
+			},
+		},
+	}
+	for _, tt := range tests {
+		c, f, iface := newFakeClient(t)
+		ctx := context.Background()
+		for _, r := range tt.rules {
+			r = r.clone()
+			r.Iface = &iface
+			err := c.Set(ctx, r)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		want := f.tree(t, c, iface)
+
+		tx, err := c.Begin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.first != nil {
+			r := tt.first.clone()
+			r.Iface = &iface
+			err = tx.Set(ctx, r)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		mid := f.tree(t, c, iface)
+		f.fail = tt.fail
+		f.commands = nil
+		err = tt.change(ctx, tx, iface)
+		var cerr *CommandError
+		if !errors.As(err, &cerr) || !strings.Contains(strings.Join(cerr.Argv, " "), tt.fail) {
+			t.Fatalf("%s: got error %v, want the failure of the command containing %q", tt.name, err, tt.fail)
+		}
+		failed := slices.IndexFunc(f.commands, func(cmd string) bool {
+			return strings.Contains(cmd, tt.fail)
+		})
+		if !slices.ContainsFunc(f.commands[:failed], func(cmd string) bool {
+			return !strings.Contains(cmd, " show") && !strings.Contains(cmd, " list ") && cmd != "lsmod"
+		}) {
+			t.Errorf("%s: nothing was changed before the failure:\n%s", tt.name, strings.Join(f.commands, "\n"))
+		}
+		f.fail = ""
+		if got := f.tree(t, c, iface); got != mid {
+			t.Errorf("%s: after the failed change:\n%s\nwant\n%s", tt.name, got, mid)
+		}
+
+		err = tx.Rollback(ctx)
+		if err != nil {
+			t.Fatalf("%s: rollback: %v", tt.name, err)
+		}
+		if got := f.tree(t, c, iface); got != want {
+			t.Errorf("%s: after rollback:\n%s\nwant\n%s", tt.name, got, want)
+		}
+		if err := tx.Rollback(ctx); !errors.Is(err, ErrTxDone) {
+			t.Errorf("%s: second rollback: got error %v, want %v", tt.name, err, ErrTxDone)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package tc
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// tc takes times, rates and percentages with units, prints them with units, and lists the netem options in json in seconds,
+// bytes per second and fractions; all conversions between them are made here, so that a rule reads back as it was set
+
+// percentage, 0-100
+type Percent float64
+
+func (p Percent) String() string {
+	return strconv.FormatFloat(float64(p), 'f', -1, 64)
+}
+
+// tc reports percentages with limited precision, compare to 2 decimals
+func (p Percent) equal(q Percent) bool {
+	return math.Round(float64(p)*100) == math.Round(float64(q)*100)
+}
+
+// parse a percentage, with or without a trailing '%', such as 0.5%
+func ParsePercent(s string) (Percent, error) {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("invalid percentage %q", s)
+	}
+	return Percent(v), nil
+}
+
+// the percentage of a fraction as tc lists it; the kernel keeps a fraction of 2^32, tc prints it with 6 significant digits,
+// so the rounding noise of the conversion is dropped
+func fractionPercent(f float64) Percent {
+	return Percent(math.Round(f*1e8) / 1e6)
+}
+
+// rate in bits per second
+type Rate uint64
+
+// the rate as given to tc
+func (r Rate) String() string {
+	return strconv.FormatUint(uint64(r), 10) + "bit"
+}
+
+// rate in bytes per second, as stored by the kernel
+func (r Rate) BytesPerSecond() uint64 {
+	return uint64(r) / 8
+}
+
+// the kernel stores rates in bytes per second, compare at that precision
+func (r Rate) equal(q Rate) bool {
+	return r.BytesPerSecond() == q.BytesPerSecond()
+}
+
+// rate prefixes, 1000-based as tc takes them, or 1024-based with an i
+var ratePrefixes = map[string]float64{
+	"": 1, "k": 1e3, "m": 1e6, "g": 1e9, "t": 1e12,
+	"ki": 1 << 10, "mi": 1 << 20, "gi": 1 << 30, "ti": 1 << 40,
+}
+
+// bits per second of a rate unit: bit for bits, B or bps for bytes per second, after a prefix; case is ignored
+func rateUnit(u string) (float64, bool) {
+	u = strings.ToLower(u)
+	bytes := false
+	switch {
+	case u == "":
+	case strings.HasSuffix(u, "bit"):
+		u = strings.TrimSuffix(u, "bit")
+	case strings.HasSuffix(u, "bps"):
+		u, bytes = strings.TrimSuffix(u, "bps"), true
+	case strings.HasSuffix(u, "b"):
+		u, bytes = strings.TrimSuffix(u, "b"), true
+	default:
+		return 0, false
+	}
+	v, ok := ratePrefixes[u]
+	if bytes {
+		v *= 8
+	}
+	return v, ok
+}
+
+// parse a rate with its unit, such as 10mbit, 1.5MB or 100kbps: bit for bits per second, B or bps for bytes per second, with
+// the prefixes k, m, g and t, which are 1000-based as for tc, or ki, mi, gi and ti; a number alone is in bits per second, as for tc
+func ParseRate(s string) (Rate, error) {
+	number, unit := splitUnit(s)
+	v, err := strconv.ParseFloat(number, 64)
+	mult, ok := rateUnit(unit)
+	if err != nil || !ok || !(v >= 0 && v*mult < math.MaxUint64) {
+		return 0, fmt.Errorf("invalid rate %q, must be a number with a unit such as 10mbit or 1.5MB", s)
+	}
+	return Rate(math.Round(v * mult)), nil
+}
+
+// parse a rate as ParseRate does, but a number alone is in unit, such as "B" for the bytes per second of --rate-bytes
+func ParseRateDefault(s string, unit string) (Rate, error) {
+	if _, u := splitUnit(s); u == "" {
+		r, err := ParseRate(s + unit)
+		if err != nil {
+			return 0, fmt.Errorf("invalid rate %q, must be a number of %s or a number with a unit such as 10mbit or 1.5MB", s, unit)
+		}
+		return r, nil
+	}
+	return ParseRate(s)
+}
+
+// a rate of bytes per second, rounded to the bit
+func BytesRate(bytes float64) Rate {
+	return Rate(math.Round(bytes * 8))
+}
+
+// the rate in the largest 1000-based unit of bits per second it has one of, such as 1.5Mbit; ParseRate reads it back exactly
+func FormatRate(r Rate) string {
+	units := []string{"bit", "Kbit", "Mbit", "Gbit", "Tbit"}
+	i := 0
+	for limit := uint64(1000); i < len(units)-1 && uint64(r) >= limit; limit *= 1000 {
+		i++
+	}
+	return decimal(uint64(r), 3*i) + units[i]
+}
+
+// time units, as tc takes and prints them
+var durationUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond, "µs": time.Microsecond, "usec": time.Microsecond, "usecs": time.Microsecond,
+	"ms": time.Millisecond, "msec": time.Millisecond, "msecs": time.Millisecond,
+	"s": time.Second, "sec": time.Second, "secs": time.Second,
+}
+
+// parse a duration with its unit, such as 250us, 100ms or 1.2s
+func ParseDuration(s string) (time.Duration, error) {
+	number, unit := splitUnit(s)
+	v, err := strconv.ParseFloat(number, 64)
+	mult, ok := durationUnits[strings.ToLower(unit)]
+	if err != nil || !ok || !(math.Abs(v*float64(mult)) < math.MaxInt64) {
+		return 0, fmt.Errorf("invalid duration %q, must be a number with a unit such as 250us, 100ms or 1.2s", s)
+	}
+	return time.Duration(math.Round(v * float64(mult))), nil
+}
+
+// parse a duration as ParseDuration does, but a number alone is in unit, such as "ms" for --latency-ms
+func ParseDurationDefault(s string, unit string) (time.Duration, error) {
+	if _, u := splitUnit(s); u == "" {
+		d, err := ParseDuration(s + unit)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q, must be a number of %s or a number with a unit such as 250us, 100ms or 1.2s", s, unit)
+		}
+		return d, nil
+	}
+	return ParseDuration(s)
+}
+
+// the duration in the largest of the units s, ms and us it has one of, such as 1.2s or 250us; ParseDuration reads it back exactly
+func FormatDuration(d time.Duration) string {
+	sign := ""
+	if d < 0 {
+		sign, d = "-", -d
+	}
+	switch {
+	case d == 0:
+		return "0s"
+	case d >= time.Second:
+		return sign + decimal(uint64(d), 9) + "s"
+	case d >= time.Millisecond:
+		return sign + decimal(uint64(d), 6) + "ms"
+	case d >= time.Microsecond:
+		return sign + decimal(uint64(d), 3) + "us"
+	}
+	return sign + decimal(uint64(d), 0) + "ns"
+}
+
+// duration in the format accepted by tc
+func tcTime(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', -1, 64) + "ms"
+}
+
+// a duration of fractional milliseconds, at the microsecond precision of netem
+func Milliseconds(ms float64) time.Duration {
+	return time.Duration(ms * float64(time.Millisecond)).Round(time.Microsecond)
+}
+
+// tc reports times in seconds, with microsecond precision
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second)).Round(time.Microsecond)
+}
+
+// a number and the unit after it, from the first letter which is not the exponent of the number, such as the e of 1.5e6bit
+func splitUnit(s string) (string, string) {
+	for i, c := range s {
+		if !unicode.IsLetter(c) {
+			continue
+		}
+		if (c == 'e' || c == 'E') && i > 0 && strings.ContainsRune("0123456789.", rune(s[i-1])) {
+			exp := s[i+1:]
+			if strings.HasPrefix(exp, "+") || strings.HasPrefix(exp, "-") {
+				exp = exp[1:]
+			}
+			if exp != "" && exp[0] >= '0' && exp[0] <= '9' {
+				continue
+			}
+		}
+		return s[:i], s[i:]
+	}
+	return s, ""
+}
+
+// n divided by 10^digits, without trailing zeros
+func decimal(n uint64, digits int) string {
+	s := strconv.FormatUint(n, 10)
+	if digits == 0 {
+		return s
+	}
+	if len(s) <= digits {
+		s = strings.Repeat("0", digits-len(s)+1) + s
+	}
+	s = s[:len(s)-digits] + "." + s[len(s)-digits:]
+	return strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+}
@@ -0,0 +1,273 @@
+package tc
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Rate
+	}{
+		{"125", 125},
+		{"125bit", 125},
+		{"10mbit", 10_000_000},
+		{"10Mbit", 10_000_000},
+		{"1.5MB", 12_000_000},
+		{"100kbps", 800_000},
+		{"2Gbit", 2_000_000_000},
+		{"1tbit", 1_000_000_000_000},
+		{"1kibit", 1024},
+		{"1Mibit", 1 << 20},
+		{"1mibps", 8 << 20},
+		{"1GiB", 8 << 30},
+		{"0.5Kbit", 500},
+		{"0.1bit", 0},
+		// numbers with an exponent
+		{"1e3bit", 1000},
+		{"1.5e6bit", 1_500_000},
+		{"1E3kbit", 1_000_000},
+		{"2e-3kbit", 2},
+		{"1e3", 1000},
+	}
+	for _, tt := range tests {
+		got, err := ParseRate(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseRate(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"", "mbit", "10furlongs", "-1bit", "NaN", "inf", "1ebit", "1e+bit", "e3bit", "1..5mbit", "99999999999tbit", "1e20tbit"} {
+		if got, err := ParseRate(in); err == nil {
+			t.Errorf("ParseRate(%q) = %d, want an error", in, got)
+		}
+	}
+}
+
+func TestParseRateDefault(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Rate
+	}{
+		{"125000", 1_000_000},
+		{"0.3", 2},
+		{"1e3", 8000},
+		{"10mbit", 10_000_000},
+	}
+	for _, tt := range tests {
+		got, err := ParseRateDefault(tt.in, "B")
+		if err != nil || got != tt.want {
+			t.Errorf("ParseRateDefault(%q, B) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"-1", "NaN", "Inf", "+Inf", "x"} {
+		if got, err := ParseRateDefault(in, "B"); err == nil {
+			t.Errorf("ParseRateDefault(%q, B) = %d, want an error", in, got)
+		}
+	}
+}
+
+func TestFormatRate(t *testing.T) {
+	tests := []struct {
+		in   Rate
+		want string
+	}{
+		{0, "0bit"},
+		{999, "999bit"},
+		{1000, "1Kbit"},
+		{1500, "1.5Kbit"},
+		{10_000_000, "10Mbit"},
+		{12_345_678, "12.345678Mbit"},
+		{1 << 30, "1.073741824Gbit"},
+		{2_000_000_000_000, "2Tbit"},
+		{5_000_000_000_000_000, "5000Tbit"},
+	}
+	for _, tt := range tests {
+		got := FormatRate(tt.in)
+		if got != tt.want {
+			t.Errorf("FormatRate(%d) = %q, want %q", tt.in, got, tt.want)
+		}
+		back, err := ParseRate(got)
+		if err != nil || back != tt.in {
+			t.Errorf("ParseRate(FormatRate(%d)) = %d, %v", tt.in, back, err)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+	}{
+		{"250us", 250 * time.Microsecond},
+		{"250µs", 250 * time.Microsecond},
+		{"250usec", 250 * time.Microsecond},
+		{"100ms", 100 * time.Millisecond},
+		{"1.5msec", 1500 * time.Microsecond},
+		{"1.2s", 1200 * time.Millisecond},
+		{"2secs", 2 * time.Second},
+		{"3ns", 3 * time.Nanosecond},
+		{"0.0001s", 100 * time.Microsecond},
+		{"-5ms", -5 * time.Millisecond},
+		// numbers with an exponent
+		{"1e3ms", time.Second},
+		{"1e-3s", time.Millisecond},
+		{"2.5E+2us", 250 * time.Microsecond},
+	}
+	for _, tt := range tests {
+		got, err := ParseDuration(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseDuration(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"", "5", "ms", "3h", "1m", "NaN", "Inf", "1e3", "1esec", "1e-s", "9999999999s", "1e10s"} {
+		if got, err := ParseDuration(in); err == nil {
+			t.Errorf("ParseDuration(%q) = %v, want an error", in, got)
+		}
+	}
+}
+
+func TestParseDurationDefault(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+	}{
+		{"100", 100 * time.Millisecond},
+		{"0.25", 250 * time.Microsecond},
+		{"1e2", 100 * time.Millisecond},
+		{"1.2s", 1200 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		got, err := ParseDurationDefault(tt.in, "ms")
+		if err != nil || got != tt.want {
+			t.Errorf("ParseDurationDefault(%q, ms) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"NaN", "Inf", "-Inf", "x"} {
+		if got, err := ParseDurationDefault(in, "ms"); err == nil {
+			t.Errorf("ParseDurationDefault(%q, ms) = %v, want an error", in, got)
+		}
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	tests := []struct {
+		in   time.Duration
+		want string
+	}{
+		{0, "0s"},
+		{3 * time.Nanosecond, "3ns"},
+		{250 * time.Microsecond, "250us"},
+		{1500 * time.Microsecond, "1.5ms"},
+		{100 * time.Millisecond, "100ms"},
+		{33_333 * time.Microsecond, "33.333ms"},
+		{1200 * time.Millisecond, "1.2s"},
+		{1_234_567_891 * time.Nanosecond, "1.234567891s"},
+		{-5 * time.Millisecond, "-5ms"},
+	}
+	for _, tt := range tests {
+		got := FormatDuration(tt.in)
+		if got != tt.want {
+			t.Errorf("FormatDuration(%v) = %q, want %q", tt.in, got, tt.want)
+		}
+		back, err := ParseDuration(got)
+		if err != nil || back != tt.in {
+			t.Errorf("ParseDuration(FormatDuration(%v)) = %v, %v", tt.in, back, err)
+		}
+	}
+}
+
+func TestParsePercent(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Percent
+	}{
+		{"5", 5},
+		{"5%", 5},
+		{"0.5%", 0.5},
+		{"0.07", 0.07},
+		{"100%", 100},
+	}
+	for _, tt := range tests {
+		got, err := ParsePercent(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParsePercent(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"", "%", "x%", "5%%", "NaN", "Inf%"} {
+		if got, err := ParsePercent(in); err == nil {
+			t.Errorf("ParsePercent(%q) = %v, want an error", in, got)
+		}
+	}
+}
+
+func TestFractionPercent(t *testing.T) {
+	// 7% as the kernel keeps it, a fraction of 2^32, and as tc lists it
+	for _, f := range []float64{0.07, 300647710.0 / (1<<32 - 1)} {
+		if got := fractionPercent(f); got != 7 {
+			t.Errorf("fractionPercent(%v) = %v, want 7", f, got)
+		}
+	}
+}
+
+// the actions of a rule read back from the netem options tc prints without json
+func TestNetemTextRoundTrip(t *testing.T) {
+	tests := []*Rule{
+		{Latency: Ptr(250 * time.Microsecond), Jitter: Ptr(1200 * time.Millisecond), PacketLoss: Ptr(Percent(0.5)), Corrupt: Ptr(Percent(0.07)), Rate: Ptr(Rate(10_000_000))},
+		{Latency: Ptr(33_333 * time.Microsecond), Rate: Ptr(Rate(12_345_672))},
+		{Latency: Ptr(1500 * time.Millisecond), PacketLoss: Ptr(Percent(7))},
+		{Rate: Ptr(Rate(8 << 30))},
+		{Corrupt: Ptr(Percent(100))},
+	}
+	for _, want := range tests {
+		// as tc prints them: times and rates with units, the jitter after the delay, percentages with '%'
+		line := []string{"limit", "1000"}
+		if want.Latency != nil {
+			line = append(line, "delay", FormatDuration(*want.Latency))
+			if want.Jitter != nil {
+				line = append(line, "", FormatDuration(*want.Jitter))
+			}
+		}
+		if want.PacketLoss != nil {
+			line = append(line, "loss", want.PacketLoss.String()+"%")
+		}
+		if want.Corrupt != nil {
+			line = append(line, "corrupt", want.Corrupt.String()+"%")
+		}
+		if want.Rate != nil {
+			line = append(line, "rate", FormatRate(*want.Rate))
+		}
+		line = append(line, "seed", "123")
+		qd := &Qdisc{Options: &QdiscOptions{}}
+		qdiscListNoJsonParseNetem(qd, line)
+		if qd.Options.NetemLimit == nil || *qd.Options.NetemLimit != 1000 {
+			t.Errorf("%s: limit %v, want 1000", strings.Join(line, " "), qd.Options.NetemLimit)
+		}
+		got := netemRule(qd)
+		if !equalPtr(got.Latency, want.Latency) || !equalPtr(got.Jitter, want.Jitter) || !equalPtr(got.PacketLoss, want.PacketLoss) ||
+			!equalPtr(got.Corrupt, want.Corrupt) || !equalPtr(got.Rate, want.Rate) {
+			t.Errorf("%s: read back as %s, want %s", strings.Join(line, " "), describeActions(got), describeActions(want))
+		}
+	}
+}
+
+func describeActions(r *Rule) string {
+	s := []string{}
+	if r.Latency != nil {
+		s = append(s, "latency "+FormatDuration(*r.Latency))
+	}
+	if r.Jitter != nil {
+		s = append(s, "jitter "+FormatDuration(*r.Jitter))
+	}
+	if r.PacketLoss != nil {
+		s = append(s, "loss "+r.PacketLoss.String())
+	}
+	if r.Corrupt != nil {
+		s = append(s, "corrupt "+r.Corrupt.String())
+	}
+	if r.Rate != nil {
+		s = append(s, "rate "+r.Rate.String())
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,172 @@
+package tc
+
+import (
+	"context"
+)
+
+// change the actions of an existing rule in place, keeping its filter, identity and, unless its qdisc is shared with other rules,
+// the counters of its qdisc; the rule is selected by the filter, name or filter handle of r, and actions which are not specified in r are left unchanged
+func (c *Client) Update(ctx context.Context, r *Rule) error {
+	unlock, err := c.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return c.undoOnError(ctx, func() error {
+		return c.updateRule(ctx, r)
+	})
+}
+
+func (c *Client) updateRule(ctx context.Context, r *Rule) error {
+	e := r.check()
+	r.checkHasSelector(e)
+	r.checkHasAction(e)
+	if err := e.errOrNil(); err != nil {
+		return err
+	}
+	rules, err := c.ListRules(ctx)
+	if err != nil {
+		return err
+	}
+
+	// list ifaces
+	ifaces, err := rules.selectIfaces(r.Iface)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, iface := range ifaces {
+		for _, rule := range rules.Rules {
+			if rule.Iface == nil || iface != *rule.Iface || rule.FilterHandle == nil || rule.PassThrough {
+				continue
+			}
+			if !r.selects(rule) {
+				continue
+			}
+			found = true
+			err = c.update(ctx, rule, r, rules)
+			if err != nil {
+				return err
+			}
+			break
+		}
+	}
+	if !found {
+		return ErrRuleNotFound
+	}
+	return c.cleanupUnusedQdisc(ctx)
+}
+
+func (c *Client) update(ctx context.Context, rule *Rule, r *Rule, rules *Rules) error {
+	// merge requested actions into the existing ones
+	n := &Rule{
+		Iface:           rule.Iface,
+		SourceIP:        rule.SourceIP,
+		SourcePort:      rule.SourcePort,
+		DestinationIP:   rule.DestinationIP,
+		DestinationPort: rule.DestinationPort,
+		DSCP:            rule.DSCP,
+		TOS:             rule.TOS,
+		Length:          rule.Length,
+		TCPFlags:        rule.TCPFlags,
+		Protocol:        rule.Protocol,
+		FwMark:          rule.FwMark,
+		Cgroup:          rule.Cgroup,
+		SourceSet:       rule.SourceSet,
+		DestinationSet:  rule.DestinationSet,
+		Priority:        rule.Priority,
+		AllTraffic:      rule.AllTraffic,
+		Latency:         rule.Latency,
+		Jitter:          rule.Jitter,
+		Distribution:    rule.Distribution,
+		PacketLoss:      rule.PacketLoss,
+		Rate:            rule.Rate,
+		Corrupt:         rule.Corrupt,
+		FlowID:          rule.FlowID,
+		QdiscHandle:     rule.QdiscHandle,
+		FilterHandle:    rule.FilterHandle,
+		ID:              rule.ID,
+		Name:            rule.Name,
+		Labels:          rule.Labels,
+	}
+	if r.Latency != nil {
+		n.Latency = r.Latency
+	}
+	if r.Jitter != nil {
+		n.Jitter = r.Jitter
+	}
+	if r.Distribution != nil {
+		n.Distribution = r.Distribution
+	}
+	if r.PacketLoss != nil {
+		n.PacketLoss = r.PacketLoss
+	}
+	if r.Rate != nil {
+		n.Rate = r.Rate
+	}
+	if r.Corrupt != nil {
+		n.Corrupt = r.Corrupt
+	}
+	e := &ValidationError{}
+	if n.Jitter != nil && n.Latency == nil {
+		e.add("Jitter", "requires Latency to be set")
+	}
+	if n.Distribution != nil && n.Jitter == nil {
+		e.add("Distribution", "requires Latency and Jitter to be set")
+	}
+	if err := e.errOrNil(); err != nil {
+		return err
+	}
+
+	// a qdisc shared with other filters cannot be changed in place, move this filter to its own qdisc first
+	shared := false
+	for _, other := range rules.Rules {
+		if other == rule || other.Iface == nil || *other.Iface != *rule.Iface || other.FilterHandle == nil {
+			continue
+		}
+		if other.FlowID != nil && rule.FlowID != nil && *other.FlowID == *rule.FlowID {
+			shared = true
+		}
+	}
+	if !shared {
+		err := c.tcExec(ctx, append([]string{"qdisc", "replace", "dev", *n.Iface, "parent", *n.FlowID, "handle", *n.QdiscHandle}, netemParams(n)...)...)
+		if err != nil {
+			return err
+		}
+		c.recordChange(ChangeModify, n, rule)
+		return c.writeDistribution(rule, n)
+	}
+
+	flowId, err := freeFlowId(rules, *rule.Iface)
+	if err != nil {
+		return err
+	}
+	n.FlowID, n.QdiscHandle = flowHandles(flowId)
+	err = c.tcExec(ctx, append([]string{"qdisc", "replace", "dev", *n.Iface, "parent", *n.FlowID, "handle", *n.QdiscHandle}, netemParams(n)...)...)
+	if err != nil {
+		return err
+	}
+	err = c.tcExec(ctx, append(append(filterArgs("replace", *rule.Iface, rule, rule.FilterHandle), replaceMatches(rule)...), "flowid", *n.FlowID)...)
+	if err != nil {
+		return err
+	}
+	c.recordChange(ChangeModify, n, rule)
+	// the rule list is reused for the next interface, keep it in sync
+	rule.FlowID = n.FlowID
+	rule.QdiscHandle = n.QdiscHandle
+	return c.writeDistribution(rule, n)
+}
+
+// record the distribution table of a rule which was updated to n, as tc does not list it
+func (c *Client) writeDistribution(rule *Rule, n *Rule) error {
+	if equalPtr(rule.Distribution, n.Distribution) {
+		return nil
+	}
+	return c.changeMeta(*rule.Iface, *rule.FilterHandle, func(meta *ruleMeta) *ruleMeta {
+		if meta != nil && meta.Match == matchKey(rule) {
+			meta.Distribution = PtrToString(n.Distribution)
+		}
+		return meta
+	})
+}